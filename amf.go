@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"net/url"
 	"reflect"
 	"strings"
 )
@@ -46,6 +47,7 @@ type AmfInfo struct {
 	Type           string
 	PublishName    string  // 可能带参数 cctv1?app=pgm0&tm=xxx
 	PublishType    string  // live/ record/ append
+	PlayName       string  // play cmd use, 可能带参数 cctv1?only=audio
 	StreamName     string  // play cmd use
 	Start          float64 // play cmd use
 	Duration       float64 // play cmd use, live is -1
@@ -152,6 +154,8 @@ func AmfDecode(s *Stream, r io.Reader) (interface{}, error) {
 		return Amf0DecodeNull(s, r)
 	case Amf0MarkerEcmaArray:
 		return Amf0DecodeEcmaArray(s, r)
+	case Amf0MarkerArray:
+		return Amf0DecodeStrictArray(s, r)
 	}
 	err = fmt.Errorf("Untreated AmfType %d", t)
 	s.log.Println(err)
@@ -248,6 +252,28 @@ func Amf0DecodeEcmaArray(s *Stream, r io.Reader) (Object, error) {
 	return ret, nil
 }
 
+// 4byte的个数, 然后是N个任意amf数据类型
+func Amf0DecodeStrictArray(s *Stream, r io.Reader) ([]interface{}, error) {
+	len, err := ReadUint32(r, 4, BE)
+	if err != nil {
+		if err != io.EOF {
+			s.log.Println(err)
+		}
+		return nil, err
+	}
+
+	var ret []interface{}
+	for i := uint32(0); i < len; i++ {
+		v, err := AmfDecode(s, r)
+		if err != nil {
+			s.log.Println(err)
+			return nil, err
+		}
+		ret = append(ret, v)
+	}
+	return ret, nil
+}
+
 /////////////////////////////////////////////////////////////////
 // amf encode
 /////////////////////////////////////////////////////////////////
@@ -282,6 +308,8 @@ func AmfEncode(s *Stream, buf io.Writer, v interface{}) (int, error) {
 		return Amf0EncodeNumber(s, buf, float64(val.Float()))
 	case reflect.Map:
 		return Amf0EncodeObject(s, buf, v.(Object))
+	case reflect.Slice:
+		return Amf0EncodeStrictArray(s, buf, val)
 	}
 	err := fmt.Errorf("Untreated Amf0Marker %s", val.Kind())
 	s.log.Println(err)
@@ -386,6 +414,24 @@ func Amf0EncodeObject(s *Stream, buf io.Writer, o Object) (int, error) {
 	return n + 1, nil
 }
 
+// 如flv文件onMetaData里的 keyframes.times 和 keyframes.filepositions
+func Amf0EncodeStrictArray(s *Stream, buf io.Writer, val reflect.Value) (int, error) {
+	b := []byte{Amf0MarkerArray}
+	buf.Write(b)
+	WriteUint32(buf, BE, uint32(val.Len()), 4)
+	n := 5
+
+	for i := 0; i < val.Len(); i++ {
+		m, err := AmfEncode(s, buf, val.Index(i).Interface())
+		if err != nil {
+			s.log.Println(err)
+			return 0, err
+		}
+		n += m
+	}
+	return n, nil
+}
+
 /////////////////////////////////////////////////////////////////
 // amf command handle
 /////////////////////////////////////////////////////////////////
@@ -557,7 +603,13 @@ func AmfPlayHandle(s *Stream, vs []interface{}) error {
 			if k == 0 {
 				s.AmfInfo.CmdName = v.(string)
 			} else if k == 3 {
-				s.AmfInfo.StreamName = v.(string)
+				s.AmfInfo.PlayName = v.(string)
+				ss := strings.SplitN(s.AmfInfo.PlayName, "?", 2)
+				s.AmfInfo.StreamName = ss[0]
+				if len(ss) == 2 {
+					q, _ := url.ParseQuery(ss[1])
+					s.PlayOnly = PlayOnlyParse(q.Get("only"))
+				}
 			}
 		case float64:
 			if k == 1 {
@@ -1,6 +1,6 @@
 #!/bin/bash
 
-go build -o sms main.go http.go rtmp.go serialize.go amf.go flv.go hls.go sip.go
+go build -o sms main.go http.go rtmp.go serialize.go amf.go flv.go hls.go sip.go record.go mp4.go vod.go filelive.go websocket.go httpts.go llhls.go hlsfmp4.go dash.go hlsstore.go hlsencrypt.go hlsplaylist.go hlsarchive.go hlsstate.go hlsmaster.go hlsmeta.go hlscaption.go hlsondemand.go
 echo "==========================================="
 rm -rf sms.log
 rm -rf streamlog
@@ -0,0 +1,510 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"time"
+)
+
+/**********************************************************/
+/* dash
+/**********************************************************/
+// https://dashif.org/docs/DASH-IF-IOP-v4.3.pdf
+// DashEnable 为true时 开启, 每个发布者一个dash生产协程
+// HlsFormat为fmp4时 直接用hls的 init.mp4 和 m4s, 不再切片, 见DashSharedInit()
+// 否则音视频各自生成 init.mp4 和 m4s, dash.js等播放器 要求音视频分开
+// live_yuankang.mpd                   动态mpd, 每个切片完成后更新
+// live_yuankang_video_0_init.mp4      视频初始化切片, 文件名里是Period的id
+// live_yuankang_video_180000.m4s      视频切片, 文件名里是切片开始的时间, 单位为track的timescale
+// live_yuankang_audio_0_init.mp4      音频初始化切片
+// live_yuankang_audio_88200.m4s       音频切片
+// 发布中音视频头变了(如 分辨率变了), 下一个关键帧开始新的Period 并生成新的init.mp4
+// 之前的切片 还在之前的Period里 用之前的init.mp4, 切片都淘汰后 删除之前的init.mp4
+// 切片规则和hls一样: >= HlsTsMaxTime 且 为关键帧才会截断
+// 保留的切片也和hls一样 按HlsPlaylist的规则: live保留HlsM3u8TsNum个, event都保留, dvr保留DvrMinutes分钟
+// timeShiftBufferDepth 是mpd里切片的总时长
+type DashInfo struct {
+	LogDashFn       string       // 文件名 包括路径
+	logDash         *log.Logger  // 每个发布者、播放者的日志都是独立的
+	MpdPath         string       // mpd文件路径, 包含文件名
+	DashVideoHeader *Chunk       // 视频init.mp4里要用
+	DashAudioHeader *Chunk       // 音频init.mp4里要用
+	DashVideo       *Mp4Muxer    // 视频切片的封装器, 没有视频时为nil
+	DashAudio       *Mp4Muxer    // 音频切片的封装器, 没有音频时为nil
+	DashStartTime   time.Time    // 第一个切片开始的时间, mpd的availabilityStartTime
+	DashFirstTs     uint32       // 当前切片中第一个时间戳, 单位为毫秒
+	DashStartTs     uint32       // 第一个切片中第一个时间戳, 换算为presentationTimeOffset
+	DashSegList     *list.List   // 存储切片信息, 双向链表, 删头追尾
+	DashShared      bool         // 用hls的fmp4切片, 没有DashCreator()
+	DashInitPath    string       // 共用时 mpd里的init.mp4, 和hls的不同时 之前的切片不能再用
+	DashPlType      string       // live / event / dvr, 见HlsPlaylistTypeGet()
+	DashDvrTime     float64      // dvr时 mpd里切片的最大总时长, 单位为秒
+	DashListTime    float64      // mpd里切片的总时长, 单位为秒
+	DashPeriods     []DashPeriod // mpd里的Period, 最后一个是正在生成的
+	DashInitNew     bool         // 音视频头变了, 下一个关键帧开始新的Period
+}
+
+// DashVideo/DashAudio 是最后一个Period的封装器, 之前的只用来生成mpd
+type DashPeriod struct {
+	Id      uint32
+	StartTs uint32    // 第一个切片中第一个时间戳, 单位为毫秒
+	Video   *Mp4Muxer // 没有视频时为nil
+	Audio   *Mp4Muxer // 没有音频时为nil
+}
+
+// 一个切片 音视频各一个m4s, 共用hls的m4s时 只有Video 里面有音视频
+type DashSeg struct {
+	Duration float64 // 单位为秒
+	Number   uint32  // 共用hls的m4s时 是切片的序号
+	Period   uint32  // 属于哪个Period, 共用hls的m4s时 为0
+	Video    DashTrackSeg
+	Audio    DashTrackSeg
+}
+
+type DashTrackSeg struct {
+	Path     string // m4s存储路径 包含文件名, 为空表示这个切片里没有数据
+	Time     uint64 // 切片开始的时间, 单位为track的timescale
+	Duration uint64 // 单位为track的timescale
+	Size     int
+}
+
+var mpdHead = `<?xml version="1.0" encoding="utf-8"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" profiles="urn:mpeg:dash:profile:isoff-live:2011" type="dynamic"
+    availabilityStartTime="%s" publishTime="%s" minimumUpdatePeriod="PT%dS"
+    minBufferTime="PT%dS" timeShiftBufferDepth="PT%.3fS" suggestedPresentationDelay="PT%dS">
+`
+
+var mpdPeriod = `
+  <Period id="%d" start="PT%.3fS">%s
+  </Period>`
+
+var mpdTail = `
+</MPD>
+`
+
+var mpdVideo = `
+    <AdaptationSet id="0" contentType="video" mimeType="video/mp4" segmentAlignment="true" startWithSAP="1">
+      <Representation id="video" codecs="%s" width="%d" height="%d" bandwidth="%d">
+        <SegmentTemplate timescale="%d" presentationTimeOffset="%d" initialization="%s" media="%s">
+          <SegmentTimeline>%s
+          </SegmentTimeline>
+        </SegmentTemplate>
+      </Representation>
+    </AdaptationSet>`
+
+var mpdAudio = `
+    <AdaptationSet id="1" contentType="audio" mimeType="audio/mp4" segmentAlignment="true" startWithSAP="1">
+      <Representation id="audio" codecs="%s" audioSamplingRate="%d" bandwidth="%d">
+        <AudioChannelConfiguration schemeIdUri="urn:mpeg:dash:23003:3:audio_channel_configuration:2011" value="%d"/>
+        <SegmentTemplate timescale="%d" presentationTimeOffset="%d" initialization="%s" media="%s">
+          <SegmentTimeline>%s
+          </SegmentTimeline>
+        </SegmentTemplate>
+      </Representation>
+    </AdaptationSet>`
+
+var mpdShared = `
+    <AdaptationSet id="0" mimeType="%s" segmentAlignment="true" startWithSAP="1">
+      <Representation id="0" codecs="%s"%s bandwidth="%d">
+        <SegmentTemplate timescale="1000" presentationTimeOffset="%d" startNumber="%d" initialization="%s" media="%s">
+          <SegmentTimeline>%s
+          </SegmentTimeline>
+        </SegmentTemplate>
+      </Representation>
+    </AdaptationSet>`
+
+/**********************************************************/
+/* DashCreator()
+/**********************************************************/
+func DashCreator(s *Stream) {
+	s.LogDashFn = fmt.Sprintf("%s%s/%s_dashCreator_%s.log", conf.LogStreamPath, s.Key, s.Key, s.RemoteAddr)
+	s.logDash, _ = StreamLogCreate(s.LogDashFn)
+
+	folder := fmt.Sprintf("%s%s", conf.HlsSavePath, s.Key)
+	err := os.MkdirAll(folder, 0755)
+	if err != nil {
+		log.Println(err)
+		for range s.DashChan { // 不生成dash, 但要读取数据 避免阻塞发布者
+		}
+		return
+	}
+	s.MpdPath = fmt.Sprintf("%s/%s.mpd", folder, s.Key)
+	s.logDash.Println("mpdPath is", s.MpdPath)
+	s.DashSegList = list.New()
+	s.DashPlType, s.DashDvrTime = HlsPlaylistTypeGet(s.AmfInfo.App, s.logDash)
+	s.logDash.Printf("playlist type is %s, dvr time %.0fs", s.DashPlType, s.DashDvrTime)
+
+	for {
+		c, ok := <-s.DashChan
+		if !ok {
+			s.logDash.Printf("%s DashCreator stop", s.Key)
+			HlsMemClear(folder)
+			return
+		}
+
+		switch c.DataType {
+		case "Metadata", "DataFrame", "AudioFrame": // fmp4音频只支持aac
+			continue
+		case "VideoHeader":
+			DashHeaderCheck(s, s.DashVideoHeader, c)
+			s.DashVideoHeader = c
+			continue
+		case "AudioHeader":
+			DashHeaderCheck(s, s.DashAudioHeader, c)
+			s.DashAudioHeader = c
+			continue
+		}
+		DashCreate(s, c)
+	}
+}
+
+// 和Fmp4HeaderCheck()一样, 第一次收到 或 没变时 不用换init.mp4
+func DashHeaderCheck(s *Stream, old, c *Chunk) {
+	if (s.DashVideo == nil && s.DashAudio == nil) || old == nil || bytes.Equal(old.MsgData, c.MsgData) {
+		return
+	}
+	s.logDash.Printf("%s changed, new period at next keyframe", c.DataType)
+	s.DashInitNew = true
+}
+
+// 有视频时 只在关键帧处开始和切分, 只有音频时 任意音频帧都可以
+func DashIsKeyFrame(s *Stream, c *Chunk) bool {
+	if c.DataType == "VideoKeyFrame" {
+		return true
+	}
+	return s.DashVideoHeader == nil && c.DataType == "AudioAacFrame"
+}
+
+func DashCreate(s *Stream, c *Chunk) {
+	if DashIsKeyFrame(s, c) {
+		if s.DashVideo == nil && s.DashAudio == nil {
+			if err := DashInitCreate(s, c); err != nil {
+				s.logDash.Println(err)
+				return
+			}
+		} else if s.DashInitNew {
+			DashSegCreate(s, c)
+			if err := DashInitCreate(s, c); err != nil {
+				s.logDash.Println(err) // 下一个关键帧再试
+				s.DashVideo, s.DashAudio = nil, nil
+				return
+			}
+		} else if (c.Timestamp-s.DashFirstTs)/1000 >= conf.HlsTsMaxTime {
+			DashSegCreate(s, c)
+		}
+	}
+	// 第一个关键帧之前的数据 丢弃
+	if s.DashVideo == nil && s.DashAudio == nil {
+		return
+	}
+
+	switch c.MsgTypeId {
+	case MsgTypeIdVideo:
+		if s.DashVideo != nil {
+			Mp4SampleAdd(s.DashVideo, c, c.Timestamp)
+		}
+	case MsgTypeIdAudio:
+		if s.DashAudio != nil {
+			Mp4SampleAdd(s.DashAudio, c, c.Timestamp)
+		}
+	}
+}
+
+// 音视频头 必须在第一个帧之前到达, init.mp4的moov里要用
+// 每次调用 开始一个新的Period
+func DashInitCreate(s *Stream, c *Chunk) error {
+	s.DashInitNew = false
+	p := DashPeriod{StartTs: c.Timestamp}
+	if n := len(s.DashPeriods); n > 0 {
+		p.Id = s.DashPeriods[n-1].Id + 1
+	}
+	var err error
+	if s.DashVideoHeader != nil {
+		p.Video, err = Mp4MuxerNew(s.DashVideoHeader, nil)
+		if err != nil {
+			return err
+		}
+		err = HlsFileWrite(DashInitFilename(s, "video", p.Id), Mp4InitCreate(p.Video))
+		if err != nil {
+			return err
+		}
+	}
+	if s.DashAudioHeader != nil {
+		p.Audio, err = Mp4MuxerNew(nil, s.DashAudioHeader)
+		if err != nil {
+			return err
+		}
+		err = HlsFileWrite(DashInitFilename(s, "audio", p.Id), Mp4InitCreate(p.Audio))
+		if err != nil {
+			return err
+		}
+	}
+	if p.Video == nil && p.Audio == nil {
+		return fmt.Errorf("no video header and no audio header")
+	}
+
+	if s.DashStartTime.IsZero() {
+		s.DashStartTime = time.Now()
+		s.DashStartTs = c.Timestamp
+	}
+	s.DashVideo, s.DashAudio = p.Video, p.Audio
+	s.DashPeriods = append(s.DashPeriods, p)
+	s.DashFirstTs = c.Timestamp
+	s.logDash.Printf("dash period %d start, timestamp=%d", p.Id, c.Timestamp)
+	return nil
+}
+
+// live_yuankang_video_0_init.mp4
+func DashInitFilename(s *Stream, typ string, id uint32) string {
+	return DashFilename(s, typ, fmt.Sprintf("%d_init.mp4", id))
+}
+
+// live_yuankang_video_180000.m4s
+func DashFilename(s *Stream, typ, name string) string {
+	return fmt.Sprintf("%s%s/%s_%s_%s", conf.HlsSavePath, s.Key, s.Key, typ, name)
+}
+
+// c是下一个切片的第一个数据
+func DashSegCreate(s *Stream, c *Chunk) {
+	seg := DashSeg{Duration: float64(c.Timestamp-s.DashFirstTs) / 1000}
+	if n := len(s.DashPeriods); n > 0 {
+		seg.Period = s.DashPeriods[n-1].Id
+	}
+	if s.DashVideo != nil {
+		seg.Video = DashTrackSegCreate(s, s.DashVideo, s.DashVideo.Video, "video")
+	}
+	if s.DashAudio != nil {
+		seg.Audio = DashTrackSegCreate(s, s.DashAudio, s.DashAudio.Audio, "audio")
+	}
+	s.DashFirstTs = c.Timestamp
+
+	for HlsEvictCheck(s.DashPlType, s.DashDvrTime, uint32(s.DashSegList.Len()), s.DashListTime, seg.Duration) {
+		e := s.DashSegList.Front()
+		old := (e.Value).(DashSeg)
+		if old.Video.Path != "" {
+			HlsFileRemove(old.Video.Path)
+		}
+		if old.Audio.Path != "" {
+			HlsFileRemove(old.Audio.Path)
+		}
+		s.DashSegList.Remove(e)
+		s.DashListTime -= old.Duration
+		DashPeriodRemove(s)
+	}
+	s.DashSegList.PushBack(seg)
+	s.DashListTime += seg.Duration
+	MpdUpdate(s)
+}
+
+// 切片淘汰后调用, 之前的Period 没有切片了 就删除它和它的init.mp4
+func DashPeriodRemove(s *Stream) {
+	e := s.DashSegList.Front()
+	for len(s.DashPeriods) > 1 && (e == nil || (e.Value).(DashSeg).Period > s.DashPeriods[0].Id) {
+		p := s.DashPeriods[0]
+		if p.Video != nil {
+			HlsFileRemove(DashInitFilename(s, "video", p.Id))
+		}
+		if p.Audio != nil {
+			HlsFileRemove(DashInitFilename(s, "audio", p.Id))
+		}
+		s.DashPeriods = s.DashPeriods[1:]
+		s.logDash.Printf("dash period %d removed", p.Id)
+	}
+}
+
+// Period里有切片才写入mpd
+func DashPeriodHasSeg(s *Stream, id uint32) bool {
+	for e := s.DashSegList.Front(); e != nil; e = e.Next() {
+		if (e.Value).(DashSeg).Period == id {
+			return true
+		}
+	}
+	return false
+}
+
+// 把还没写入的sample 生成一个 moof + mdat 写入m4s
+// 最后一个sample的时长 无法计算, 用前一个的, 所以切片时长会有很小的误差
+func DashTrackSegCreate(s *Stream, m *Mp4Muxer, t *Mp4Track, typ string) DashTrackSeg {
+	var ts DashTrackSeg
+	if len(t.Samples) == 0 {
+		return ts
+	}
+	ts.Time = t.Samples[0].Dts
+	d := Mp4FragmentCreate(m, 0)
+	ts.Duration = t.Duration - ts.Time
+	ts.Size = len(d)
+
+	fn := DashFilename(s, typ, fmt.Sprintf("%d.m4s", ts.Time))
+	if err := HlsFileWrite(fn, d); err != nil {
+		s.logDash.Println(err)
+		return DashTrackSeg{}
+	}
+	s.logDash.Printf("%s, time %d, duration %d, size %d", fn, ts.Time, ts.Duration, ts.Size)
+	ts.Path = fn
+	return ts
+}
+
+func MpdUpdate(s *Stream) {
+	var depth float64
+	for e := s.DashSegList.Front(); e != nil; e = e.Next() {
+		depth += (e.Value).(DashSeg).Duration
+	}
+
+	td := conf.HlsTsMaxTime
+	mpd := fmt.Sprintf(mpdHead, s.DashStartTime.UTC().Format(time.RFC3339),
+		time.Now().UTC().Format(time.RFC3339), td, td, depth, 3*td)
+	if s.DashShared {
+		mpd += fmt.Sprintf(mpdPeriod, 0, 0.0, MpdSharedCreate(s))
+	}
+	// Period的start 是相对于availabilityStartTime的时间
+	for _, p := range s.DashPeriods {
+		if !DashPeriodHasSeg(s, p.Id) {
+			continue
+		}
+		var as string
+		if p.Video != nil {
+			as += MpdVideoCreate(s, p)
+		}
+		if p.Audio != nil {
+			as += MpdAudioCreate(s, p)
+		}
+		mpd += fmt.Sprintf(mpdPeriod, p.Id, float64(p.StartTs-s.DashStartTs)/1000, as)
+	}
+	mpd += mpdTail
+
+	if err := HlsFileWrite(s.MpdPath, []byte(mpd)); err != nil {
+		s.logDash.Printf("Write %s fail, %s", s.MpdPath, err)
+	}
+}
+
+// 只有这个Period的切片, presentationTimeOffset 是Period开始的时间
+func MpdVideoCreate(s *Stream, p DashPeriod) string {
+	t := p.Video.Video
+	tl, bw := MpdTimelineCreate(s, func(seg DashSeg) DashTrackSeg {
+		if seg.Period != p.Id {
+			return DashTrackSeg{}
+		}
+		return seg.Video
+	}, t.Timescale)
+	pto := uint64(p.StartTs) * uint64(t.Timescale) / 1000
+	return fmt.Sprintf(mpdVideo, t.Codec, t.Width, t.Height, bw, t.Timescale, pto,
+		path.Base(DashInitFilename(s, "video", p.Id)),
+		path.Base(DashFilename(s, "video", "$Time$.m4s")), tl)
+}
+
+func MpdAudioCreate(s *Stream, p DashPeriod) string {
+	t := p.Audio.Audio
+	tl, bw := MpdTimelineCreate(s, func(seg DashSeg) DashTrackSeg {
+		if seg.Period != p.Id {
+			return DashTrackSeg{}
+		}
+		return seg.Audio
+	}, t.Timescale)
+	pto := uint64(p.StartTs) * uint64(t.Timescale) / 1000
+	return fmt.Sprintf(mpdAudio, t.Codec, t.SampleRate, bw, t.ChannelNum, t.Timescale, pto,
+		path.Base(DashInitFilename(s, "audio", p.Id)),
+		path.Base(DashFilename(s, "audio", "$Time$.m4s")), tl)
+}
+
+// 返回 SegmentTimeline 和 码率(bit/s)
+func MpdTimelineCreate(s *Stream, get func(DashSeg) DashTrackSeg, timescale uint32) (string, int) {
+	var tl string
+	var size, duration uint64
+	for e := s.DashSegList.Front(); e != nil; e = e.Next() {
+		ts := get((e.Value).(DashSeg))
+		if ts.Path == "" {
+			continue
+		}
+		tl += fmt.Sprintf("\n            <S t=\"%d\" d=\"%d\"/>", ts.Time, ts.Duration)
+		size += uint64(ts.Size)
+		duration += ts.Duration
+	}
+	if duration == 0 {
+		return tl, 1
+	}
+	bw := math.Ceil(float64(size*8) * float64(timescale) / float64(duration))
+	return tl, int(bw)
+}
+
+/**********************************************************/
+/* 共用hls的fmp4切片
+/**********************************************************/
+// 一个Representation里 音视频在一起(ExoPlayer/shaka可以播放), 时间单位为毫秒
+// 切片名是序号, 所以用 $Number$, 切片移出m3u8时 也移出mpd
+// hls加密 或 按需生成时 hls的m4s不一定有, 还是单独生成音视频切片
+func DashSharedInit(s *Stream) bool {
+	if !HlsIsFmp4() || s.HlsOdEnable {
+		return false
+	}
+	if _, ok := HlsEncryptRuleGet(s.AmfInfo.App); ok {
+		return false
+	}
+	s.DashShared = true
+	s.MpdPath = fmt.Sprintf("%s%s/%s.mpd", conf.HlsSavePath, s.Key, s.Key)
+	s.DashSegList = list.New()
+	return true
+}
+
+// M3u8Update()里调用, c是下一个切片的第一个数据, s.TsFirstTs还是完成的切片的
+func MpdSharedUpdate(s *Stream, c *Chunk) {
+	if !s.DashShared {
+		return
+	}
+	s.logDash = s.logHls
+	if s.DashInitPath != s.HlsInitPath {
+		s.DashInitPath = s.HlsInitPath
+		s.DashSegList.Init()
+	}
+	d := c.Timestamp - s.TsFirstTs
+	if s.DashStartTime.IsZero() {
+		s.DashStartTime = time.Now().Add(-time.Duration(d) * time.Millisecond)
+		s.DashStartTs = s.TsFirstTs
+	}
+	size, _ := HlsFileSize(s.TsPath)
+	seg := DashSeg{Duration: float64(d) / 1000, Number: s.TsLastSeq - 1}
+	seg.Video = DashTrackSeg{s.TsPath, uint64(s.TsFirstTs), uint64(d), int(size)}
+	s.DashSegList.PushBack(seg)
+	// 文件由hls删除
+	for e := s.DashSegList.Front(); e != nil && (e.Value).(DashSeg).Number < s.TsFirstSeq; e = s.DashSegList.Front() {
+		s.DashSegList.Remove(e)
+	}
+	MpdUpdate(s)
+}
+
+func MpdSharedCreate(s *Stream) string {
+	e := s.DashSegList.Front()
+	if e == nil {
+		return ""
+	}
+	tl, bw := MpdTimelineCreate(s, func(seg DashSeg) DashTrackSeg { return seg.Video }, 1000)
+	mime, res := "audio/mp4", ""
+	if HlsHasVideo(s) {
+		mime = "video/mp4"
+		res = fmt.Sprintf(" width=\"%d\" height=\"%d\"", s.HlsWidth, s.HlsHeight)
+	}
+	return fmt.Sprintf(mpdShared, mime, s.HlsCodecs, res, bw, s.DashStartTs, (e.Value).(DashSeg).Number,
+		path.Base(s.DashInitPath), fmt.Sprintf("%s_$Number$.m4s", s.Key), tl)
+}
+
+/**********************************************************/
+/* http
+/**********************************************************/
+// http://127.0.0.1/live/yuankang.mpd
+// live_yuankang/live_yuankang.mpd
+func GetMpd(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	app, stream, _ := GetPlayInfo(r.URL.Path)
+	file := fmt.Sprintf("%s%s_%s/%s_%s.mpd", conf.HlsSavePath, app, stream, app, stream)
+
+	d, err := HlsFileRead(file)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	return d, nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/**********************************************************/
+/* file live
+/**********************************************************/
+// flv/mp4文件 循环播放作为直播流, 用于测试频道和垫片
+// 在配置文件的FileLive里配置, 或者通过接口开启和关闭
+// POST /api/filelive/start?token=xxx {"App":"live", "Stream":"test", "File":"live/cctv1/cctv1_20220405102030.flv"}
+// 接口开启时 File必须在FileLivePath下, 配置文件里的不限制
+// POST /api/filelive/stop?token=xxx  {"App":"live", "Stream":"test"}
+// token必须和FileLiveToken相同, FileLiveToken为空时 接口不能用
+// 和rtmp推流一样 存入Publishers, rtmp/flv/hls播放 和录制都不需要区分
+// 循环播放时 时间戳是连续递增的, 播放者感知不到文件重新开始
+func FileLiveStart(fl FileLive) error {
+	fn := fl.File
+	if !filepath.IsAbs(fn) {
+		fn = filepath.Join(conf.WorkDir, fn)
+	}
+	if ext := filepath.Ext(fn); ext != ".flv" && ext != ".mp4" {
+		return fmt.Errorf("%s isn't flv or mp4 file", fn)
+	}
+	if fl.App == "" || fl.Stream == "" {
+		return fmt.Errorf("App and Stream can't be empty")
+	}
+
+	s := NewStream(nil)
+	s.StreamType = "filePublisher"
+	s.IsPublisher = true
+	s.AmfInfo.App = fl.App
+	s.AmfInfo.StreamName = fl.Stream
+	s.RemoteAddr = "file"
+	s.FileLiveQuit = make(chan struct{}, 1)
+
+	s.Key = fmt.Sprintf("%s_%s", s.AmfInfo.App, s.AmfInfo.StreamName)
+	s.log.Println("publisher key is", s.Key)
+
+	// 失败时删除临时日志, 成功后才重命名 否则会覆盖已存在发布者的日志
+	v, err := VodFileOpen(s, fn)
+	if err != nil {
+		os.Remove(s.LogFilename)
+		return err
+	}
+	if len(v.Tags) == 0 {
+		v.File.Close()
+		os.Remove(s.LogFilename)
+		return fmt.Errorf("%s has no audio and video", fn)
+	}
+
+	if !PublisherStart(s) {
+		v.File.Close()
+		os.Remove(s.LogFilename)
+		return fmt.Errorf("publisher %s is exist", s.Key)
+	}
+	StreamLogRename(s, "file")
+	log.Printf("file live %s start, file is %s", s.Key, fn)
+	go FileLivePublisher(s, v)
+	return nil
+}
+
+func FileLiveStop(app, stream string) error {
+	key := fmt.Sprintf("%s_%s", app, stream)
+	s, ok := PublisherGet(key)
+	if !ok || s.StreamType != "filePublisher" {
+		return fmt.Errorf("file live %s isn't exist", key)
+	}
+	log.Printf("file live %s stop", key)
+	// 多次停止时 不阻塞, FileLivePublisher()只需要收到一次
+	select {
+	case s.FileLiveQuit <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func FileLiveTokenCheck(r *http.Request) error {
+	if conf.FileLiveToken == "" {
+		return &HttpError{403, "file live api is disabled"}
+	}
+	token := r.URL.Query().Get("token")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(conf.FileLiveToken)) != 1 {
+		return &HttpError{403, "file live api token is wrong"}
+	}
+	return nil
+}
+
+func FileLiveStartApi(d []byte) ([]byte, error) {
+	var fl FileLive
+	if err := json.Unmarshal(d, &fl); err != nil {
+		return nil, err
+	}
+	fn, err := FileLiveApiFilename(fl.File)
+	if err != nil {
+		return nil, err
+	}
+	fl.File = fn
+	if err := FileLiveStart(fl); err != nil {
+		return nil, err
+	}
+	return GetRsps(200, "ok"), nil
+}
+
+// 接口传入的文件 不能在FileLivePath以外, 相对路径是相对于FileLivePath
+func FileLiveApiFilename(fn string) (string, error) {
+	root := filepath.Clean(conf.FileLivePath)
+	if !filepath.IsAbs(fn) {
+		fn = filepath.Join(root, fn)
+	}
+	fn = filepath.Clean(fn)
+	if !strings.HasPrefix(fn, root+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s isn't in %s", fn, root)
+	}
+	return fn, nil
+}
+
+func FileLiveStopApi(d []byte) ([]byte, error) {
+	var fl FileLive
+	if err := json.Unmarshal(d, &fl); err != nil {
+		return nil, err
+	}
+	if err := FileLiveStop(fl.App, fl.Stream); err != nil {
+		return nil, err
+	}
+	return GetRsps(200, "ok"), nil
+}
+
+// 和RtmpPublisher()一样, 数据处理后 传递给发送协程
+// 每循环一次, 时间戳增加 文件时长 + 一帧的间隔
+func FileLivePublisher(s *Stream, v *VodFile) {
+	defer v.File.Close()
+
+	for _, h := range []struct {
+		TypeId uint32
+		Data   []byte
+	}{
+		{MsgTypeIdDataAmf0, v.MetaData},
+		{MsgTypeIdVideo, v.VideoHeader},
+		{MsgTypeIdAudio, v.AudioHeader},
+	} {
+		if h.Data == nil {
+			continue
+		}
+		c := VodChunkCreate(h.TypeId, 0, h.Data)
+		if err := MediaHandle(s, c); err != nil {
+			s.log.Println(err)
+			continue
+		}
+		s.DataChan <- c
+	}
+
+	first := v.Tags[0].Timestamp
+	last := v.Tags[len(v.Tags)-1].Timestamp
+	var base uint32 // 当前循环的起始时间戳
+	t0 := time.Now()
+	for n := 0; ; n++ {
+		s.log.Printf("%s file live loop %d, base timestamp %d", s.Key, n, base)
+		for i := range v.Tags {
+			t := &v.Tags[i]
+			ts := base
+			if t.Timestamp > first { // 时间戳比第一个tag小时 不能相减, 否则溢出
+				ts += t.Timestamp - first
+			}
+			// FileLiveStop()在http协程里调用, 等待时也要能及时停止
+			wait := time.Duration(ts)*time.Millisecond - time.Since(t0)
+			if wait < 0 {
+				wait = 0
+			}
+			select {
+			case <-s.FileLiveQuit:
+				s.log.Printf("%s FileLivePublisher stop", s.Key)
+				RtmpPublishStop(s)
+				return
+			case <-time.After(wait):
+			}
+
+			d, err := VodTagRead(v, t)
+			if err != nil {
+				s.log.Println(err)
+				s.log.Printf("%s FileLivePublisher stop", s.Key)
+				RtmpPublishStop(s)
+				return
+			}
+			c := VodChunkCreate(uint32(t.TagType), ts, d)
+			if err = MediaHandle(s, c); err != nil {
+				s.log.Println(err)
+				continue
+			}
+			s.DataChan <- c
+		}
+		if last > first {
+			base += last - first
+		}
+		base += FileLiveGap(v)
+	}
+}
+
+// 一帧的间隔, 避免循环时 前后两帧的时间戳相同
+func FileLiveGap(v *VodFile) uint32 {
+	n := len(v.Tags)
+	for i := n - 2; i >= 0; i-- {
+		if v.Tags[i].TagType != v.Tags[n-1].TagType {
+			continue
+		}
+		if v.Tags[n-1].Timestamp > v.Tags[i].Timestamp {
+			return v.Tags[n-1].Timestamp - v.Tags[i].Timestamp
+		}
+		break
+	}
+	return 40
+}
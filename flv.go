@@ -2,108 +2,96 @@ package main
 
 import (
 	"container/list"
-	"encoding/json"
 	"fmt"
+	"io"
 	"log"
-	"net"
 	"net/http"
 	"strconv"
 )
 
-type FlvPlayInfo struct {
-	App    string
-	Stream string
-	Client string
-}
-
 /**********************************************************/
-/* for http
+/* http-flv
 /**********************************************************/
-// 0xff + len(1 Byte) + data(len Byte)
-func FlvRecv(fpi FlvPlayInfo) (net.Conn, error) {
-	data, err := json.Marshal(fpi)
-	if err != nil {
-		log.Println(err)
-		return nil, err
+// http-flv播放者 直接存入发布者的Players里
+// 发布者的发送协程 把flv数据直接写到http.ResponseWriter
+// http协程 要等到发送失败、发布者结束 或 客户端断开 才能返回
+// GET http://www.domain.com/live/yuankang.flv
+// GET http://www.domain.com/live/yuankang.flv?only=audio 只播放音频, video只播放视频
+func GetFlv(w http.ResponseWriter, r *http.Request) {
+	p, err := FlvPublisherGet(r)
+	if err != nil { // 发布者不存在, 返回错误
+		FlvRspsErr(w, err)
+		return
 	}
-	//log.Println(data)
+	s := FlvPlayerNew(r, w, "flv")
 
-	// 127.0.0.1:1935, 配置文件中的端口 可能会被修改
-	addr := fmt.Sprintf("127.0.0.1%s", conf.RtmpListen)
-	c, err := net.Dial("tcp", addr)
-	if err != nil {
-		log.Println(err)
-		return nil, err
-	}
+	// 不设置Content-length, 会使用chunked方式发送
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Connection", "Keep-Alive")
+	w.Header().Set("Content-Type", "video/x-flv")
+	w.Header().Set("Server", AppName)
+	w.WriteHeader(http.StatusOK)
+	FlvFlush(s)
 
-	err = WriteUint8(c, 0xff)
-	if err != nil {
-		log.Println(err)
-		return nil, err
+	PlayerAdd(p, s)
+	select {
+	case <-s.HttpDone:
+	case <-r.Context().Done():
 	}
-	err = WriteUint8(c, uint8(len(data)))
-	if err != nil {
-		log.Println(err)
-		return nil, err
+	// 删除后 发送协程就不会再写http.ResponseWriter了
+	PlayerDelete(p, s)
+	s.log.Printf("%s FlvPlayer stop", s.Key)
+}
+
+// websocket-flv播放者, 和http-flv一样 只是flv数据放在websocket的二进制帧里
+// 每个flv tag是一个帧, flv头(9字节+PreviousTagSize0)也是一个帧
+// 用于不支持chunked方式的环境, flv.js/mpegts.js都支持
+// ws://www.domain.com/live/yuankang.flv
+// wss://www.domain.com/live/yuankang.flv
+func GetWsFlv(w http.ResponseWriter, r *http.Request) {
+	p, err := FlvPublisherGet(r)
+	if err != nil { // 握手前 还能用http返回错误
+		FlvRspsErr(w, err)
+		return
 	}
-	_, err = WriteByte(c, data)
+	ws, err := WsUpgrade(w, r)
 	if err != nil {
 		log.Println(err)
-		return nil, err
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-	return c, nil
-}
-
-func FlvSend(c net.Conn, w http.ResponseWriter) {
-	buf := make([]byte, 4096)
-	var n, m int = 0, 0
-	var err error
+	s := FlvPlayerNew(r, ws, "wsflv")
 
-	defer func() {
-		c.Close()
-		buf = nil
-	}()
-
-	for {
-		n, err = c.Read(buf[:])
-		//log.Println("flvRead", n, err, len(buf))
-		if err != nil || n == 0 {
-			log.Println("receive data error.", err)
-			break
+	// 客户端关闭或断开时 通知本协程
+	go func() {
+		if err := WsReceiver(ws); err != nil {
+			s.log.Println(err)
 		}
+		PlayerStop(s)
+	}()
 
-		m, err = w.Write(buf[:n])
-		//log.Println("flvWrite", m, err, len(buf))
-		if err != nil || m == 0 {
-			log.Println("send data error.", err)
-			break
-		}
-	}
+	PlayerAdd(p, s)
+	<-s.HttpDone
+	PlayerDelete(p, s)
+	WsClose(ws)
+	s.log.Printf("%s WsFlvPlayer stop", s.Key)
 }
 
-// tcp连接到 Publisher 获取数据
-// 收到数据后 按http-flv格式 发送数据
-// GET http://www.domain.com/live/yuankang.flv
-func GetFlv(w http.ResponseWriter, r *http.Request) {
-	var fpi FlvPlayInfo
-	fpi.App, fpi.Stream, _ = GetPlayInfo(r.URL.String())
-	fpi.Client = r.RemoteAddr
-	log.Printf("%#v", fpi)
+func FlvPublisherGet(r *http.Request) (*Stream, error) {
+	app, stream, _ := GetPlayInfo(r.URL.Path)
+	key := fmt.Sprintf("%s_%s", app, stream)
+	log.Println("publisher key is", key)
 
-	c, err := FlvRecv(fpi)
-	if err != nil {
+	p, ok := PublisherGet(key)
+	if !ok {
+		err := fmt.Errorf("publisher %s isn't exist", key)
 		log.Println(err)
-		goto ERR
+		return nil, err
 	}
+	return p, nil
+}
 
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Connection", "Keep-Alive")
-	w.Header().Set("Content-Type", "video/x-flv")
-	w.Header().Set("transfer-encoding", "chunked")
-	w.Header().Set("Server", AppName)
-	FlvSend(c, w)
-	return
-ERR:
+func FlvRspsErr(w http.ResponseWriter, err error) {
 	rsps := GetRsps(500, err.Error())
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Content-length", strconv.Itoa(len(rsps)))
@@ -111,60 +99,43 @@ ERR:
 	w.Write(rsps)
 }
 
-/**********************************************************/
-/* rtmp2flv
-/**********************************************************/
-// 1 获取播放信息 app stream client
-// 2 查找是否有发布者
-// 3 创建Stream 挂在到 Publisher
-// 4 接收rtmp数据 转为flv数据
-// 5 发送flv数据
-func FlvPlayer(c net.Conn) {
-	len, err := ReadUint8(c)
-	if err != nil {
-		log.Println(err)
-		return
-	}
-	//log.Println(len)
-
-	data, err := ReadByte(c, uint32(len))
-	if err != nil {
-		log.Println(err)
-		return
-	}
-
-	var fpi FlvPlayInfo
-	err = json.Unmarshal(data, &fpi)
-	if err != nil {
-		log.Println(err)
-		return
-	}
-	log.Printf("%#v", fpi)
+// sType 用于日志文件名, flv 或 wsflv
+func FlvPlayerNew(r *http.Request, w io.Writer, sType string) *Stream {
+	app, stream, _ := GetPlayInfo(r.URL.Path)
 
-	s := NewStream(c)
+	s := NewStream(nil)
 	s.StreamType = "flvPlayer"
-	s.AmfInfo.App = fpi.App
-	s.AmfInfo.StreamName = fpi.Stream
-	s.RemoteAddr = fpi.Client
+	s.AmfInfo.App = app
+	s.AmfInfo.StreamName = stream
+	s.RemoteAddr = r.RemoteAddr
 	s.IsPublisher = false
+	s.PlayOnly = PlayOnlyParse(r.URL.Query().Get("only"))
+	s.FlvWriter = w
+	s.HttpDone = make(chan bool, 1)
 
 	s.log.Printf("---> the stream is publisher %t", s.IsPublisher)
-	StreamLogRename(s, "flv")
-
-	key := fmt.Sprintf("%s_%s", s.AmfInfo.App, s.AmfInfo.StreamName)
-	s.log.Println("publisher key is", key)
-
-	p, ok := Publishers[key]
-	if !ok { // 发布者不存在, 断开连接并返回错误
-		s.log.Printf("publisher %s isn't exist", key)
-		s.Conn.Close()
-		return
-	}
+	StreamLogRename(s, sType)
 
 	s.Key = fmt.Sprintf("%s_%s_%s", s.AmfInfo.App,
 		s.AmfInfo.StreamName, s.RemoteAddr)
 	s.log.Println("player key is", s.Key)
-	p.Players[s.Key] = s
+	return s
+}
+
+// 写完马上发送, 不在http的缓存里停留
+func FlvWrite(s *Stream, d []byte) error {
+	_, err := s.FlvWriter.Write(d)
+	if err != nil {
+		return err
+	}
+	FlvFlush(s)
+	return nil
+}
+
+func FlvFlush(s *Stream) {
+	if f, ok := s.FlvWriter.(http.Flusher); ok {
+		f.Flush()
+	}
 }
 
 // 3 + 1 + 1 + 4 + 4 = 13字节
@@ -197,6 +168,67 @@ type FlvData struct {
 	Tags []FlvTag
 }
 
+// 13字节, FlvHead(9) + PreviousTagSize0(4)
+func FlvHeadCreate(h FlvHead) []byte {
+	buf := make([]byte, 13)
+	buf[0] = h.Signature0
+	buf[1] = h.Signature1
+	buf[2] = h.Signature2
+	buf[3] = h.Version
+	buf[4] = (h.FlagReserved0&0x1f)<<3 |
+		(h.FlagAudio&0x1)<<2 |
+		(h.FlagReserved1&0x1)<<1 |
+		(h.FlagVideo & 0x1)
+	Uint32ToByte(h.Offset, buf[5:9], BE)
+	Uint32ToByte(h.TagSize, buf[9:13], BE)
+	return buf
+}
+
+// rtmp推流的Metadata是 "@setDataFrame" + "onMetaData" + object
+// flv文件里的Metadata是 "onMetaData" + object, 要去掉 "@setDataFrame"
+// 0x02 + 0x000d + "@setDataFrame" = 16字节
+func MetaDataStrip(d []byte) []byte {
+	if len(d) > 16 && d[0] == Amf0MarkerString &&
+		string(d[3:16]) == "@setDataFrame" {
+		return d[16:]
+	}
+	return d
+}
+
+// tagHeader(11) + data + PreviousTagSize(4)
+// Timestamp超过24bit时, 高8bit放到TimeExtend里
+func FlvTagCreate(TagType uint8, Timestamp uint32, data []byte) []byte {
+	var t FlvTag
+	t.TagType = TagType
+	t.DataSize = uint32(len(data))
+	t.Timestamp = Timestamp & 0xffffff
+	t.TimeExtend = uint8(Timestamp >> 24)
+	t.StreamId = 0x0
+	t.TagSize = 11 + t.DataSize
+
+	buf := make([]byte, 11+t.DataSize+4)
+	buf[0] = t.TagType
+	Uint24ToByte(t.DataSize, buf[1:4], BE)
+	Uint24ToByte(t.Timestamp, buf[4:7], BE)
+	buf[7] = t.TimeExtend
+	Uint24ToByte(t.StreamId, buf[8:11], BE)
+	copy(buf[11:11+t.DataSize], data)
+	Uint32ToByte(t.TagSize, buf[11+t.DataSize:], BE)
+	return buf
+}
+
+// d 至少11字节, 返回的Timestamp 已经合并了TimeExtend
+func FlvTagHeadParse(d []byte) FlvTag {
+	var t FlvTag
+	t.TagType = d[0] & 0x1f // 高3bit是保留位和加密标志
+	t.DataSize = ByteToUint32(d[1:4], BE)
+	t.TimeExtend = d[7]
+	t.Timestamp = uint32(t.TimeExtend)<<24 | ByteToUint32(d[4:7], BE)
+	t.StreamId = ByteToUint32(d[8:11], BE)
+	t.TagSize = 11 + t.DataSize
+	return t
+}
+
 func GopCacheSendFlv(s *Stream, gop *GopCache) error {
 	var h FlvHead
 	h.Signature0 = 0x46
@@ -211,15 +243,31 @@ func GopCacheSendFlv(s *Stream, gop *GopCache) error {
 	h.TagSize = 0x0
 	s.log.Printf("%#v", h)
 
+	// 没有音频或视频时 对应的Header为nil
+	// 只播放音频或视频时 PlayerChunk()返回nil 或 修改后的Metadata
 	FlvSendHead(s, h)
-	FlvSendMetaData(s, gop.MetaData)
-	FlvSendVideoHead(s, gop.VideoHeader)
-	FlvSendAudioHead(s, gop.AudioHeader)
+	if c := PlayerChunk(s, gop.MetaData); c != nil {
+		FlvSendMetaData(s, c)
+	}
+	if c := PlayerChunk(s, gop.VideoHeader); c != nil {
+		FlvSendVideoHead(s, c)
+	}
+	if c := PlayerChunk(s, gop.AudioHeader); c != nil {
+		FlvSendAudioHead(s, c)
+	}
 	FlvSendData(s, gop.MediaData)
 	return nil
 }
 
 func FlvSendHead(s *Stream, h FlvHead) {
+	// 只播放音频或视频时 修改flv头的标志位
+	switch s.PlayOnly {
+	case "audio":
+		h.FlagVideo = 0x0
+	case "video":
+		h.FlagAudio = 0x0
+	}
+
 	buf := make([]byte, 13)
 	buf[0] = h.Signature0
 	buf[1] = h.Signature1
@@ -233,7 +281,7 @@ func FlvSendHead(s *Stream, h FlvHead) {
 	Uint32ToByte(h.TagSize, buf[9:13], BE)
 	s.log.Println(len(buf), buf)
 
-	_, err := s.Conn.Write(buf)
+	err := FlvWrite(s, buf)
 	if err != nil {
 		s.log.Println(err)
 		return
@@ -267,7 +315,7 @@ func FlvSendMetaData(s *Stream, c *Chunk) {
 	s.log.Println(len(buf), buf)
 
 	// send data
-	_, err := s.Conn.Write(buf)
+	err := FlvWrite(s, buf)
 	if err != nil {
 		s.log.Println(err)
 		return
@@ -301,7 +349,7 @@ func FlvSendVideoHead(s *Stream, c *Chunk) {
 	s.log.Println(len(buf), buf)
 
 	// send data
-	_, err := s.Conn.Write(buf)
+	err := FlvWrite(s, buf)
 	if err != nil {
 		s.log.Println(err)
 		return
@@ -335,7 +383,7 @@ func FlvSendAudioHead(s *Stream, c *Chunk) {
 	s.log.Println(len(buf), buf)
 
 	// send data
-	_, err := s.Conn.Write(buf)
+	err := FlvWrite(s, buf)
 	if err != nil {
 		s.log.Println(err)
 		return
@@ -350,6 +398,9 @@ func FlvSendData(s *Stream, md *list.List) {
 	i := 0
 	for e := md.Front(); e != nil; e = e.Next() {
 		c := (e.Value).(*Chunk)
+		if PlayerChunk(s, c) == nil {
+			continue
+		}
 		t.TagType = uint8(c.MsgTypeId)
 		t.DataSize = c.MsgLength
 		t.Timestamp = c.Timestamp
@@ -377,7 +428,7 @@ func FlvSendData(s *Stream, md *list.List) {
 		//log.Println(len(buf), buf)
 
 		// send data
-		_, err := s.Conn.Write(buf)
+		err := FlvWrite(s, buf)
 		if err != nil {
 			s.log.Println(err)
 			s.log.Println("@@@ GopCacheSend() error")
@@ -417,10 +468,165 @@ func MessageSendFlv(s *Stream, c *Chunk) error {
 	//log.Println(len(buf), buf)
 
 	// send data
-	_, err := s.Conn.Write(buf)
+	err := FlvWrite(s, buf)
 	if err != nil {
 		s.log.Println(err)
 		return err
 	}
 	return nil
 }
+
+/**********************************************************/
+/* http-flv推流
+/**********************************************************/
+// 有些设备只能用http推flv, 和rtmp推流一样 存入Publishers
+// POST http://www.domain.com/live/yuankang.flv (Transfer-Encoding: chunked)
+// ws://www.domain.com/live/yuankang.flv?publish
+func PostFlv(w http.ResponseWriter, r *http.Request) {
+	s, err := FlvPublisherNew(r, "flv")
+	if err != nil {
+		FlvRspsErr(w, err)
+		return
+	}
+
+	// 推流结束(客户端发完数据或断开) 才回复
+	if err = FlvPublisher(s, r.Body); err != nil {
+		FlvRspsErr(w, err)
+		return
+	}
+	rsps := GetRsps(200, "ok")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-length", strconv.Itoa(len(rsps)))
+	w.Header().Set("Server", AppName)
+	w.Write(rsps)
+}
+
+func GetWsFlvPublish(w http.ResponseWriter, r *http.Request) {
+	s, err := FlvPublisherNew(r, "wsflv")
+	if err != nil { // 握手前 还能用http返回错误
+		FlvRspsErr(w, err)
+		return
+	}
+	ws, err := WsUpgrade(w, r)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		RtmpPublishStop(s)
+		return
+	}
+
+	FlvPublisher(s, &WsReader{Ws: ws})
+	WsClose(ws)
+}
+
+// 发布者已存在时 返回错误
+func FlvPublisherNew(r *http.Request, sType string) (*Stream, error) {
+	app, stream, _ := GetPlayInfo(r.URL.Path)
+	if app == "" || stream == "" {
+		return nil, fmt.Errorf("invalid flv publish url %s", r.URL.Path)
+	}
+
+	s := NewStream(nil)
+	s.StreamType = "flvPublisher"
+	s.AmfInfo.App = app
+	s.AmfInfo.StreamName = stream
+	s.RemoteAddr = r.RemoteAddr
+	s.IsPublisher = true
+
+	s.log.Printf("---> the stream is publisher %t", s.IsPublisher)
+	StreamLogRename(s, sType)
+
+	s.Key = fmt.Sprintf("%s_%s", s.AmfInfo.App, s.AmfInfo.StreamName)
+	s.log.Println("publisher key is", s.Key)
+
+	if !PublisherStart(s) {
+		return nil, fmt.Errorf("publisher %s is exist", s.Key)
+	}
+	return s, nil
+}
+
+// 和RtmpPublisher()一样, 解析出的数据 传递给发送协程
+// 读完(io.EOF) 或 出错 或 被关闭 都结束推流
+func FlvPublisher(s *Stream, r io.Reader) error {
+	var err error
+	if err = FlvHeadRead(r); err != nil {
+		s.log.Println(err)
+	}
+
+	for err == nil {
+		if s.TransmitSwitch == "off" {
+			break
+		}
+
+		var c *Chunk
+		if c, err = FlvTagRead(r); err != nil {
+			break
+		}
+		if c == nil { // 不处理的tag
+			continue
+		}
+		if err = MediaHandle(s, c); err != nil {
+			break
+		}
+		s.DataChan <- c
+	}
+
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	if err != nil {
+		s.log.Println(err)
+	}
+	s.log.Printf("%s FlvPublisher stop", s.Key)
+	RtmpPublishStop(s)
+	return err
+}
+
+// flv头 9字节 + PreviousTagSize0 4字节
+func FlvHeadRead(r io.Reader) error {
+	d, err := ReadByte(r, 13)
+	if err != nil {
+		return err
+	}
+	if string(d[:3]) != "FLV" {
+		return fmt.Errorf("invalid flv signature %x", d[:3])
+	}
+	// DataOffset一般是9, 大于9时 跳过多出来的部分
+	offset := ByteToUint32(d[5:9], BE)
+	if offset > 9 {
+		if _, err = ReadByte(r, offset-9); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 读取一个tag 和 它后面的PreviousTagSize, 转为Chunk
+// 不是音频/视频/Metadata 或 没有数据的tag 返回nil
+func FlvTagRead(r io.Reader) (*Chunk, error) {
+	h, err := ReadByte(r, 11)
+	if err != nil {
+		return nil, err
+	}
+	t := FlvTagHeadParse(h)
+
+	d, err := ReadByte(r, t.DataSize+4)
+	if err != nil {
+		return nil, err
+	}
+	d = d[:t.DataSize]
+
+	switch t.TagType {
+	case MsgTypeIdAudio, MsgTypeIdVideo:
+		if len(d) < 2 { // 至少要有 编码信息 和 包类型
+			return nil, nil
+		}
+	case MsgTypeIdDataAmf0:
+		if len(d) == 0 {
+			return nil, nil
+		}
+	default:
+		return nil, nil
+	}
+	return VodChunkCreate(uint32(t.TagType), t.Timestamp, d), nil
+}
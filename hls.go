@@ -1,47 +1,68 @@
 package main
 
 import (
+	"bytes"
 	"container/list"
 	"fmt"
+	"io"
 	"log"
 	"math"
 	"net/http"
 	"os"
 	"path"
 	"strings"
-	"utils"
 )
 
 const (
-	H264ClockFrequency = 90 // ISO/IEC13818-1中指定, 时钟频率为90kHz
+	H264ClockFrequency = 90          // ISO/IEC13818-1中指定, 时钟频率为90kHz
+	TsTimestampMax     = 0x1ffffffff // pts/dts/pcr 是33bit, 90kHz时 约26.5小时回绕
+	TsDtsOffset        = 700         // 单位为毫秒, dts比pcr大700ms, 给解码器留缓冲时间(同ffmpeg的muxdelay)
+	TsPatPmtInterval   = 500         // 单位为毫秒, 重复写pat/pmt的间隔
+	TsPcrInterval      = 80          // 单位为毫秒, 标准规定pcr间隔不能超过100ms
 	TsPacketLen        = 188
 	PatPid             = 0x0
 	PmtPid             = 0x1001
 	VideoPid           = 0x100
 	AudioPid           = 0x101
+	Id3Pid             = 0x102 // timed metadata, 见HlsMetaInfo
 	VideoStreamId      = 0xe0
 	AudioStreamId      = 0xc0
 )
 
 type HlsInfo struct {
-	LogHlsFn     string      // 文件名 包括路径
-	logHls       *log.Logger // 每个发布者、播放者的日志都是独立的
-	M3u8Path     string      // m3u8文件路径, 包含文件名
-	M3u8File     *os.File    // m3u8文件描述符
-	M3u8Data     string      // m3u8内容
-	TsNum        uint32      // m3u8里ts的个数
-	TsFirstSeq   uint32      // m3u8里第一个ts的序号
-	TsLastSeq    uint32      // m3u8里最后一个ts的序号
-	TsList       *list.List  // 存储ts内容, 双向链表, 删头追尾
-	TsFirstTs    uint32      // ts文件中第一个时间戳
-	TsExtInfo    float64     // ts文件的播放时长
-	TsPath       string      // ts文件路径, 包含文件名
-	TsFile       *os.File    // ts文件描述符
-	TsData       []byte      // ts文件内容(不完整，正在生成)
-	VideoCounter uint8       // 4bit, 0x0 - 0xf 循环
-	AudioCounter uint8       // 4bit, 0x0 - 0xf 循环
-	SpsPpsData   []byte      // 视频关键帧tsPacket
-	AdtsData     []byte      // 音频tsPacket需要
+	LogHlsFn     string        // 文件名 包括路径
+	logHls       *log.Logger   // 每个发布者、播放者的日志都是独立的
+	M3u8Path     string        // m3u8文件路径, 包含文件名
+	M3u8File     *os.File      // m3u8文件描述符
+	M3u8Data     string        // m3u8内容
+	TsNum        uint32        // m3u8里ts的个数
+	TsFirstSeq   uint32        // m3u8里第一个ts的序号
+	TsLastSeq    uint32        // m3u8里最后一个ts的序号
+	TsDiscSeq    uint32        // m3u8里的 #EXT-X-DISCONTINUITY-SEQUENCE
+	TsDisc       bool          // 重新发布后 下一个切片前要加 #EXT-X-DISCONTINUITY
+	TsList       *list.List    // 存储ts内容, 双向链表, 删头追尾
+	TsFirstTs    uint32        // ts文件中第一个时间戳
+	TsExtInfo    float64       // ts文件的播放时长
+	TsPath       string        // ts文件路径, 包含文件名
+	TsFile       *os.File      // ts文件描述符, HlsStore为memory时是nil
+	TsBuf        *bytes.Buffer // ts文件内容, HlsStore为disk时是nil
+	TsWriter     io.Writer     // ts数据写到这里, hls是TsFile, http-ts是http.ResponseWriter
+	TsData       []byte        // ts文件内容(不完整，正在生成)
+	PatCounter   uint8         // 4bit, 0x0 - 0xf 循环
+	PmtCounter   uint8         // 4bit, 0x0 - 0xf 循环
+	VideoCounter uint8         // 4bit, 0x0 - 0xf 循环
+	AudioCounter uint8         // 4bit, 0x0 - 0xf 循环
+	TsPatPmtTs   uint32        // 上次写pat/pmt的时间戳
+	TsPatPmtSet  bool          // 新切片 或 http-ts播放者 还没写过pat/pmt时为false
+	TsPcrTs      uint32        // 上次写pcr的时间戳
+	TsPcrSet     bool          // 新切片 或 http-ts播放者 还没写过pcr时为false
+	TsVideoType  uint8         // pmt里视频的stream_type, 0表示没有视频
+	TsAudioType  uint8         // pmt里音频的stream_type, 0表示没有音频
+	TsPmtTypes   [2]uint8      // 上次写入pmt的 视频和音频的stream_type
+	TsPmtVersion uint8         // 5bit, pmt的version_number, stream_type变了就加1
+	TsStarted    bool          // http-ts播放者 是否已经从关键帧开始发送
+	SpsPpsData   []byte        // 视频关键帧tsPacket, hevc时是 vps + sps + pps
+	AdtsData     []byte        // 音频tsPacket需要
 }
 
 /**********************************************************/
@@ -102,11 +123,53 @@ type NaluHeader struct {
 	NalUnitType      uint8 // 5bit, 简写为Type
 }
 
+// 去掉防竞争字节, 0x000003 -> 0x0000
+func NaluUnescape(d []byte) []byte {
+	out := make([]byte, 0, len(d))
+	zeros := 0
+	for _, b := range d {
+		if zeros >= 2 && b == 0x03 {
+			zeros = 0
+			continue
+		}
+		if b == 0x0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+// NaluUnescape()的反操作, 00 00 后面是 00/01/02/03 时 插入 03
+func NaluEscape(d []byte) []byte {
+	out := make([]byte, 0, len(d)+len(d)/64)
+	zeros := 0
+	for _, b := range d {
+		if zeros >= 2 && b <= 0x03 {
+			out = append(out, 0x03)
+			zeros = 0
+		}
+		if b == 0x0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
 /**********************************************************/
 /* prepare SpsPpsData and AdtsData
 /**********************************************************/
 //0x00000001 + 0x67 + sps + 0x00000001 + 0x68 + pps
 func PrepareSpsPpsData(s *Stream, c *Chunk) {
+	if c.MsgData[0]&0xf == 12 { // HEVC
+		PrepareVpsSpsPpsData(s, c)
+		return
+	}
 	var AvcC AVCDecoderConfigurationRecord
 	AvcC.ConfigurationVersion = c.MsgData[5]          // 8bit, 0x01
 	AvcC.AVCProfileIndication = c.MsgData[6]          // 8bit, 0x4d, 0100 1101
@@ -146,6 +209,25 @@ func PrepareSpsPpsData(s *Stream, c *Chunk) {
 	Uint24ToByte(0x000001, s.SpsPpsData[sp:sp+3], BE)
 	copy(s.SpsPpsData[sp+3:sp+3+AvcC.PpsSize], AvcC.PpsData)
 	s.logHls.Printf("SpsPpsData: %x", s.SpsPpsData)
+	s.TsVideoType = TsVideoStreamType(c.MsgData[0] & 0xf)
+}
+
+// hevc关键帧前 要有 vps + sps + pps, HEVCDecoderConfigurationRecord里的nalu 都加上开始码
+func PrepareVpsSpsPpsData(s *Stream, c *Chunk) {
+	HevcC, err := HevcCParse(c.MsgData)
+	if err != nil {
+		s.logHls.Println(err)
+		return
+	}
+	s.logHls.Printf("%#v", HevcC)
+
+	s.SpsPpsData = nil
+	for _, nalu := range HevcC.Nalus {
+		s.SpsPpsData = append(s.SpsPpsData, 0x00, 0x00, 0x01)
+		s.SpsPpsData = append(s.SpsPpsData, nalu...)
+	}
+	s.logHls.Printf("VpsSpsPpsData: %x", s.SpsPpsData)
+	s.TsVideoType = TsVideoStreamType(c.MsgData[0] & 0xf)
 }
 
 // FF F9 50 80 2E 7F FC
@@ -243,6 +325,20 @@ func PrepareAdtsData(s *Stream, c *Chunk) {
 	s.AdtsData[5] = uint8(adts.AacFrameLength&0x7)<<5 | uint8((adts.AdtsBufferFullness>>6)&0x1f)
 	s.AdtsData[6] = uint8((adts.AdtsBufferFullness&0x3f)<<2) | (adts.NumberOfRawDataBlocksInFrame & 0x3)
 	s.logHls.Printf("AdtsData: %x", s.AdtsData)
+	s.TsAudioType = TsAudioStreamType(c.MsgData[0] >> 4)
+}
+
+// MP3和G.711没有音频头, 收到音频帧(AudioFrame)时 才知道音频的stream_type
+// 变了就要马上写pat/pmt, 不然这个音频pes的pid 不在pmt里, 变了返回true
+func TsAudioTypeUpdate(s *Stream, c *Chunk) bool {
+	at := TsAudioStreamType(c.MsgData[0] >> 4)
+	if at == s.TsAudioType {
+		return false
+	}
+	s.logHls.Printf("audio stream_type 0x%x -> 0x%x", s.TsAudioType, at)
+	s.TsAudioType = at
+	s.TsPatPmtSet = false
+	return true
 }
 
 func ParseAdtsData(s *Stream) Adts {
@@ -279,9 +375,12 @@ func SetAdtsLength(d []byte, size uint16) {
 /* HlsCreator()
 /**********************************************************/
 func HlsCreator(s *Stream) {
+	defer HlsOnDemandDone(s)
 	// 初始化hls的生产
 	s.LogHlsFn = fmt.Sprintf("%s%s/%s_hlsCreator_%s.log", conf.LogStreamPath, s.Key, s.Key, s.RemoteAddr)
 	s.logHls, _ = StreamLogCreate(s.LogHlsFn)
+	done := HlsStateWait(s)
+	defer HlsStateDone(s, done)
 
 	folder := fmt.Sprintf("%s%s", conf.HlsSavePath, s.Key)
 	err := os.MkdirAll(folder, 0755)
@@ -291,36 +390,83 @@ func HlsCreator(s *Stream) {
 	}
 	s.M3u8Path = fmt.Sprintf("%s/%s.m3u8", folder, s.Key)
 	s.logHls.Println("m3u8Path is", s.M3u8Path)
-	s.M3u8File, err = os.OpenFile(s.M3u8Path, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+
+	s.HlsInfo.TsList = list.New()
+	HlsStateLoad(s)
+	if conf.HlsPartTime > 0 {
+		LlHlsInit(s)
+	}
+	HlsPlaylistInit(s)
+	HlsArchiveInit(s)
+	HlsMasterInit(s)
+	HlsMetaInit(s)
+	HlsVttInit(s)
+	if err = HlsEncryptInit(s); err == nil {
+		err = HlsStateM3u8Write(s)
+	}
 	if err != nil {
-		log.Println(err)
+		s.logHls.Println(err)
+		for range s.HlsChan { // 不生成hls, 但要读取数据 避免阻塞发布者
+		}
 		return
 	}
 
-	s.HlsInfo.TsList = list.New()
-
 	var i uint32 = 0
 	for {
 		c, ok := <-s.HlsChan
 		if !ok {
 			s.logHls.Printf("%s HlsCreator stop", s.Key)
+			HlsPlaylistEnd(s)
+			HlsOnDemandClear(s)
+			HlsStateSave(s)
+			HlsMemClear(folder)
 			return
 		}
 		s.logHls.Printf("-------------------->> chunk %d", i)
 		i++
 		s.logHls.Printf("===>> fmt=%d, csid=%d, timestamp=%d, MsgLength=%d, MsgTypeId=%d, DataType=%s", c.Fmt, c.Csid, c.Timestamp, c.MsgLength, c.MsgTypeId, c.DataType)
 
+		// 只有音频 或 只有视频时, 没有的那个头不会到达
+		// 头到达之前的帧 无法封装, 丢弃
 		switch c.DataType {
 		case "Metadata":
 			continue
+		case "DataFrame":
+			HlsDataFrameHandle(s, c)
+			continue
 		case "AudioAacFrame":
-			//continue
+			if !HlsHasAudio(s) {
+				continue
+			}
+		case "AudioFrame":
+			if HlsIsFmp4() {
+				continue // fmp4的音频只支持AAC
+			}
+			if TsAudioTypeUpdate(s, c) {
+				HlsCodecsUpdate(s)
+			}
+		case "VideoKeyFrame", "VideoInterFrame":
+			if !HlsHasVideo(s) {
+				continue
+			}
+			HlsVttFrame(s, c)
 		case "VideoHeader":
+			Fmp4HeaderCheck(s, s.HlsVideoHeader, c)
+			s.HlsVideoHeader = c
 			PrepareSpsPpsData(s, c)
+			HlsCodecsUpdate(s)
 			continue
 		case "AudioHeader":
+			Fmp4HeaderCheck(s, s.HlsAudioHeader, c)
+			s.HlsAudioHeader = c
 			PrepareAdtsData(s, c)
 			ParseAdtsData(s)
+			HlsCodecsUpdate(s)
+			continue
+		}
+
+		if HlsIsFmp4() {
+			Fmp4Create(s, c)
 			continue
 		}
 
@@ -385,12 +531,12 @@ type Pcr struct {
 // tsPakcet
 //---------------------------------------------------------/
 // tsPacket 大小固定188byte, tsHeader 固定4byte
-// TsPacketCreate() 只有tsHeader + 184字节数据
+// TsPacketCreatePes() tsHeader + adaptation(可选) + pes数据
+// first为true时是pes的第一个tsPacket, PayloadUnitStartIndicator为1
+// 需要时 adaptation里有pcr, 关键帧的RandomAccessIndicator为1
+// 数据不够时 用adaptation填充0xff, 不能在数据后面填充
 // 返回tsData 和 写入tsData的字节数(也就是data数据消耗了多少)
-func TsPacketCreate(s *Stream, pid uint16, data []byte) ([]byte, int) {
-	dataLen := len(data)
-	freeBuffLen := 188 - 4
-
+func TsPacketCreatePes(s *Stream, pid uint16, data []byte, first bool, pcr int64, rai bool) ([]byte, int) {
 	var th TsHeader
 	th.SyncByte = 0x47
 	th.TransportErrorIndicator = 0x0
@@ -399,24 +545,42 @@ func TsPacketCreate(s *Stream, pid uint16, data []byte) ([]byte, int) {
 	th.PID = pid
 	th.TransportScramblingControl = 0x0
 	th.AdaptationFieldControl = 0x1
-	if dataLen < freeBuffLen {
-		th.AdaptationFieldControl = 0x3
-	}
-	if pid == AudioPid {
-		th.ContinuityCounter = s.AudioCounter
-		s.AudioCounter++
-		if s.AudioCounter > 0xf {
-			s.AudioCounter = 0x0
+	th.ContinuityCounter = TsCounterNext(s, pid)
+
+	var a Adaptation
+	if first {
+		th.PayloadUnitStartIndicator = 0x1
+		if rai {
+			a.RandomAccessIndicator = 0x1
 		}
-		//s.logHls.Printf("th.ContinuityCounter=%x", th.ContinuityCounter)
+		if pcr >= 0 {
+			a.PcrFlag = 0x1
+		}
+	}
+
+	// afLen 是adaptation的总字节数, 包括AdaptationFieldLength
+	afLen := 0
+	if a.RandomAccessIndicator == 0x1 || a.PcrFlag == 0x1 {
+		afLen = 2 + 6*int(a.PcrFlag)
+	}
+	dataLen := len(data)
+	if dataLen > 184-afLen {
+		dataLen = 184 - afLen
 	}
-	if pid == VideoPid {
-		th.ContinuityCounter = s.VideoCounter
-		s.VideoCounter++
-		if s.VideoCounter > 0xf {
-			s.VideoCounter = 0x0
+	padLen := 184 - afLen - dataLen
+	if padLen > 0 && afLen == 0 {
+		// 只差1字节时 adaptation只有AdaptationFieldLength(值为0)
+		afLen = 1
+		padLen--
+		if padLen > 0 {
+			afLen = 2
+			padLen--
 		}
 	}
+	if afLen > 0 {
+		th.AdaptationFieldControl = 0x3
+		a.AdaptationFieldLength = uint8(afLen + padLen - 1)
+	}
 
 	tsData := make([]byte, 188)
 	tsData[0] = th.SyncByte
@@ -424,34 +588,55 @@ func TsPacketCreate(s *Stream, pid uint16, data []byte) ([]byte, int) {
 	tsData[2] = uint8(th.PID & 0xff)
 	tsData[3] = (th.TransportScramblingControl&0x3)<<6 | (th.AdaptationFieldControl&0x3)<<4 | (th.ContinuityCounter & 0xf)
 
-	//s.logHls.Printf("dataLen=%d, freeBuffLen=%d", dataLen, freeBuffLen)
-	if dataLen >= freeBuffLen {
-		dataLen = freeBuffLen
-		copy(tsData[4:4+dataLen], data)
-	} else {
-		// 添加 adaptation(2字节) 填充 0xff
-		// 183 184 -> 185 184 这种情况 无法添加adaptation 需特殊处理
-		// 182 184 -> 184 184 这种情况 刚好添加adaptation
-		// 181 184 -> 183 184 这种情况 添加adaptation 还能填充1个0xff
-		// 180 184 -> 182 184 这种情况 添加adaptation 还能填充2个0xff
-		// 188 = 4 + 2 + padLen + dataLen
-		padLen := 188 - 4 - 2 - dataLen
-		tsData[4] = uint8(padLen + 1)
-		if padLen < 0 {
-			padLen = 0
-			dataLen -= 1
-			tsData[4] = 0x1
-		}
-		tsData[5] = 0x0
-		//s.logHls.Printf("padLen=%d, tsData[4]=%d, tsData[5]=%d", padLen, tsData[4], tsData[5])
-		for i := 0; i < padLen; i++ {
-			tsData[6+i] = 0xff
-		}
-		copy(tsData[6+padLen:], data)
+	n := 4
+	if afLen > 0 {
+		tsData[4] = a.AdaptationFieldLength
+		n = 5
 	}
+	if afLen > 1 {
+		tsData[5] = (a.DiscontinuityIndicator&0x1)<<7 | (a.RandomAccessIndicator&0x1)<<6 | (a.ElementaryStreamPriorityIndicator&0x1)<<5 | (a.PcrFlag&0x1)<<4 | (a.OpcrFlag&0x1)<<3 | (a.SplicingPointFlag&0x1)<<2 | (a.TransportPrivateDataFlag&0x1)<<1 | (a.AdaptationFieldExtensionFlag & 0x1)
+		n = 6
+	}
+	if a.PcrFlag == 0x1 {
+		// pcr_base 33bit + reserved 6bit + pcr_extension 9bit(为0)
+		base := uint64(pcr) & TsTimestampMax
+		tsData[6] = uint8((base >> 25) & 0xff)
+		tsData[7] = uint8((base >> 17) & 0xff)
+		tsData[8] = uint8((base >> 9) & 0xff)
+		tsData[9] = uint8((base >> 1) & 0xff)
+		tsData[10] = uint8(((base & 0x1) << 7) | 0x7e)
+		tsData[11] = 0x00
+		n = 12
+	}
+	for i := 0; i < padLen; i++ {
+		tsData[n+i] = 0xff
+	}
+	copy(tsData[n+padLen:], data[:dataLen])
 	return tsData, dataLen
 }
 
+// 每个pid有自己的ContinuityCounter, 4bit 0x0 - 0xf 循环
+func TsCounterNext(s *Stream, pid uint16) uint8 {
+	var p *uint8
+	switch pid {
+	case PatPid:
+		p = &s.PatCounter
+	case PmtPid:
+		p = &s.PmtCounter
+	case VideoPid:
+		p = &s.VideoCounter
+	case AudioPid:
+		p = &s.AudioCounter
+	case Id3Pid:
+		p = &s.Id3Counter
+	default:
+		return 0
+	}
+	cc := *p
+	*p = (*p + 1) & 0xf
+	return cc
+}
+
 // TsPacketCreatePatPmt() tsHeader和pat/pmt之间用0x00分割
 func TsPacketCreatePatPmt(s *Stream, pid uint16, data []byte) ([]byte, int) {
 	var th TsHeader
@@ -463,6 +648,15 @@ func TsPacketCreatePatPmt(s *Stream, pid uint16, data []byte) ([]byte, int) {
 	th.TransportScramblingControl = 0x0 // 2bit
 	th.AdaptationFieldControl = 0x1     // 2bit
 	th.ContinuityCounter = 0x0          // 4bit
+	// http-ts会重复发送pat/pmt, ContinuityCounter要递增
+	if pid == PatPid {
+		th.ContinuityCounter = s.PatCounter
+		s.PatCounter = (s.PatCounter + 1) & 0xf
+	}
+	if pid == PmtPid {
+		th.ContinuityCounter = s.PmtCounter
+		s.PmtCounter = (s.PmtCounter + 1) & 0xf
+	}
 
 	tsData := make([]byte, 188)
 	tsData[0] = th.SyncByte
@@ -493,310 +687,198 @@ func TsPacketCreatePatPmt(s *Stream, pid uint16, data []byte) ([]byte, int) {
 	return tsData, dataLen
 }
 
-// tsHeader + adaptation(pcr) + pesHeader + sps + pps + keyFrmae
-// TsPacketCreateKeyFrame() 视频关键帧的第一个tsPacket
-func TsPacketCreateKeyFrame(s *Stream, pid uint16, data []byte, pcr uint64) ([]byte, int) {
-	var th TsHeader
-	th.SyncByte = 0x47
-	th.TransportErrorIndicator = 0x0
-	th.PayloadUnitStartIndicator = 0x1
-	th.TransportPriority = 0x0
-	th.PID = pid
-	th.TransportScramblingControl = 0x0
-	th.AdaptationFieldControl = 0x3
-	th.ContinuityCounter = s.VideoCounter
-	s.VideoCounter++
-	if s.VideoCounter > 0xf {
-		s.VideoCounter = 0x0
-	}
-
-	var a Adaptation
-	a.AdaptationFieldLength = 0x7
-	a.DiscontinuityIndicator = 0x0
-	a.RandomAccessIndicator = 0x0
-	a.ElementaryStreamPriorityIndicator = 0x0
-	a.PcrFlag = 0x1
-	a.OpcrFlag = 0x0
-	a.SplicingPointFlag = 0x0
-	a.TransportPrivateDataFlag = 0x0
-	a.AdaptationFieldExtensionFlag = 0x0
-
-	tsData := make([]byte, 188)
-	tsData[0] = th.SyncByte
-	tsData[1] = (th.TransportErrorIndicator&0x1)<<7 | (th.PayloadUnitStartIndicator&0x1)<<6 | (th.TransportPriority&0x1)<<5 | uint8((th.PID&0x1f00)>>8)
-	tsData[2] = uint8(th.PID & 0xff)
-	tsData[3] = (th.TransportScramblingControl&0x3)<<6 | (th.AdaptationFieldControl&0x3)<<4 | (th.ContinuityCounter & 0xf)
-
-	tsData[4] = a.AdaptationFieldLength
-	tsData[5] = (a.DiscontinuityIndicator&0x1)<<7 | (a.RandomAccessIndicator&0x1)<<6 | (a.ElementaryStreamPriorityIndicator&0x1)<<5 | (a.PcrFlag&0x1)<<4 | (a.OpcrFlag&0x1)<<3 | (a.SplicingPointFlag&0x1)<<2 | (a.TransportPrivateDataFlag&0x1)<<1 | (a.AdaptationFieldExtensionFlag & 0x1)
-
-	tsData[6] = uint8((pcr >> 25) & 0xff)
-	tsData[7] = uint8((pcr >> 17) & 0xff)
-	tsData[8] = uint8((pcr >> 9) & 0xff)
-	tsData[9] = uint8((pcr >> 1) & 0xff)
-	tsData[10] = uint8(((pcr & 0x1) << 7) | 0x7e)
-	tsData[11] = 0x00
-
-	dataLen := len(data)
-	freeBuffLen := 188 - 12
-	if dataLen >= freeBuffLen {
-		dataLen = freeBuffLen
-		copy(tsData[12:12+dataLen], data)
-	} else {
-		copy(tsData[12:12+dataLen], data)
-		freeBuffLen = 188 - 12 - dataLen
-		for i := 0; i < freeBuffLen; i++ {
-			tsData[12+dataLen+i] = 0xff
-		}
-	}
-	return tsData, dataLen
-}
-
-// tsHeader + pesHeader + interFrame
-// TsPacketCreateInterFrame() 视频非关键帧的第一个tsPacket
-func TsPacketCreateInterFrame(s *Stream, pid uint16, data []byte) ([]byte, int) {
-	var th TsHeader
-	th.SyncByte = 0x47
-	th.TransportErrorIndicator = 0x0
-	th.PayloadUnitStartIndicator = 0x1
-	th.TransportPriority = 0x0
-	th.PID = pid
-	th.TransportScramblingControl = 0x0
-	th.AdaptationFieldControl = 0x1
-	th.ContinuityCounter = s.VideoCounter
-	s.VideoCounter++
-	if s.VideoCounter > 0xf {
-		s.VideoCounter = 0x0
-	}
-
-	tsData := make([]byte, 188)
-	tsData[0] = th.SyncByte
-	tsData[1] = (th.TransportErrorIndicator&0x1)<<7 | (th.PayloadUnitStartIndicator&0x1)<<6 | (th.TransportPriority&0x1)<<5 | uint8((th.PID&0x1f00)>>8)
-	tsData[2] = uint8(th.PID & 0xff)
-	tsData[3] = (th.TransportScramblingControl&0x3)<<6 | (th.AdaptationFieldControl&0x3)<<4 | (th.ContinuityCounter & 0xf)
-
-	dataLen := len(data)
-	freeBuffLen := 188 - 4
-	if dataLen >= freeBuffLen {
-		dataLen = freeBuffLen
-		copy(tsData[4:4+dataLen], data)
-	} else {
-		copy(tsData[4:4+dataLen], data)
-		freeBuffLen = 188 - 4 - dataLen
-		for i := 0; i < freeBuffLen; i++ {
-			tsData[i+4+dataLen] = 0xff
-		}
-	}
-	return tsData, dataLen
-}
-
-// tsHeader + pesHeader + adts + aacFrame
-// TsPacketCreateAacFrame() 音频帧的第一个tsPacket
-func TsPacketCreateAacFrame(s *Stream, pid uint16, data []byte) ([]byte, int) {
-	dataLen := len(data)
-	freeBuffLen := 188 - 4
-
-	var th TsHeader
-	th.SyncByte = 0x47
-	th.TransportErrorIndicator = 0x0
-	th.PayloadUnitStartIndicator = 0x1
-	th.TransportPriority = 0x0
-	th.PID = pid
-	th.TransportScramblingControl = 0x0
-	th.AdaptationFieldControl = 0x1
-	if dataLen < freeBuffLen {
-		th.AdaptationFieldControl = 0x3
-	}
-	th.ContinuityCounter = s.AudioCounter
-	s.AudioCounter++
-	if s.AudioCounter > 0xf {
-		s.AudioCounter = 0x0
-	}
-
-	tsData := make([]byte, 188)
-	tsData[0] = th.SyncByte
-	tsData[1] = (th.TransportErrorIndicator&0x1)<<7 | (th.PayloadUnitStartIndicator&0x1)<<6 | (th.TransportPriority&0x1)<<5 | uint8((th.PID&0x1f00)>>8)
-	tsData[2] = uint8(th.PID & 0xff)
-	tsData[3] = (th.TransportScramblingControl&0x3)<<6 | (th.AdaptationFieldControl&0x3)<<4 | (th.ContinuityCounter & 0xf)
-
-	if dataLen >= freeBuffLen {
-		dataLen = freeBuffLen
-		copy(tsData[4:4+dataLen], data)
-	} else {
-		padLen := 188 - 4 - 2 - dataLen
-		tsData[4] = uint8(padLen + 1)
-		if padLen < 0 {
-			padLen = 0
-			dataLen -= 1
-			tsData[4] = 0x1
-		}
-		tsData[5] = 0x0
-		for i := 0; i < padLen; i++ {
-			tsData[6+i] = 0xff
-		}
-		copy(tsData[6+padLen:], data)
-	}
-	return tsData, dataLen
-}
-
 //---------------------------------------------------------/
 // tsFile
 //---------------------------------------------------------/
 // xxx.ts文件 有很多个 188字节的ts包 组成
 func TsFileCreate(s *Stream, c *Chunk) {
 	if s.TsPath != "" {
-		s.TsFile.Close()
+		HlsSegClose(s)
+		if conf.HlsPartTime > 0 {
+			HlsPartEnd(s, c) // 上一个ts的最后一个part
+		}
 		M3u8Update(s, c)
 	}
 
 	s.TsPath = fmt.Sprintf("%s%s/%s_%d.ts", conf.HlsSavePath, s.Key, s.Key, s.TsLastSeq)
 	s.logHls.Println(s.TsPath)
 
-	var err error
-	s.TsFile, err = os.OpenFile(s.TsPath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	err := HlsSegOpen(s)
 	if err != nil {
 		log.Println(err)
 		s.TsPath = ""
 		return
 	}
+	if conf.HlsPartTime > 0 {
+		HlsPartTsStart(s, c)
+	}
+
+	// 每个ts都从pat/pmt开始, 第一个pes带pcr
+	s.TsPatPmtSet = false
+	s.TsPcrSet = false
+	TsFileAppend(s, c)
+	s.TsFirstTs = c.Timestamp
+	HlsDateTimeSet(s, c.Timestamp)
+	HlsCueSegStart(s)
+	s.TsLastSeq++
+	if conf.HlsPartTime > 0 {
+		M3u8LlUpdate(s)
+	}
+}
 
+// 第1个tsPacket是pat, 第2个tsPacket是pmt
+func TsPatPmtWrite(s *Stream) error {
 	_, patData := PatCreate()
 	s.TsData, _ = TsPacketCreatePatPmt(s, PatPid, patData)
-	_, err = s.TsFile.Write(s.TsData)
+	_, err := s.TsWriter.Write(s.TsData)
 	if err != nil {
 		s.logHls.Printf("Write ts fail, %s", err)
-		return
+		return err
 	}
 
-	_, pmtData := PmtCreate()
+	// 音视频的stream_type变了(如 MP3的第一个音频帧到达时), pmt的版本号加1
+	if st := [2]uint8{s.TsVideoType, s.TsAudioType}; st != s.TsPmtTypes {
+		s.TsPmtTypes = st
+		s.TsPmtVersion = (s.TsPmtVersion + 1) & 0x1f
+	}
+	_, pmtData := PmtCreate(s)
+	if s.HlsEncMethod == "SAMPLE-AES" {
+		pmtData = PmtSampleAesCreate(s)
+	}
+	if s.HlsId3 {
+		pmtData = PmtId3Add(pmtData)
+	}
 	s.TsData, _ = TsPacketCreatePatPmt(s, PmtPid, pmtData)
-	_, err = s.TsFile.Write(s.TsData)
+	_, err = s.TsWriter.Write(s.TsData)
 	if err != nil {
 		s.logHls.Printf("Write ts fail, %s", err)
-		return
+		return err
 	}
+	return nil
+}
 
-	TsFileAppend(s, c)
-	s.TsFirstTs = c.Timestamp
-	s.TsLastSeq++
+// 关键帧前, 新切片开始时, 和每隔TsPatPmtInterval 写pat/pmt
+// 播放器从任意位置开始(http-ts, ll-hls的part) 都能找到pat/pmt
+func TsPatPmtCheck(s *Stream, c *Chunk) error {
+	if s.TsPatPmtSet && c.DataType != "VideoKeyFrame" &&
+		c.Timestamp-s.TsPatPmtTs < TsPatPmtInterval {
+		return nil
+	}
+	if err := TsPatPmtWrite(s); err != nil {
+		return err
+	}
+	s.TsPatPmtTs = c.Timestamp
+	s.TsPatPmtSet = true
+	return nil
 }
 
-func TsFileAppendKeyFrame(s *Stream, c *Chunk) {
-	pesHeader, pesHeaderData := PesHeaderCreate(s, c)
-	pesData := PesDataCreateKeyFrame(s, c, pesHeaderData)
+// pcr在PcrPID的pes里, 关键帧 和 距离上次超过TsPcrInterval时 带pcr, 返回-1表示不带
+// pcr 是解码器的系统时钟, dts 是帧的解码时间, pcr 要比 dts 小, 见TsDtsOffset
+func TsPcrGet(s *Stream, c *Chunk, pid uint16) int64 {
+	if pid != TsPcrPid(s) {
+		return -1
+	}
+	if s.TsPcrSet && c.DataType != "VideoKeyFrame" &&
+		c.Timestamp-s.TsPcrTs < TsPcrInterval {
+		return -1
+	}
+	s.TsPcrTs = c.Timestamp
+	s.TsPcrSet = true
+	return int64(TsTimestamp(c.Timestamp))
+}
 
-	var pesDataLen = len(pesData)
-	//SetPesPakcetLength(pesData, uint16(pesDataLen)-6)
+// pes切成多个tsPacket写入
+func TsPesWrite(s *Stream, c *Chunk, pid uint16, pesData []byte) error {
+	pcr := TsPcrGet(s, c, pid)
+	rai := c.DataType == "VideoKeyFrame" || (pid == AudioPid && s.SpsPpsData == nil)
 
 	var consumeLen, start int
-	// pcr 和 dts是什么关系???
-	s.TsData, consumeLen = TsPacketCreateKeyFrame(s, VideoPid, pesData[start:], pesHeader.Dts)
-	start += consumeLen
-
-	_, err := s.TsFile.Write(s.TsData)
-	if err != nil {
-		s.logHls.Printf("Write ts fail, %s", err)
-		return
-	}
-
-	for {
-		s.TsData, consumeLen = TsPacketCreate(s, VideoPid, pesData[start:])
+	for start < len(pesData) {
+		s.TsData, consumeLen = TsPacketCreatePes(s, pid, pesData[start:], start == 0, pcr, rai)
 		start += consumeLen
 
-		_, err := s.TsFile.Write(s.TsData)
+		_, err := s.TsWriter.Write(s.TsData)
 		if err != nil {
 			s.logHls.Printf("Write ts fail, %s", err)
-			return
-		}
-
-		if start >= pesDataLen {
-			s.logHls.Printf("pesDataLen=%d, start=%d", pesDataLen, start)
-			break
+			return err
 		}
 	}
+	s.logHls.Printf("pesDataLen=%d, start=%d", len(pesData), start)
+	return nil
 }
 
-func TsFileAppendInterFrame(s *Stream, c *Chunk) {
+func TsFileAppendKeyFrame(s *Stream, c *Chunk) error {
 	_, pesHeaderData := PesHeaderCreate(s, c)
-	pesData := PesDataCreateInterFrame(s, c, pesHeaderData)
-
-	var pesDataLen = len(pesData)
-	SetPesPakcetLength(pesData, uint16(pesDataLen)-6)
-
-	var consumeLen, start int
-	s.TsData, consumeLen = TsPacketCreateInterFrame(s, VideoPid, pesData[start:])
-	start += consumeLen
-
-	_, err := s.TsFile.Write(s.TsData)
-	if err != nil {
-		s.logHls.Printf("Write ts fail, %s", err)
-		return
-	}
-
-	for {
-		s.TsData, consumeLen = TsPacketCreate(s, VideoPid, pesData[start:])
-		start += consumeLen
-
-		_, err := s.TsFile.Write(s.TsData)
-		if err != nil {
-			s.logHls.Printf("Write ts fail, %s", err)
-			return
-		}
+	pesData := PesDataCreateKeyFrame(s, c, pesHeaderData)
+	SetPesPakcetLength(pesData, len(pesData)-6)
+	return TsPesWrite(s, c, VideoPid, pesData)
+}
 
-		if start >= pesDataLen {
-			s.logHls.Printf("pesDataLen=%d, start=%d", pesDataLen, start)
-			break
-		}
-	}
+func TsFileAppendInterFrame(s *Stream, c *Chunk) error {
+	_, pesHeaderData := PesHeaderCreate(s, c)
+	pesData := PesDataCreateInterFrame(s, c, pesHeaderData)
+	SetPesPakcetLength(pesData, len(pesData)-6)
+	return TsPesWrite(s, c, VideoPid, pesData)
 }
 
-func TsFileAppendAacFrame(s *Stream, c *Chunk) {
+func TsFileAppendAacFrame(s *Stream, c *Chunk) error {
 	_, pesHeaderData := PesHeaderCreate(s, c)
 	pesData := PesDataCreateAacFrame(s, c, pesHeaderData)
-	//s.logHls.Printf(">>> %x", pesData)
-
-	var pesDataLen = len(pesData)
-	SetPesPakcetLength(pesData, uint16(pesDataLen)-6)
+	SetPesPakcetLength(pesData, len(pesData)-6)
+	return TsPesWrite(s, c, AudioPid, pesData)
+}
 
-	var consumeLen, start int
-	s.TsData, consumeLen = TsPacketCreateAacFrame(s, AudioPid, pesData[start:])
-	start += consumeLen
+// MP3和G.711 去掉1字节的AudioTagHeader 直接放到pes里
+func TsFileAppendAudioFrame(s *Stream, c *Chunk) error {
+	_, pesHeaderData := PesHeaderCreate(s, c)
+	pesData := append(pesHeaderData, c.MsgData[1:]...)
+	SetPesPakcetLength(pesData, len(pesData)-6)
+	return TsPesWrite(s, c, AudioPid, pesData)
+}
 
-	//s.logHls.Printf(">>> %x", s.TsData)
-	_, err := s.TsFile.Write(s.TsData)
-	if err != nil {
-		s.logHls.Printf("Write ts fail, %s", err)
-		return
+func TsFileAppend(s *Stream, c *Chunk) error {
+	switch c.DataType {
+	case "VideoKeyFrame", "VideoInterFrame", "AudioAacFrame", "AudioFrame":
+	default:
+		return nil
 	}
-
-	for {
-		s.TsData, consumeLen = TsPacketCreate(s, AudioPid, pesData[start:])
-		start += consumeLen
-
-		//s.logHls.Printf(">>> %x", s.TsData)
-		_, err := s.TsFile.Write(s.TsData)
-		if err != nil {
-			s.logHls.Printf("Write ts fail, %s", err)
-			return
-		}
-
-		if start >= pesDataLen {
-			s.logHls.Printf("pesDataLen=%d, start=%d", pesDataLen, start)
-			break
-		}
+	if err := TsPatPmtCheck(s, c); err != nil {
+		return err
 	}
-}
 
-func TsFileAppend(s *Stream, c *Chunk) {
+	c = SampleAesChunk(s, c)
 	switch c.DataType {
 	case "VideoKeyFrame":
-		TsFileAppendKeyFrame(s, c)
+		return TsFileAppendKeyFrame(s, c)
 	case "VideoInterFrame":
-		TsFileAppendInterFrame(s, c)
+		return TsFileAppendInterFrame(s, c)
 	case "AudioAacFrame":
-		TsFileAppendAacFrame(s, c)
-	default:
+		return TsFileAppendAacFrame(s, c)
+	case "AudioFrame":
+		return TsFileAppendAudioFrame(s, c)
+	}
+	return nil
+}
+
+// 时长够了 并且是关键帧时 截断, 只有音频时 时长够了就截断
+// 属于码率组时 跨过对齐的时间点 并且是关键帧时 截断, 见HlsAlignedCut()
+// 有广告标记时 不看时长, 下一个关键帧就截断, 见HlsCueCheck()
+// fmp4的音视频头变了 也是下一个关键帧就截断, 见Fmp4HeaderCheck()
+func HlsSegNeedCut(s *Stream, c *Chunk) bool {
+	if s.TsPath == "" {
+		return true
+	}
+	switch {
+	case s.HlsCuePend != "":
+	case s.HlsInitNew:
+	case s.HlsAligned:
+		if !HlsAlignedCut(s, c) {
+			return false
+		}
+	case uint32(s.TsExtInfo) < conf.HlsTsMaxTime:
+		return false
 	}
+	return c.DataType == "VideoKeyFrame" || (!HlsHasVideo(s) && ChunkIsAudioFrame(c))
 }
 
 // 新生成一个ts返回true, 否则返回false
@@ -806,12 +888,15 @@ func TsCreate(s *Stream, c *Chunk) bool {
 	s.logHls.Printf("c.Timestamp=%d, s.TsFirstTs=%d, s.TsExtInfo=%f, conf.HlsTsMaxTime=%d", c.Timestamp, s.TsFirstTs, s.TsExtInfo, conf.HlsTsMaxTime)
 
 	var tf bool
-	if s.TsPath == "" || (uint32(s.TsExtInfo) >= conf.HlsTsMaxTime && c.DataType == "VideoKeyFrame") {
+	if HlsSegNeedCut(s, c) {
 		s.logHls.Println("--->> TsFileCreate()")
 		TsFileCreate(s, c) // 新建TsFile, 并写入
 		tf = true
 	} else {
 		s.logHls.Println("--->> TsFileAppend()")
+		if conf.HlsPartTime > 0 {
+			HlsPartAppend(s, c) // 需要时 截断part
+		}
 		TsFileAppend(s, c) // 可以写入当前TsFile
 		tf = false
 	}
@@ -877,13 +962,17 @@ type PesHeader struct {
 // 音频的pts等于dts; 视频I帧(关键帧)的pts等于dts;
 // 视频P帧(没有B帧)的pts等于dts; 视频P帧(有B帧)的pts不等于dts;
 // 视频B帧(没有P帧)的pts等于dts; 视频B帧(有P帧)的pts不等于dts;
+// rtmp视频tag里的CompositionTime(cts) 就是 pts - dts, 单位为毫秒, 有B帧时不为0
+// ts里pts不能小于dts, cts为负数时(少数编码器) 按0处理
 func PesHeaderCreate(s *Stream, c *Chunk) (*PesHeader, []byte) {
-	dts := uint64(c.Timestamp * H264ClockFrequency)
+	dts := TsTimestamp(c.Timestamp + TsDtsOffset)
 	pts := dts
-	var CompositionTime uint32
+	var CompositionTime int32
 	if c.MsgTypeId == MsgTypeIdVideo { // 9
-		CompositionTime = ByteToUint32(c.MsgData[2:5], BE) // 24bit
-		pts = dts + uint64(CompositionTime*H264ClockFrequency)
+		CompositionTime = ByteToInt24(c.MsgData[2:5], BE) // 24bit
+		if CompositionTime > 0 {
+			pts = TsTimestamp(c.Timestamp + TsDtsOffset + uint32(CompositionTime))
+		}
 	}
 	s.logHls.Printf("c.DataType=%s, pts=%d, dts=%d, CompositionTime=%d", c.DataType, pts, dts, CompositionTime)
 
@@ -944,7 +1033,7 @@ func PesHeaderCreate(s *Stream, c *Chunk) (*PesHeader, []byte) {
 	pes.MarkerBit2 = 0x1
 	if pes.PtsDtsFlags == 0x2 { // 只有PTS, 40bit
 		pes.FixedValue1 = 0x2
-		pesData[9] = (pes.FixedValue1&0xf)<<4 | uint8((pes.Pts>>29)&0xd) | (pes.MarkerBit0 & 0x1)
+		pesData[9] = (pes.FixedValue1&0xf)<<4 | uint8((pes.Pts>>29)&0xe) | (pes.MarkerBit0 & 0x1)
 		pesData[10] = uint8((pes.Pts >> 22) & 0xff)
 		pesData[11] = uint8((pes.Pts>>14)&0xfe) | (pes.MarkerBit1 & 0x1)
 		pesData[12] = uint8((pes.Pts >> 7) & 0xff)
@@ -952,13 +1041,13 @@ func PesHeaderCreate(s *Stream, c *Chunk) (*PesHeader, []byte) {
 	}
 	if pes.PtsDtsFlags == 0x3 { // 有PTS 有DTS, 40bit + 40bit
 		pes.FixedValue1 = 0x3
-		pesData[9] = (pes.FixedValue1&0xf)<<4 | uint8((pes.Pts>>29)&0xd) | (pes.MarkerBit0 & 0x1)
+		pesData[9] = (pes.FixedValue1&0xf)<<4 | uint8((pes.Pts>>29)&0xe) | (pes.MarkerBit0 & 0x1)
 		pesData[10] = uint8((pes.Pts >> 22) & 0xff)
 		pesData[11] = uint8((pes.Pts>>14)&0xfe) | (pes.MarkerBit1 & 0x1)
 		pesData[12] = uint8((pes.Pts >> 7) & 0xff)
 		pesData[13] = uint8((pes.Pts&0x7F)<<1) | (pes.MarkerBit2 & 0x1)
 		pes.FixedValue1 = 0x1
-		pesData[14] = (pes.FixedValue1&0xf)<<4 | uint8((pes.Dts>>29)&0xd) | (pes.MarkerBit0 & 0x1)
+		pesData[14] = (pes.FixedValue1&0xf)<<4 | uint8((pes.Dts>>29)&0xe) | (pes.MarkerBit0 & 0x1)
 		pesData[15] = uint8((pes.Dts >> 22) & 0xff)
 		pesData[16] = uint8((pes.Dts>>14)&0xfe) | (pes.MarkerBit1 & 0x1)
 		pesData[17] = uint8((pes.Dts >> 7) & 0xff)
@@ -968,79 +1057,102 @@ func PesHeaderCreate(s *Stream, c *Chunk) (*PesHeader, []byte) {
 	return &pes, pesData
 }
 
-func SetPesPakcetLength(d []byte, size uint16) {
-	// 16bit, 最大值65536, 如果放不下就不放了
+// rtmp时间戳(毫秒) 转为90kHz的时钟, 33bit回绕
+// rtmp时间戳是32bit 回绕时 2^32*90 正好是2^33的倍数, 所以结果也是连续的
+func TsTimestamp(ms uint32) uint64 {
+	return (uint64(ms) * H264ClockFrequency) & TsTimestampMax
+}
+
+// 16bit, 最大值65535, 放不下时为0(只有视频可以为0), 表示长度不限
+func SetPesPakcetLength(d []byte, size int) {
 	if size > 0xffff {
-		return
+		size = 0
 	}
-	Uint16ToByte(size, d[4:6], BE)
+	Uint16ToByte(uint16(size), d[4:6], BE)
 }
 
 //0x00000001 + 0x09 + 0xf0, ffmpeg转出的ts有这6个字节, 没有也可以
-//0x00000001 + 0x67 + sps + 0x00000001 + 0x68 + pps + 0x00000001 + 0x65 + iFrame
+//0x00000001 + 0x67 + sps + 0x00000001 + 0x68 + pps + 0x00000001 + 0x06 + sei + 0x00000001 + 0x65 + iFrame
+// hevc的分隔符是 0x00000001 + 0x46 0x01 + 0x50, 关键帧前是 vps + sps + pps
 // 返回值: pesHeader + pesBody
 func PesDataCreateKeyFrame(s *Stream, c *Chunk, phd []byte) []byte {
 	pesHeaderDataLen := len(phd)
 	SpsPpsDataLen := len(s.SpsPpsData)
-	MsgDataLen := int(c.MsgLength) - 9
-	dataLen := pesHeaderDataLen + SpsPpsDataLen + 6 + 3 + MsgDataLen
-	s.logHls.Println(pesHeaderDataLen, SpsPpsDataLen, 9, MsgDataLen, dataLen)
+	aud := TsVideoAud(s)
+	es := NaluAnnexB(c.MsgData[5:], s.TsVideoType == 0x24)
+	MsgDataLen := len(es)
+	dataLen := pesHeaderDataLen + SpsPpsDataLen + len(aud) + MsgDataLen
+	s.logHls.Println(pesHeaderDataLen, SpsPpsDataLen, len(aud), MsgDataLen, dataLen)
 	data := make([]byte, dataLen)
 
 	ss := 0
 	ee := pesHeaderDataLen
 	copy(data[ss:ee], phd)
 	ss = ee
-	ee += 4
-	Uint32ToByte(0x00000001, data[ss:ee], BE)
-	ss = ee
-	ee += 1
-	data[ss] = 0x09
-	ss = ee
-	ee += 1
-	data[ss] = 0xf0
+	ee += len(aud)
+	copy(data[ss:ee], aud)
 	ss = ee
 	ee += SpsPpsDataLen
 	copy(data[ss:ee], s.SpsPpsData)
 	ss = ee
-	ee += 3
-	Uint24ToByte(0x000001, data[ss:ee], BE)
-	//Uint32ToByte(0x00000001, data[ss:ee], BE)
-	ss = ee
 	ee += MsgDataLen
 	//s.logHls.Printf("%x", c.MsgData)
-	copy(data[ss:], c.MsgData[9:])
+	copy(data[ss:], es)
 	return data
 }
 
 func PesDataCreateInterFrame(s *Stream, c *Chunk, phd []byte) []byte {
 	pesHeaderDataLen := len(phd)
-	MsgDataLen := int(c.MsgLength) - 9
-	dataLen := pesHeaderDataLen + 6 + 3 + MsgDataLen
+	aud := TsVideoAud(s)
+	es := NaluAnnexB(c.MsgData[5:], s.TsVideoType == 0x24)
+	MsgDataLen := len(es)
+	dataLen := pesHeaderDataLen + len(aud) + MsgDataLen
 	data := make([]byte, dataLen)
 
 	ss := 0
 	ee := pesHeaderDataLen
 	copy(data[ss:ee], phd)
 	ss = ee
-	ee += 4
-	Uint32ToByte(0x00000001, data[ss:ee], BE)
-	ss = ee
-	ee += 1
-	data[ss] = 0x09
-	ss = ee
-	ee += 1
-	data[ss] = 0xf0
-	ss = ee
-	ee += 3
-	Uint24ToByte(0x000001, data[ss:ee], BE)
-	//Uint32ToByte(0x00000001, data[ss:ee], BE)
+	ee += len(aud)
+	copy(data[ss:ee], aud)
 	ss = ee
 	ee += MsgDataLen
-	copy(data[ss:], c.MsgData[9:])
+	copy(data[ss:], es)
 	return data
 }
 
+// 每个视频pes开头的分隔符(access unit delimiter)
+// h264是 nalu type 9 + primary_pic_type, hevc是 nalu type 35 + pic_type
+func TsVideoAud(s *Stream) []byte {
+	if s.TsVideoType == 0x24 {
+		return []byte{0x00, 0x00, 0x00, 0x01, 0x46, 0x01, 0x50}
+	}
+	return []byte{0x00, 0x00, 0x00, 0x01, 0x09, 0xf0}
+}
+
+// rtmp视频数据(AVCC)里 每个nalu前是4字节的长度, ts里要换成开始码(Annex B)
+// 一帧里可能有多个nalu(如 SEI + 关键帧), 每个都要换, SEI(字幕等)原样保留
+// 数据里的分隔符(h264 type 9, hevc type 35) 去掉, pes开头已经有了
+// 长度不对时 剩下的数据当作一个nalu
+func NaluAnnexB(d []byte, hevc bool) []byte {
+	out := make([]byte, 0, len(d)+16)
+	for len(d) > 0 {
+		var nalu []byte
+		if len(d) >= 4 && ByteToUint32(d[:4], BE) <= uint32(len(d)-4) {
+			n := ByteToUint32(d[:4], BE)
+			nalu, d = d[4:4+n], d[4+n:]
+		} else {
+			nalu, d = d, nil
+		}
+		if len(nalu) == 0 || (!hevc && nalu[0]&0x1f == 9) || (hevc && (nalu[0]>>1)&0x3f == 35) {
+			continue
+		}
+		out = append(out, 0x00, 0x00, 0x00, 0x01)
+		out = append(out, nalu...)
+	}
+	return out
+}
+
 func PesDataCreateAacFrame(s *Stream, c *Chunk, phd []byte) []byte {
 	pesHeaderDataLen := len(phd)
 	MsgDataLen := int(c.MsgLength) - 2
@@ -1130,8 +1242,13 @@ func PatCreate() (*Pat, []byte) {
 /* pmt
 /**********************************************************/
 // StreamType             uint8  // 8bit, arr 5byte
+// 0x03		MPEG-1 Audio Layer III (mp3)
 // 0x0f		Audio with ADTS transport syntax
 // 0x1b		H.264
+// 0x24		H.265
+// 0x90		G.711 A-law, 私有值 和海康/ZLMediaKit一样
+// 0x91		G.711 mu-law, 私有值
+// 0x15		Metadata carried in PES packets(ID3), 见PmtId3Add()
 // 40bit = 5byte
 type PmtStream struct {
 	StreamType    uint8  // 8bit, 节目数据类型
@@ -1141,7 +1258,7 @@ type PmtStream struct {
 	EsInfoLength  uint16 // 12bit, 私有数据长度
 }
 
-// 3 + 9 + 5*2 + 4 = 26byte
+// 3 + 9 + 5*n + 4 byte, n为音视频的个数
 type Pmt struct {
 	TableId                uint8       // 8bit, 固定值0x02, 表示是PMT
 	SectionSyntaxIndicator uint8       // 1bit, 固定值0x1
@@ -1162,37 +1279,75 @@ type Pmt struct {
 	CRC32                  uint32      // 32bit
 }
 
-func PmtCreate() (*Pmt, []byte) {
+// flv视频tag的CodecId 对应的stream_type, 0表示不支持
+func TsVideoStreamType(codecId uint8) uint8 {
+	switch codecId {
+	case 7: // AVC
+		return 0x1b
+	case 12: // HEVC, 国内扩展的flv
+		return 0x24
+	}
+	return 0
+}
+
+// flv音频tag的SoundFormat 对应的stream_type, 0表示不支持
+func TsAudioStreamType(soundFormat uint8) uint8 {
+	switch soundFormat {
+	case 2, 14: // MP3, MP3 8kHz
+		return 0x03
+	case 7: // G.711 A-law
+		return 0x90
+	case 8: // G.711 mu-law
+		return 0x91
+	case 10: // AAC
+		return 0x0f
+	}
+	return 0
+}
+
+// 有视频时 pcr在视频里, 只有音频时 pcr在音频里
+func TsPcrPid(s *Stream) uint16 {
+	if s.TsVideoType == 0 && s.TsAudioType != 0 {
+		return AudioPid
+	}
+	return VideoPid
+}
+
+// 按实际的音视频生成pmt, 只有视频 或 只有音频时 只有一个PmtStream
+// 还没收到音视频头时(不应该发生) 按H.264+AAC处理
+func PmtCreate(s *Stream) (*Pmt, []byte) {
 	var pmt Pmt
 	pmt.TableId = 0x2
 	pmt.SectionSyntaxIndicator = 0x1
 	pmt.Zero = 0x0
 	pmt.Reserved0 = 0x3
-	pmt.SectionLength = 0x17
 	pmt.ProgramNumber = 0x1
 	pmt.Reserved1 = 0x3
-	pmt.VersionNumber = 0x0
+	pmt.VersionNumber = s.TsPmtVersion
 	pmt.CurrentNextIndicator = 0x1
 	pmt.SectionNumber = 0x0
 	pmt.LastSectionNumber = 0x0
 	pmt.Reserved2 = 0x7
-	pmt.PcrPID = VideoPid
+	pmt.PcrPID = TsPcrPid(s)
 	pmt.Reserved3 = 0xf
 	pmt.ProgramInfoLength = 0x0
-	pmt.PmtStream = make([]PmtStream, 2)
-	pmt.PmtStream[1].StreamType = 0x1b // AVC video stream as defined in ITU-T Rec. H.264 | ISO/IEC 14496-10 Video
-	pmt.PmtStream[1].Reserved4 = 0x7
-	pmt.PmtStream[1].ElementaryPID = VideoPid
-	pmt.PmtStream[1].Reserved5 = 0xf
-	pmt.PmtStream[1].EsInfoLength = 0x0
-	pmt.PmtStream[0].StreamType = 0xf // ISO/IEC 13818-7 Audio with ADTS transport syntax
-	pmt.PmtStream[0].Reserved4 = 0x7
-	pmt.PmtStream[0].ElementaryPID = AudioPid
-	pmt.PmtStream[0].Reserved5 = 0xf
-	pmt.PmtStream[0].EsInfoLength = 0x0
+
+	vt, at := s.TsVideoType, s.TsAudioType
+	if vt == 0 && at == 0 {
+		vt, at = 0x1b, 0x0f
+	}
+	if at != 0 {
+		pmt.PmtStream = append(pmt.PmtStream, PmtStream{at, 0x7, AudioPid, 0xf, 0x0})
+	}
+	if vt != 0 {
+		pmt.PmtStream = append(pmt.PmtStream, PmtStream{vt, 0x7, VideoPid, 0xf, 0x0})
+	}
+	// 5 + 4 + 5*n + 4
+	pmt.SectionLength = uint16(13 + 5*len(pmt.PmtStream))
 	pmt.CRC32 = 0
 
-	pmtData := make([]byte, 26)
+	n := 3 + int(pmt.SectionLength)
+	pmtData := make([]byte, n)
 	pmtData[0] = pmt.TableId
 	pmtData[1] = (pmt.SectionSyntaxIndicator&0x1)<<7 | (pmt.Zero&0x1)<<6 | (pmt.Reserved0&0x3)<<4 | uint8((pmt.SectionLength&0xf00)>>8)
 	pmtData[2] = uint8(pmt.SectionLength & 0xff)
@@ -1204,21 +1359,17 @@ func PmtCreate() (*Pmt, []byte) {
 	pmtData[9] = uint8(pmt.PcrPID & 0xff)
 	pmtData[10] = (pmt.Reserved3&0xf)<<4 | uint8((pmt.ProgramInfoLength&0xf00)>>8)
 	pmtData[11] = uint8(pmt.ProgramInfoLength & 0xff)
-	ps0 := pmt.PmtStream[0]
-	ps1 := pmt.PmtStream[1]
-	pmtData[12] = ps0.StreamType
-	pmtData[13] = (ps0.Reserved4&0x7)<<5 | uint8((ps0.ElementaryPID&0x1f00)>>8)
-	pmtData[14] = uint8(ps0.ElementaryPID & 0xff)
-	pmtData[15] = (ps0.Reserved5|0xf)<<4 | uint8((ps0.EsInfoLength&0xf00)>>8)
-	pmtData[16] = uint8(ps0.EsInfoLength & 0xff)
-	pmtData[17] = ps1.StreamType
-	pmtData[18] = (ps1.Reserved4&0x7)<<5 | uint8((ps1.ElementaryPID&0x1f00)>>8)
-	pmtData[19] = uint8(ps1.ElementaryPID & 0xff)
-	pmtData[20] = (ps1.Reserved5|0xf)<<4 | uint8((ps1.EsInfoLength&0xf00)>>8)
-	pmtData[21] = uint8(ps1.EsInfoLength & 0xff)
-
-	pmt.CRC32 = Crc32Create(pmtData[:22])
-	Uint32ToByte(pmt.CRC32, pmtData[22:26], BE)
+	for i, ps := range pmt.PmtStream {
+		d := pmtData[12+5*i:]
+		d[0] = ps.StreamType
+		d[1] = (ps.Reserved4&0x7)<<5 | uint8((ps.ElementaryPID&0x1f00)>>8)
+		d[2] = uint8(ps.ElementaryPID & 0xff)
+		d[3] = (ps.Reserved5&0xf)<<4 | uint8((ps.EsInfoLength&0xf00)>>8)
+		d[4] = uint8(ps.EsInfoLength & 0xff)
+	}
+
+	pmt.CRC32 = Crc32Create(pmtData[:n-4])
+	Uint32ToByte(pmt.CRC32, pmtData[n-4:], BE)
 	return &pmt, pmtData
 }
 
@@ -1328,7 +1479,7 @@ live_cctv1_h264_aac_timestamp_3.ts
 */
 
 var m3u8Head = `#EXTM3U
-#EXT-X-VERSION:3
+#EXT-X-VERSION:%d
 #EXT-X-TARGETDURATION:%d
 #EXT-X-MEDIA-SEQUENCE:%d`
 
@@ -1337,62 +1488,75 @@ var m3u8Body = `#EXTINF:%.2f, no desc
 %s`
 
 type TsInfo struct {
-	TsInfoStr  string  // m3u8里ts的记录
-	TsExtInfo  float64 // ts文件的播放时长
-	TsFilepath string  // ts存储路径 包含文件名
+	TsInfoStr  string    // m3u8里ts的记录
+	TsExtInfo  float64   // ts文件的播放时长
+	TsFilepath string    // ts存储路径 包含文件名
+	Parts      []HlsPart // ll-hls, ts里的part
+	TagStr     string    // ts前面的 #EXT-X-PROGRAM-DATE-TIME, 加密时还有 #EXT-X-KEY
+	KeyPath    string    // 加密时 key的存储路径 包含文件名
+	Disc       bool      // ts前面有 #EXT-X-DISCONTINUITY
+	MapPath    string    // fmp4时 init.mp4的存储路径 包含文件名
 }
 
 func M3u8Update(s *Stream, c *Chunk) {
-	// s.TsNum 初始值为0, conf.HlsM3u8TsNum 通常为6
-	if s.TsNum == uint32(conf.HlsM3u8TsNum) {
+	// live时 s.TsNum 最大为 conf.HlsM3u8TsNum, 通常为6
+	for HlsNeedEvict(s, s.TsExtInfo) {
 		e := s.TsList.Front()
 		ti := (e.Value).(TsInfo)
-		os.Remove(ti.TsFilepath)
+		HlsFileRemove(ti.TsFilepath)
+		HlsPartRemove(ti)
 		s.TsList.Remove(e)
-		s.TsNum--
-		s.TsFirstSeq++
+		HlsKeyRemove(s, ti)
+		HlsInitRemove(s, ti)
+		HlsVttRemove(s, ti)
+		HlsTsInfoEvict(s, ti)
 	}
 	tiStr := fmt.Sprintf(m3u8Body, s.TsExtInfo, path.Base(s.TsPath))
-	ti := TsInfo{tiStr, s.TsExtInfo, s.TsPath}
+	ti := TsInfo{tiStr, s.TsExtInfo, s.TsPath, s.PartList, HlsSegTagCreate(s), s.HlsKeyPath, s.TsDisc, s.HlsInitPath}
+	s.TsDisc = false
 	s.TsList.PushBack(ti)
 	s.TsNum++
-
-	var tsMaxTime float64
-	var tis string
-	for e := s.TsList.Front(); e != nil; e = e.Next() {
-		ti = (e.Value).(TsInfo)
-		if tsMaxTime < ti.TsExtInfo {
-			tsMaxTime = ti.TsExtInfo
-		}
-		tis = fmt.Sprintf("%s\n%s", tis, ti.TsInfoStr)
+	s.TsListTime += s.TsExtInfo
+	HlsBandwidthUpdate(s, s.TsPath, s.TsExtInfo)
+	HlsArchiveAppend(s, ti)
+	HlsVttSegWrite(s, s.TsPath, c.Timestamp)
+	HlsVttM3u8Write(s, "")
+	MpdSharedUpdate(s, c)
+
+	// ll-hls 在新ts开始后 再更新m3u8, 见TsFileCreate()
+	if conf.HlsPartTime > 0 {
+		return
 	}
 
-	s.M3u8Data = fmt.Sprintf(m3u8Head, uint32(math.Ceil(tsMaxTime)), s.TsFirstSeq)
-	s.M3u8Data = fmt.Sprintf("%s%s", s.M3u8Data, tis)
+	s.M3u8Data = M3u8Create(s)
 	//s.logHls.Println(s.M3u8Data)
 
-	// 打开文件
-	var err error
-	if s.M3u8File == nil {
-		s.M3u8File, err = os.OpenFile(s.M3u8Path, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
-		if err != nil {
-			log.Println(err)
-			return
-		}
-	}
 	// 写入文件
-	_, err = s.M3u8File.WriteString(s.M3u8Data)
+	err := HlsFileWrite(s.M3u8Path, []byte(s.M3u8Data))
 	if err != nil {
 		s.logHls.Printf("Write %s fail, %s", s.M3u8Path, err)
 		return
 	}
-	// 关闭文件
-	err = s.M3u8File.Close()
-	if err != nil {
-		log.Println(err)
-		return
+	HlsOnDemandReady(s)
+}
+
+// 只包含已完成的切片
+func M3u8Create(s *Stream) string {
+	var tsMaxTime float64
+	var tis string
+	for e := s.TsList.Front(); e != nil; e = e.Next() {
+		ti := (e.Value).(TsInfo)
+		if tsMaxTime < ti.TsExtInfo {
+			tsMaxTime = ti.TsExtInfo
+		}
+		tis = fmt.Sprintf("%s%s\n%s", tis, ti.TagStr, ti.TsInfoStr)
 	}
-	s.M3u8File = nil
+
+	m3u8 := fmt.Sprintf(m3u8Head, HlsVersion(s), uint32(math.Ceil(tsMaxTime)), s.TsFirstSeq)
+	m3u8 += HlsDiscSeqCreate(s)
+	m3u8 += HlsPlaylistTypeCreate(s)
+	m3u8 += HlsMapCreate(s)
+	return fmt.Sprintf("%s%s", m3u8, tis)
 }
 
 func M3u8Update0(s *Stream, c *Chunk) {
@@ -1406,11 +1570,11 @@ func M3u8Update0(s *Stream, c *Chunk) {
 		s.TsFirstSeq++
 	}
 	tiStr := fmt.Sprintf(m3u8Body, s.TsExtInfo, path.Base(s.TsPath))
-	ti := TsInfo{tiStr, s.TsExtInfo, s.TsPath}
+	ti := TsInfo{tiStr, s.TsExtInfo, s.TsPath, nil, "", "", false, ""}
 	s.TsList.PushBack(ti)
 	s.TsNum++
 
-	s.M3u8Data = fmt.Sprintf(m3u8Head, conf.HlsTsMaxTime, s.TsFirstSeq)
+	s.M3u8Data = fmt.Sprintf(m3u8Head, HlsVersion(s), conf.HlsTsMaxTime, s.TsFirstSeq)
 
 	var tis string
 	for e := s.TsList.Front(); e != nil; e = e.Next() {
@@ -1453,7 +1617,7 @@ func M3u8Update0(s *Stream, c *Chunk) {
 func GetPlayInfo(url string) (string, string, string) {
 	ext := path.Ext(url)
 	switch ext {
-	case ".m3u8", ".flv":
+	case ".m3u8", ".flv", ".mpd":
 		s := strings.Split(url, "/")
 		if len(s) < 3 {
 			return "", "", ""
@@ -1463,38 +1627,103 @@ func GetPlayInfo(url string) (string, string, string) {
 			return "", "", ""
 		}
 		return s[1], ss[0], path.Base(url)
-	case ".ts":
+	case ".ts", ".m4s", ".mp4", ".key", ".vtt":
 		//dir := path.Dir(url) // /live
-		fn := path.Base(url) // live_yuankang_0.ts
-		s := strings.Split(fn, "_")
-		if len(s) < 3 {
+		fn := path.Base(url) // live_yuankang_0.ts, live_yuankang_0.m4s, live_yuankang_0_init.mp4, live_yuankang_0.vtt
+		key := HlsSegKey(fn)
+		if key == "" {
 			return "", "", ""
 		}
+		// 流名里可以有_, app用url里的
+		if s := strings.Split(url, "/"); len(s) >= 3 && strings.HasPrefix(key, s[1]+"_") {
+			return s[1], key[len(s[1])+1:], fn
+		}
+		s := strings.SplitN(key, "_", 2)
 		return s[0], s[1], fn
 	}
 	return "", "", ""
 }
 
+// 切片文件名 去掉结尾的 _init、_序号、dash的_video/_audio 就是发布者的key
+// live_name_1080_3.ts, live_name_1080_3.2.ts(part), live_name_1080_3_init.mp4, live_name_1080_3.key
+// live_name_1080_video_180000.m4s, live_name_1080_video_0_init.mp4
+// 流名以_video/_audio结尾时 有这个发布者 就不再去掉
+func HlsSegKey(fn string) string {
+	ss := strings.Split(strings.TrimSuffix(fn, path.Ext(fn)), "_")
+	n := len(ss)
+	if n > 0 && ss[n-1] == "init" {
+		n--
+	}
+	if n > 0 && ss[n-1] != "" && strings.Trim(ss[n-1], "0123456789.") == "" {
+		n--
+	}
+	if n < 2 {
+		return ""
+	}
+	key := strings.Join(ss[:n], "_")
+	if _, ok := PublisherGet(key); ok || n < 3 {
+		return key
+	}
+	if ss[n-1] == "video" || ss[n-1] == "audio" {
+		return strings.Join(ss[:n-1], "_")
+	}
+	return key
+}
+
+// 带有参数 ?master 时 返回master m3u8, 码率组的名字 也返回master m3u8
+// 带有参数 ?start=xxx&end=xxx 时 返回归档切片的VOD m3u8
+// 带有参数 ?vtt 时 返回字幕m3u8, 见HlsCaptionInfo
+// ll-hls的阻塞请求带有参数 ?_HLS_msn=8&_HLS_part=3, 所以用r.URL.Path
 func GetM3u8(w http.ResponseWriter, r *http.Request) ([]byte, error) {
 	//app, stream, fn := GetPlayInfo(r.URL.String())
-	app, stream, _ := GetPlayInfo(r.URL.String())
+	app, stream, _ := GetPlayInfo(r.URL.Path)
+	if s, ok := PublisherGet(fmt.Sprintf("%s_%s", app, stream)); ok && r.URL.Query().Get("start") == "" {
+		HlsOnDemandWait(s)
+	}
+	if _, ok := r.URL.Query()["master"]; ok {
+		return GetM3u8Master(app, stream, r)
+	}
+	if ss := HlsRenditionsGet(app, stream); len(ss) > 0 {
+		HlsOnDemandWait(ss...)
+		return M3u8GroupCreate(ss, r), nil
+	}
+	if r.URL.Query().Get("start") != "" {
+		d, err := GetM3u8Archive(app, stream, r)
+		if err != nil {
+			return nil, err
+		}
+		return M3u8KeyTokenAdd(d, r), nil
+	}
+	if conf.HlsPartTime > 0 {
+		if err := M3u8LlWait(app, stream, r); err != nil {
+			log.Println(err)
+			return nil, err
+		}
+	}
 	file := fmt.Sprintf("%s%s_%s/%s_%s.m3u8", conf.HlsSavePath, app, stream, app, stream)
+	if _, ok := r.URL.Query()["vtt"]; ok {
+		file = fmt.Sprintf("%s%s_%s/%s_%s_vtt.m3u8", conf.HlsSavePath, app, stream, app, stream)
+	}
 	//log.Println(app, stream, fn, file)
 
-	d, err := utils.ReadAllFile(file)
+	d, err := HlsFileRead(file)
 	if err != nil {
 		log.Println(err)
 		return nil, err
 	}
-	return d, nil
+	return M3u8KeyTokenAdd(d, r), nil
 }
 
 func GetTs(w http.ResponseWriter, r *http.Request) ([]byte, error) {
-	app, stream, fn := GetPlayInfo(r.URL.String())
+	app, stream, fn := GetPlayInfo(r.URL.Path)
 	file := fmt.Sprintf("%s%s_%s/%s", conf.HlsSavePath, app, stream, fn)
 	//log.Println(app, stream, fn, file)
+	HlsOnDemandTouch(app, stream)
+	if conf.HlsPartTime > 0 {
+		HlsPartWait(app, stream, file)
+	}
 
-	d, err := utils.ReadAllFile(file)
+	d, err := HlsFileRead(file)
 	if err != nil {
 		log.Println(err)
 		return nil, err
@@ -0,0 +1,542 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"testing"
+)
+
+/**********************************************************/
+/* ts muxer test
+/**********************************************************/
+// 用TsFileAppend()生成ts, 再按ISO/IEC 13818-1解析检查
+// 每个pid的ContinuityCounter连续, 关键帧前有pat/pmt, pcr间隔不超过100ms 且不大于dts
+// 视频pes超过65535字节时 PES_packet_length为0, pmt的CRC32正确 且只有实际的音视频
+// pes的pid 都在前面的pmt里, pmt变了 version_number也要变
+
+// 0x17 0x00 + cts + AVCDecoderConfigurationRecord, 同VideoHandle()里的例子
+var TsTestVideoHeader = []byte{
+	0x17, 0x00, 0x00, 0x00, 0x00, 0x01, 0x4d, 0x40, 0x1f, 0xff,
+	0xe1, 0x00, 0x1c, 0x67, 0x4d, 0x40, 0x1f, 0xe8, 0x80, 0x28,
+	0x02, 0xdd, 0x80, 0xb5, 0x01, 0x01, 0x01, 0x40, 0x00, 0x00,
+	0x03, 0x00, 0x40, 0x00, 0x00, 0x0c, 0x03, 0xc6, 0x0c, 0x44,
+	0x80, 0x01, 0x00, 0x04, 0x68, 0xeb, 0xef, 0x20}
+
+// 0x1c 0x00 + cts + HEVCDecoderConfigurationRecord, 1280x720 Main, vps + sps + pps
+var TsTestHevcHeader = []byte{
+	0x1c, 0x00, 0x00, 0x00, 0x00,
+	0x01, 0x01, 0x60, 0x00, 0x00, 0x00, 0x90, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x5d, 0xf0, 0x00, 0xfc, 0xfd, 0xf8, 0xf8, 0x00,
+	0x00, 0x0f, 0x03,
+	0xa0, 0x00, 0x01, 0x00, 0x18,
+	0x40, 0x01, 0x0c, 0x01, 0xff, 0xff, 0x01, 0x60, 0x00, 0x00,
+	0x03, 0x00, 0x90, 0x00, 0x00, 0x03, 0x00, 0x00, 0x03, 0x00,
+	0x5d, 0x95, 0x98, 0x09,
+	0xa1, 0x00, 0x01, 0x00, 0x29,
+	0x42, 0x01, 0x01, 0x01, 0x60, 0x00, 0x00, 0x03, 0x00, 0x90,
+	0x00, 0x00, 0x03, 0x00, 0x00, 0x03, 0x00, 0x5d, 0xa0, 0x02,
+	0x80, 0x80, 0x2d, 0x16, 0x59, 0x59, 0xa4, 0x93, 0x2b, 0xc0,
+	0x5a, 0x70, 0x80, 0x00, 0x01, 0xf4, 0x80, 0x00, 0x3a, 0x98,
+	0x04,
+	0xa2, 0x00, 0x01, 0x00, 0x07,
+	0x44, 0x01, 0xc1, 0x72, 0xb4, 0x62, 0x40}
+
+// 0xaf 0x00 + AudioSpecificConfig, AAC LC 44100Hz 双声道
+var TsTestAudioHeader = []byte{0xaf, 0x00, 0x12, 0x10}
+
+// Video是flv的CodecId, Audio是flv的SoundFormat, 0表示没有
+type TsTestCase struct {
+	Name     string
+	Video    uint8
+	Audio    uint8
+	BigFrame int      // 大于0时 第二个关键帧是这么大
+	Streams  [][2]int // pmt里的 stream_type 和 pid, PmtCreate()先写音频
+	PcrPid   uint16
+}
+
+var TsTestCases = []TsTestCase{
+	{"video+audio", 7, 10, 0, [][2]int{{0x0f, AudioPid}, {0x1b, VideoPid}}, VideoPid},
+	{"video only", 7, 0, 0, [][2]int{{0x1b, VideoPid}}, VideoPid},
+	{"audio only", 0, 10, 0, [][2]int{{0x0f, AudioPid}}, AudioPid},
+	{"large pes", 7, 10, 70000, [][2]int{{0x0f, AudioPid}, {0x1b, VideoPid}}, VideoPid},
+	{"hevc+mp3", 12, 2, 0, [][2]int{{0x03, AudioPid}, {0x24, VideoPid}}, VideoPid},
+	{"g711a only", 0, 7, 0, [][2]int{{0x90, AudioPid}}, AudioPid},
+	{"hevc+g711u", 12, 8, 0, [][2]int{{0x91, AudioPid}, {0x24, VideoPid}}, VideoPid},
+}
+
+type TsTestPacket struct {
+	Pid     uint16
+	Pusi    bool
+	Cc      uint8
+	Rai     bool
+	Pcr     int64 // -1表示没有
+	Payload []byte
+}
+
+type TsTestPes struct {
+	Pid    uint16
+	First  int // 第一个tsPacket的下标
+	Data   []byte
+	Length int // PES_packet_length
+	Dts    int64
+}
+
+// MP3和G.711没有音频头, 音频帧到达时 TsAudioTypeUpdate()
+func TsTestStream(tc TsTestCase) *Stream {
+	s := &Stream{}
+	s.log = log.New(ioutil.Discard, "", 0)
+	s.logHls = s.log
+	switch tc.Video {
+	case 7:
+		PrepareSpsPpsData(s, &Chunk{MsgTypeId: MsgTypeIdVideo, DataType: "VideoHeader", MsgData: TsTestVideoHeader})
+	case 12:
+		PrepareSpsPpsData(s, &Chunk{MsgTypeId: MsgTypeIdVideo, DataType: "VideoHeader", MsgData: TsTestHevcHeader})
+	}
+	if tc.Audio == 10 {
+		PrepareAdtsData(s, &Chunk{MsgTypeId: MsgTypeIdAudio, DataType: "AudioHeader", MsgData: TsTestAudioHeader})
+		ParseAdtsData(s)
+	}
+	return s
+}
+
+// 3秒的数据, 视频30fps 每秒一个关键帧, 音频每帧23ms, 按时间戳交错
+func TsTestChunks(tc TsTestCase) []*Chunk {
+	var cs []*Chunk
+	var vi, ai int
+	for {
+		vts, ats := uint32(vi*1000/30), uint32(ai*23)
+		if (tc.Video == 0 || vts >= 3000) && (tc.Audio == 0 || ats >= 3000) {
+			return cs
+		}
+		if tc.Video != 0 && vts < 3000 && (tc.Audio == 0 || vts <= ats) {
+			key := vi%30 == 0
+			size := 3000
+			if key && vi == 30 && tc.BigFrame > 0 {
+				size = tc.BigFrame
+			}
+			cs = append(cs, TsTestVideoChunk(tc.Video, vts, key, size))
+			vi++
+			continue
+		}
+		d := append([]byte{0xaf, 0x01}, make([]byte, 300)...)
+		dt := "AudioAacFrame"
+		if tc.Audio != 10 {
+			d, dt = append([]byte{tc.Audio<<4 | 0x2}, make([]byte, 300)...), "AudioFrame"
+		}
+		cs = append(cs, &Chunk{Timestamp: ats, MsgTypeId: MsgTypeIdAudio, DataType: dt,
+			MsgLength: uint32(len(d)), MsgData: d})
+		ai++
+	}
+}
+
+// 0x17/0x27 0x01 + cts(0) + 4字节长度 + nalu, hevc是0x1c/0x2c
+func TsTestVideoChunk(codecId uint8, ts uint32, key bool, size int) *Chunk {
+	d := []byte{0x20 | codecId, 0x01, 0x00, 0x00, 0x00}
+	nalu := make([]byte, size)
+	nalu[0] = 0x41
+	if codecId == 12 {
+		nalu[0], nalu[1] = 0x02, 0x01 // TRAIL_R
+	}
+	dt := "VideoInterFrame"
+	if key {
+		d[0], nalu[0], dt = 0x10|codecId, 0x65, "VideoKeyFrame"
+		if codecId == 12 {
+			nalu[0] = 0x26 // IDR_W_RADL
+		}
+	}
+	d = append(d, Uint32ToByte(uint32(size), nil, BE)...)
+	d = append(d, nalu...)
+	return &Chunk{Timestamp: ts, MsgTypeId: MsgTypeIdVideo, DataType: dt, MsgLength: uint32(len(d)), MsgData: d}
+}
+
+func TsTestMux(t *testing.T, tc TsTestCase) []byte {
+	s := TsTestStream(tc)
+	buf := bytes.NewBuffer(nil)
+	s.TsWriter = buf
+	for _, c := range TsTestChunks(tc) {
+		if c.DataType == "AudioFrame" {
+			TsAudioTypeUpdate(s, c)
+		}
+		if err := TsFileAppend(s, c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TsTestParse(t *testing.T, d []byte) []TsTestPacket {
+	if len(d)%188 != 0 {
+		t.Fatalf("ts length %d isn't multiple of 188", len(d))
+	}
+	var ps []TsTestPacket
+	for i := 0; i < len(d); i += 188 {
+		b := d[i : i+188]
+		if b[0] != 0x47 {
+			t.Fatalf("packet %d sync byte is 0x%x", i/188, b[0])
+		}
+		p := TsTestPacket{Pid: uint16(b[1]&0x1f)<<8 | uint16(b[2]), Pusi: b[1]&0x40 != 0, Cc: b[3] & 0xf, Pcr: -1}
+		afc := (b[3] >> 4) & 0x3
+		n := 4
+		if afc&0x2 != 0 {
+			afLen := int(b[4])
+			if afLen > 0 {
+				p.Rai = b[5]&0x40 != 0
+				if b[5]&0x10 != 0 {
+					p.Pcr = int64(b[6])<<25 | int64(b[7])<<17 | int64(b[8])<<9 | int64(b[9])<<1 | int64(b[10]>>7)
+				}
+			}
+			n = 5 + afLen
+		}
+		if afc&0x1 != 0 {
+			p.Payload = b[n:]
+		}
+		ps = append(ps, p)
+	}
+	return ps
+}
+
+func TsTestPesList(ps []TsTestPacket) []*TsTestPes {
+	var pl []*TsTestPes
+	cur := make(map[uint16]*TsTestPes)
+	for i, p := range ps {
+		if p.Pid != VideoPid && p.Pid != AudioPid {
+			continue
+		}
+		if p.Pusi {
+			cur[p.Pid] = &TsTestPes{Pid: p.Pid, First: i}
+			pl = append(pl, cur[p.Pid])
+		}
+		if e, ok := cur[p.Pid]; ok {
+			e.Data = append(e.Data, p.Payload...)
+		}
+	}
+	for _, e := range pl {
+		e.Length = int(e.Data[4])<<8 | int(e.Data[5])
+		e.Dts = TsTestTimestamp(e.Data[9:14])
+		if e.Data[7]>>6 == 0x3 {
+			e.Dts = TsTestTimestamp(e.Data[14:19])
+		}
+	}
+	return pl
+}
+
+func TsTestTimestamp(b []byte) int64 {
+	return int64(b[0]>>1&0x7)<<30 | int64(b[1])<<22 | int64(b[2]>>1)<<15 | int64(b[3])<<7 | int64(b[4]>>1)
+}
+
+// MPEG-2 CRC32, 不查表 和Crc32Create()独立, 包括CRC32在内计算 结果为0
+func TsTestCrc32(d []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, b := range d {
+		crc ^= uint32(b) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+func TestTsMuxer(t *testing.T) {
+	for _, tc := range TsTestCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			ps := TsTestParse(t, TsTestMux(t, tc))
+			pl := TsTestPesList(ps)
+			TsTestContinuity(t, ps)
+			TsTestPatPmtBeforeKeyFrame(t, ps, pl, tc)
+			TsTestPcr(t, ps, pl, tc)
+			TsTestPesLength(t, pl, tc)
+			TsTestPmt(t, ps, tc)
+		})
+	}
+}
+
+func TsTestContinuity(t *testing.T, ps []TsTestPacket) {
+	last := make(map[uint16]uint8)
+	for i, p := range ps {
+		if cc, ok := last[p.Pid]; ok && p.Cc != (cc+1)&0xf {
+			t.Errorf("packet %d pid 0x%x cc %d, last is %d", i, p.Pid, p.Cc, cc)
+		}
+		last[p.Pid] = p.Cc
+	}
+}
+
+func TsTestPatPmtBeforeKeyFrame(t *testing.T, ps []TsTestPacket, pl []*TsTestPes, tc TsTestCase) {
+	if ps[0].Pid != PatPid || ps[1].Pid != PmtPid {
+		t.Errorf("ts doesn't start with pat/pmt")
+	}
+	n := 0
+	for _, e := range pl {
+		if e.Pid != VideoPid || !ps[e.First].Rai {
+			continue
+		}
+		n++
+		if e.First < 2 || ps[e.First-2].Pid != PatPid || ps[e.First-1].Pid != PmtPid {
+			t.Errorf("keyframe at packet %d has no pat/pmt before it", e.First)
+		}
+	}
+	if tc.Video != 0 && n != 3 {
+		t.Errorf("keyframe num is %d, want 3", n)
+	}
+}
+
+func TsTestPcr(t *testing.T, ps []TsTestPacket, pl []*TsTestPes, tc TsTestCase) {
+	var last int64 = -1
+	n := 0
+	for _, e := range pl {
+		pcr := ps[e.First].Pcr
+		if pcr < 0 {
+			continue
+		}
+		n++
+		if e.Pid != tc.PcrPid {
+			t.Errorf("pcr in pid 0x%x, want 0x%x", e.Pid, tc.PcrPid)
+		}
+		if pcr > e.Dts {
+			t.Errorf("pcr %d > dts %d", pcr, e.Dts)
+		}
+		if last >= 0 && pcr-last > 100*H264ClockFrequency {
+			t.Errorf("pcr interval %dms > 100ms", (pcr-last)/H264ClockFrequency)
+		}
+		last = pcr
+	}
+	for _, p := range ps {
+		if p.Pcr >= 0 && !p.Pusi {
+			t.Errorf("pcr not in first packet of pes")
+		}
+	}
+	if n == 0 {
+		t.Errorf("no pcr")
+	}
+}
+
+func TsTestPesLength(t *testing.T, pl []*TsTestPes, tc TsTestCase) {
+	big := 0
+	for _, e := range pl {
+		size := len(e.Data) - 6
+		switch {
+		case size > 0xffff:
+			big++
+			if e.Pid != VideoPid || e.Length != 0 {
+				t.Errorf("pid 0x%x pes size %d, PES_packet_length %d, want 0", e.Pid, size, e.Length)
+			}
+		case e.Length != size:
+			t.Errorf("pid 0x%x pes size %d, PES_packet_length %d", e.Pid, size, e.Length)
+		}
+	}
+	if tc.BigFrame > 0xffff && big != 1 {
+		t.Errorf("large pes num is %d, want 1", big)
+	}
+}
+
+func TsTestPmt(t *testing.T, ps []TsTestPacket, tc TsTestCase) {
+	var last [][2]int
+	ver := -1
+	for i, p := range ps {
+		if p.Pid == VideoPid || p.Pid == AudioPid {
+			if !TsTestHasPid(last, p.Pid) {
+				t.Fatalf("packet %d pid 0x%x isn't in pmt %v", i, p.Pid, last)
+			}
+			continue
+		}
+		if p.Pid != PatPid && p.Pid != PmtPid {
+			continue
+		}
+		// pointer_field 之后是section
+		sec := p.Payload[1+int(p.Payload[0]):]
+		secLen := int(sec[1]&0xf)<<8 | int(sec[2])
+		sec = sec[:3+secLen]
+		if TsTestCrc32(sec) != 0 {
+			t.Errorf("packet %d pid 0x%x CRC32 is wrong", i, p.Pid)
+		}
+		if p.Pid == PatPid {
+			if pid := uint16(sec[10]&0x1f)<<8 | uint16(sec[11]); pid != PmtPid {
+				t.Errorf("pat pmt pid is 0x%x", pid)
+			}
+			continue
+		}
+
+		if sec[0] != 0x02 {
+			t.Errorf("pmt table_id is 0x%x", sec[0])
+		}
+		if pid := uint16(sec[8]&0x1f)<<8 | uint16(sec[9]); pid != tc.PcrPid {
+			t.Errorf("pmt PCR_PID is 0x%x, want 0x%x", pid, tc.PcrPid)
+		}
+		piLen := int(sec[10]&0xf)<<8 | int(sec[11])
+		var streams [][2]int
+		for d := sec[12+piLen : len(sec)-4]; len(d) >= 5; {
+			esLen := int(d[3]&0xf)<<8 | int(d[4])
+			streams = append(streams, [2]int{int(d[0]), int(d[1]&0x1f)<<8 | int(d[2])})
+			d = d[5+esLen:]
+		}
+		v := int(sec[5]>>1) & 0x1f
+		if last != nil && fmt.Sprint(streams) != fmt.Sprint(last) && v == ver {
+			t.Errorf("pmt streams %v -> %v, version_number is still %d", last, streams, v)
+		}
+		last, ver = streams, v
+	}
+	if fmt.Sprint(last) != fmt.Sprint(tc.Streams) {
+		t.Errorf("pmt streams %v, want %v", last, tc.Streams)
+	}
+}
+
+func TsTestHasPid(streams [][2]int, pid uint16) bool {
+	for _, st := range streams {
+		if st[1] == int(pid) {
+			return true
+		}
+	}
+	return false
+}
+
+// fmp4里的hevc 要用hvc1 + hvcC, safari才能播放
+func TestMp4Hevc(t *testing.T) {
+	// 编码器的hvcC 不一定设置array_completeness
+	arrays := []int{23, 23 + 5 + 24, 23 + 5 + 24 + 5 + 41}
+	hd := append([]byte(nil), TsTestHevcHeader...)
+	for _, i := range arrays {
+		hd[5+i] &= 0x7f
+	}
+	vh := &Chunk{MsgTypeId: MsgTypeIdVideo, DataType: "VideoHeader", MsgData: hd}
+	m, err := Mp4MuxerNew(vh, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := m.Video
+	if v.Codec != "hvc1.1.6.L93.90" || v.Width != 1280 || v.Height != 720 {
+		t.Fatalf("codec %s %dx%d, want hvc1.1.6.L93.90 1280x720", v.Codec, v.Width, v.Height)
+	}
+	for _, i := range arrays {
+		if v.Config[i]&0x80 == 0 {
+			t.Errorf("hvcC array at %d has no array_completeness", i)
+		}
+		if hd[5+i]&0x80 != 0 {
+			t.Errorf("VideoHeader is modified")
+		}
+	}
+
+	stsd := Mp4StsdCreate(v)
+	var p Mp4Track
+	err = Mp4BoxRange(stsd[16:], func(typ string, d []byte) error {
+		if typ != "hvc1" {
+			t.Errorf("sample entry is %s, want hvc1", typ)
+		}
+		return Mp4SampleEntryParse(&p, typ, d)
+	})
+	if err != nil || p.Codec != v.Codec || p.Width != 1280 || p.Height != 720 {
+		t.Errorf("parsed sample entry %s %dx%d, %v", p.Codec, p.Width, p.Height, err)
+	}
+
+	// 关键帧前的vps/sps/pps 要去掉
+	vps := TsTestHevcHeader[5+23+5 : 5+23+5+24]
+	d := append(Uint32ToByte(uint32(len(vps)), nil, BE), vps...)
+	d = append(d, 0x00, 0x00, 0x00, 0x03, 0x26, 0x01, 0xaf)
+	c := &Chunk{MsgTypeId: MsgTypeIdVideo, DataType: "VideoKeyFrame",
+		MsgData: append([]byte{0x1c, 0x01, 0x00, 0x00, 0x00}, d...)}
+	Mp4SampleAdd(m, c, 0)
+	if sp := v.Samples[0]; !bytes.Equal(sp.Data, d[4+24:]) || sp.Size != 7 {
+		t.Errorf("sample is % x, want % x", sp.Data, d[4+24:])
+	}
+}
+
+// 一个sei, 里面是cc_data, 每2个字节是一对608数据(field1)
+func VttTestChunk(dts uint32, cts uint32, key bool, pairs ...byte) *Chunk {
+	n := len(pairs) / 2
+	p := []byte{0xb5, 0x00, 0x31, 'G', 'A', '9', '4', 0x03, 0x40 | byte(n), 0xff}
+	for i := 0; i < n; i++ {
+		p = append(p, 0xfc, pairs[2*i], pairs[2*i+1])
+	}
+	sei := append([]byte{0x06, 0x04, byte(len(p))}, p...)
+	sei = append(sei, 0x80)
+	d := []byte{0x27, 0x01}
+	dt := "VideoInterFrame"
+	if key {
+		d[0], dt = 0x17, "VideoKeyFrame"
+	}
+	d = append(d, Uint24ToByte(cts, nil, BE)...)
+	d = append(d, Uint32ToByte(uint32(len(sei)), nil, BE)...)
+	d = append(d, sei...)
+	return &Chunk{Timestamp: dts, MsgTypeId: MsgTypeIdVideo, DataType: dt, MsgLength: uint32(len(d)), MsgData: d}
+}
+
+// 有B帧时 cc_data要按pts的顺序解码
+// pts顺序是 RCL, "HI", EOC; dts顺序是 RCL, EOC, "HI"
+func TestVttPtsOrder(t *testing.T) {
+	old := conf.HlsCaption
+	defer func() { conf.HlsCaption = old }()
+	conf.HlsCaption = HlsCaption{Enable: true, WebVtt: true}
+
+	s := &Stream{}
+	s.logHls = log.New(ioutil.Discard, "", 0)
+	cs := []*Chunk{
+		VttTestChunk(0, 40, true, 0x14, 0x20),   // pts 40
+		VttTestChunk(40, 80, false, 0x14, 0x2f), // pts 120
+		VttTestChunk(80, 0, false, 'H', 'I'),    // pts 80
+		VttTestChunk(120, 40, true, 0x14, 0x2c), // pts 160
+		VttTestChunk(240, 40, true, 0x00, 0x00), // pts 280
+	}
+	for _, c := range cs {
+		HlsVttFrame(s, c)
+	}
+	if len(s.VttCues) != 1 {
+		t.Fatalf("cues %+v, want 1", s.VttCues)
+	}
+	if cue := s.VttCues[0]; cue != (VttCue{120, 160, "HI"}) {
+		t.Errorf("cue %+v, want {120 160 HI}", cue)
+	}
+}
+
+// 音视频头变了 开始新的Period, 之前的切片都淘汰后 删除之前的Period和init.mp4
+func TestDashPeriod(t *testing.T) {
+	old := conf
+	defer func() { conf = old }()
+	conf.HlsStore, conf.HlsSavePath, conf.HlsTsMaxTime, conf.HlsM3u8TsNum = "memory", "/dash/", 1, 2
+
+	s := &Stream{Key: "live_test"}
+	s.logDash = log.New(ioutil.Discard, "", 0)
+	s.MpdPath = "/dash/live_test/live_test.mpd"
+	s.DashSegList = list.New()
+	s.DashPlType = "live"
+	mpd := func() string {
+		d, err := HlsFileRead(s.MpdPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(d)
+	}
+
+	s.DashVideoHeader = &Chunk{MsgTypeId: MsgTypeIdVideo, DataType: "VideoHeader", MsgData: TsTestVideoHeader}
+	for ts := uint32(0); ts < 3000; ts += 500 {
+		DashCreate(s, TsTestVideoChunk(7, ts, ts%1000 == 0, 100))
+	}
+	hc := &Chunk{MsgTypeId: MsgTypeIdVideo, DataType: "VideoHeader", MsgData: TsTestHevcHeader}
+	DashHeaderCheck(s, s.DashVideoHeader, hc)
+	s.DashVideoHeader = hc
+	DashCreate(s, TsTestVideoChunk(12, 3000, true, 100))
+	DashCreate(s, TsTestVideoChunk(12, 4000, true, 100))
+
+	m := mpd()
+	if !strings.Contains(m, `<Period id="0" start="PT0.000S">`) || !strings.Contains(m, `<Period id="1" start="PT3.000S">`) {
+		t.Fatalf("mpd should have 2 periods\n%s", m)
+	}
+	if !strings.Contains(m, `codecs="hvc1.1.6.L93.90"`) || !strings.Contains(m, "live_test_video_1_init.mp4") {
+		t.Errorf("period 1 should use hvc1 and new init.mp4\n%s", m)
+	}
+
+	DashCreate(s, TsTestVideoChunk(12, 5000, true, 100))
+	DashCreate(s, TsTestVideoChunk(12, 6000, true, 100))
+	m = mpd()
+	if strings.Contains(m, `<Period id="0"`) || HlsFileExist("/dash/live_test/live_test_video_0_init.mp4") {
+		t.Errorf("period 0 should be removed\n%s", m)
+	}
+	if !HlsFileExist("/dash/live_test/live_test_video_1_init.mp4") {
+		t.Errorf("period 1 init.mp4 is removed")
+	}
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**********************************************************/
+/* hls archive
+/**********************************************************/
+// 按app配置 把完成的切片另存一份到HlsArchive.SavePath, 和直播的TsList无关
+// HlsArchive.SavePath/live/yuankang/yuankang_1649125230123.ts  切片, 数字是切片开始时间(毫秒)
+// HlsArchive.SavePath/live/yuankang/yuankang_1649125230123.key 加密时 key换了才存
+// HlsArchive.SavePath/live/yuankang/yuankang_1649125230123_init.mp4 fmp4时 每次发布存一个
+// HlsArchive.SavePath/live/yuankang/index.idx 索引, 每行一个切片 json格式
+// 回看地址 http://127.0.0.1/live/yuankang.m3u8?start=20220405102030&end=20220405112030
+// start和end 可以是 20060102150405格式的本地时间 或 unix时间戳(秒), end为空时是现在
+// 返回VOD m3u8, 有 #EXT-X-ENDLIST, 切片地址是 /archive/live/yuankang/yuankang_1649125230123.ts
+// 切片不连续时(发布者重新推流) 加 #EXT-X-DISCONTINUITY
+type HlsArchiveInfo struct {
+	HlsArcFolder string // 归档目录, 为空时不归档
+	HlsArcMap    string // fmp4时 本次发布的init.mp4 归档文件名
+	HlsArcKeySrc string // 加密时 最后归档的key 原来的路径
+	HlsArcKeyUri string // 加密时 最后归档的key 的http地址
+}
+
+// 索引里的一个切片
+type HlsArchiveSeg struct {
+	Start    int64   // 切片开始时间, unix毫秒
+	Duration float64 // 切片时长, 单位为秒
+	File     string  // 切片文件名
+	Map      string  // fmp4时 init.mp4文件名
+	Key      string  // 加密时 #EXT-X-KEY
+}
+
+const HlsArchiveIndex = "index.idx"
+
+// 写索引 和 清理时改写索引 要互斥
+var HlsArchiveLock sync.Mutex
+
+func HlsArchiveRuleGet(app string) (HlsArchiveRule, bool) {
+	rs := conf.HlsArchive.Rules
+	if !conf.HlsArchive.Enable {
+		return HlsArchiveRule{}, false
+	}
+	i := AppRuleFind(len(rs), app, func(i int) string { return rs[i].App })
+	if i < 0 {
+		return HlsArchiveRule{}, false
+	}
+	return rs[i], true
+}
+
+func HlsArchiveInit(s *Stream) {
+	if _, ok := HlsArchiveRuleGet(s.AmfInfo.App); !ok {
+		return
+	}
+	folder := fmt.Sprintf("%s%s/%s", conf.HlsArchive.SavePath, s.AmfInfo.App, s.AmfInfo.StreamName)
+	if err := os.MkdirAll(folder, 0755); err != nil {
+		s.logHls.Println(err)
+		return
+	}
+	s.HlsArcFolder = folder
+	s.logHls.Println("hls archive folder is", folder)
+}
+
+// 切片完成时调用, 切片和需要的key/init.mp4 复制到归档目录, 再写索引
+func HlsArchiveAppend(s *Stream, ti TsInfo) {
+	if s.HlsArcFolder == "" {
+		return
+	}
+	start := s.TsDateTime.UnixNano() / 1e6
+	name := fmt.Sprintf("%s_%d", s.AmfInfo.StreamName, start)
+	seg := HlsArchiveSeg{start, ti.TsExtInfo, name + path.Ext(ti.TsFilepath), "", ""}
+
+	if err := HlsArchiveCopy(ti.TsFilepath, s.HlsArcFolder, seg.File); err != nil {
+		s.logHls.Println(err)
+		return
+	}
+	if s.HlsInitPath != "" && s.HlsArcMap == "" {
+		if err := HlsArchiveCopy(s.HlsInitPath, s.HlsArcFolder, name+"_init.mp4"); err != nil {
+			s.logHls.Println(err)
+			return
+		}
+		s.HlsArcMap = name + "_init.mp4"
+	}
+	seg.Map = s.HlsArcMap
+	if ti.KeyPath != "" && ti.KeyPath != s.HlsArcKeySrc {
+		if err := HlsArchiveCopy(ti.KeyPath, s.HlsArcFolder, name+".key"); err != nil {
+			s.logHls.Println(err)
+			return
+		}
+		s.HlsArcKeySrc = ti.KeyPath
+		s.HlsArcKeyUri = HlsArchiveUri(s.AmfInfo.App, s.AmfInfo.StreamName, name+".key")
+	}
+	if ti.KeyPath != "" {
+		seg.Key = HlsArchiveKeyCreate(ti, s.HlsArcKeyUri)
+	}
+
+	d, err := json.Marshal(seg)
+	if err != nil {
+		s.logHls.Println(err)
+		return
+	}
+	HlsArchiveLock.Lock()
+	defer HlsArchiveLock.Unlock()
+	fn := filepath.Join(s.HlsArcFolder, HlsArchiveIndex)
+	f, err := os.OpenFile(fn, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		s.logHls.Println(err)
+		return
+	}
+	defer f.Close()
+	if _, err = f.Write(append(d, '\n')); err != nil {
+		s.logHls.Printf("Write %s fail, %s", fn, err)
+	}
+}
+
+// 每个切片的IV不同, 从切片的标签里取出 #EXT-X-KEY, 换成归档key的地址
+func HlsArchiveKeyCreate(ti TsInfo, uri string) string {
+	for _, l := range strings.Split(ti.TagStr, "\n") {
+		if strings.HasPrefix(l, "#EXT-X-KEY:") {
+			return strings.Replace(l, fmt.Sprintf("URI=\"%s\"", path.Base(ti.KeyPath)),
+				fmt.Sprintf("URI=\"%s\"", uri), 1)
+		}
+	}
+	return ""
+}
+
+// 源文件可能只在内存里, 所以用HlsFileRead读取
+func HlsArchiveCopy(src, folder, name string) error {
+	d, err := HlsFileRead(src)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(folder, name), d, 0644)
+}
+
+func HlsArchiveUri(app, stream, name string) string {
+	return fmt.Sprintf("/archive/%s/%s/%s", app, stream, name)
+}
+
+// 索引文件不存在时 返回空
+func HlsArchiveIndexRead(folder string) ([]HlsArchiveSeg, error) {
+	f, err := os.Open(filepath.Join(folder, HlsArchiveIndex))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var segs []HlsArchiveSeg
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var seg HlsArchiveSeg
+		if err = json.Unmarshal(sc.Bytes(), &seg); err != nil {
+			continue // 写了一半的行
+		}
+		segs = append(segs, seg)
+	}
+	return segs, sc.Err()
+}
+
+func HlsArchiveIndexWrite(folder string, segs []HlsArchiveSeg) error {
+	var d []byte
+	for _, seg := range segs {
+		l, err := json.Marshal(seg)
+		if err != nil {
+			return err
+		}
+		d = append(append(d, l...), '\n')
+	}
+	fn := filepath.Join(folder, HlsArchiveIndex)
+	err := ioutil.WriteFile(fn+".tmp", d, 0644)
+	if err == nil {
+		err = os.Rename(fn+".tmp", fn)
+	}
+	return err
+}
+
+/**********************************************************/
+/* vod m3u8
+/**********************************************************/
+// 20220405102030 或 unix时间戳(秒)
+func HlsArchiveTimeParse(v string) (time.Time, error) {
+	if len(v) == 14 {
+		return time.ParseInLocation("20060102150405", v, time.Local)
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("time %s is invalid", v)
+	}
+	return time.Unix(n, 0), nil
+}
+
+// GET /live/yuankang.m3u8?start=20220405102030&end=20220405112030
+func GetM3u8Archive(app, stream string, r *http.Request) ([]byte, error) {
+	if _, ok := HlsArchiveRuleGet(app); !ok {
+		return nil, fmt.Errorf("%s/%s hls archive is disable", app, stream)
+	}
+	q := r.URL.Query()
+	start, err := HlsArchiveTimeParse(q.Get("start"))
+	if err != nil {
+		return nil, err
+	}
+	end := time.Now()
+	if q.Get("end") != "" {
+		if end, err = HlsArchiveTimeParse(q.Get("end")); err != nil {
+			return nil, err
+		}
+	}
+
+	folder := fmt.Sprintf("%s%s/%s", conf.HlsArchive.SavePath, app, stream)
+	HlsArchiveLock.Lock()
+	segs, err := HlsArchiveIndexRead(folder)
+	HlsArchiveLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	// 和[start, end)有重叠的切片
+	s, e := start.UnixNano()/1e6, end.UnixNano()/1e6
+	var sel []HlsArchiveSeg
+	for _, seg := range segs {
+		if seg.Start < e && seg.Start+int64(seg.Duration*1000) > s {
+			sel = append(sel, seg)
+		}
+	}
+	if len(sel) == 0 {
+		return nil, fmt.Errorf("%s/%s no hls archive from %s to %s", app, stream, start, end)
+	}
+	return []byte(M3u8ArchiveCreate(app, stream, sel)), nil
+}
+
+func M3u8ArchiveCreate(app, stream string, segs []HlsArchiveSeg) string {
+	var tsMaxTime float64
+	var tis string
+	ver := 3
+	for i, seg := range segs {
+		if tsMaxTime < seg.Duration {
+			tsMaxTime = seg.Duration
+		}
+		if strings.Contains(seg.Key, "SAMPLE-AES") && ver < 5 {
+			ver = 5
+		}
+		if seg.Map != "" {
+			ver = 6
+		}
+
+		var prev HlsArchiveSeg
+		if i > 0 {
+			prev = segs[i-1]
+			// 前后切片相差超过1秒 认为是不同的发布过程
+			gap := seg.Start - prev.Start - int64(prev.Duration*1000)
+			if seg.Map != prev.Map || gap > 1000 || gap < -1000 {
+				tis += "\n#EXT-X-DISCONTINUITY"
+			}
+		}
+		if seg.Map != "" && (i == 0 || seg.Map != prev.Map) {
+			tis += fmt.Sprintf("\n#EXT-X-MAP:URI=\"%s\"", HlsArchiveUri(app, stream, seg.Map))
+		}
+		if seg.Key != prev.Key {
+			if seg.Key == "" {
+				tis += "\n#EXT-X-KEY:METHOD=NONE"
+			} else {
+				tis += "\n" + seg.Key
+			}
+		}
+		dt := time.Unix(0, seg.Start*1e6).UTC().Format("2006-01-02T15:04:05.000Z")
+		tis += fmt.Sprintf("\n#EXT-X-PROGRAM-DATE-TIME:%s\n", dt)
+		tis += fmt.Sprintf(m3u8Body, seg.Duration, HlsArchiveUri(app, stream, seg.File))
+	}
+
+	m3u8 := fmt.Sprintf(m3u8Head, ver, uint32(math.Ceil(tsMaxTime)), 0)
+	m3u8 += "\n#EXT-X-PLAYLIST-TYPE:VOD"
+	return fmt.Sprintf("%s%s\n#EXT-X-ENDLIST\n", m3u8, tis)
+}
+
+// /archive/live/yuankang/yuankang_1649125230123.ts 返回 app 和 文件路径
+func HlsArchiveFilename(p string) (string, string, bool) {
+	if !conf.HlsArchive.Enable || !strings.HasPrefix(p, "/archive/") {
+		return "", "", false
+	}
+	switch path.Ext(p) {
+	case ".ts", ".m4s", ".mp4", ".key":
+	default:
+		return "", "", false
+	}
+	ss := strings.Split(strings.TrimPrefix(p, "/archive/"), "/")
+	if len(ss) != 3 {
+		return "", "", false
+	}
+	root := filepath.Clean(conf.HlsArchive.SavePath)
+	fn := filepath.Join(root, ss[0], ss[1], ss[2])
+	if !strings.HasPrefix(fn, root+string(filepath.Separator)) {
+		return "", "", false
+	}
+	return ss[0], fn, true
+}
+
+// GET /archive/live/yuankang/yuankang_1649125230123.key?token=xxx
+func GetHlsArchive(w http.ResponseWriter, r *http.Request, app, fn string) {
+	switch path.Ext(fn) {
+	case ".key":
+		rule, ok := HlsEncryptRuleGet(app)
+		if !ok || !HlsKeyTokenCheck(rule, r) {
+			log.Printf("hls key %s forbidden", r.URL.Path)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+	case ".ts":
+		w.Header().Set("Content-Type", "video/mp2t")
+	default:
+		w.Header().Set("Content-Type", "video/mp4")
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Server", AppName)
+	http.ServeFile(w, r, fn)
+}
+
+/**********************************************************/
+/* archive clean
+/**********************************************************/
+// 每分钟清理一次归档切片
+func HlsArchiveCleaner() {
+	log.Println("start hls archive cleaner on", conf.HlsArchive.SavePath)
+	for {
+		HlsArchiveClean()
+		time.Sleep(1 * time.Minute)
+	}
+}
+
+// 删除开始时间超过MaxAge天的切片, key和init.mp4 没有切片用时才删除
+func HlsArchiveClean() {
+	if conf.HlsArchive.MaxAge <= 0 {
+		return
+	}
+	expire := time.Now().AddDate(0, 0, -conf.HlsArchive.MaxAge).UnixNano() / 1e6
+
+	var folders []string
+	filepath.Walk(conf.HlsArchive.SavePath, func(p string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() && fi.Name() == HlsArchiveIndex {
+			folders = append(folders, filepath.Dir(p))
+		}
+		return nil
+	})
+
+	for _, folder := range folders {
+		HlsArchiveLock.Lock()
+		HlsArchiveFolderClean(folder, expire)
+		HlsArchiveLock.Unlock()
+	}
+}
+
+func HlsArchiveFolderClean(folder string, expire int64) {
+	segs, err := HlsArchiveIndexRead(folder)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	i := 0
+	for i < len(segs) && segs[i].Start < expire {
+		i++
+	}
+	if i == 0 {
+		return
+	}
+
+	used := make(map[string]bool)
+	for _, seg := range segs[i:] {
+		used[seg.Map] = true
+		used[HlsArchiveKeyFile(seg.Key)] = true
+	}
+	for _, seg := range segs[:i] {
+		os.Remove(filepath.Join(folder, seg.File))
+		if seg.Map != "" && !used[seg.Map] {
+			os.Remove(filepath.Join(folder, seg.Map))
+		}
+		if k := HlsArchiveKeyFile(seg.Key); k != "" && !used[k] {
+			os.Remove(filepath.Join(folder, k))
+		}
+	}
+	log.Printf("hls archive %s remove %d expired segments", folder, i)
+	if err = HlsArchiveIndexWrite(folder, segs[i:]); err != nil {
+		log.Println(err)
+	}
+}
+
+// #EXT-X-KEY:METHOD=AES-128,URI="/archive/live/yuankang/yuankang_1649125230123.key",IV=0x...
+func HlsArchiveKeyFile(key string) string {
+	i := strings.Index(key, "URI=\"")
+	if i < 0 {
+		return ""
+	}
+	uri := key[i+len("URI=\""):]
+	if j := strings.Index(uri, "\""); j >= 0 {
+		uri = uri[:j]
+	}
+	return path.Base(uri)
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"path"
+	"sort"
+	"strings"
+)
+
+/**********************************************************/
+/* closed captions
+/**********************************************************/
+// https://datatracker.ietf.org/doc/html/rfc8216#section-4.3.4.1
+// 广播信号里的CEA-608/708字幕 在h264的SEI里(ATSC A/53, user_data_registered_itu_t_t35 + "GA94")
+// VideoHandle()检测到字幕SEI后 master m3u8里加 CLOSED-CAPTIONS, SEI本身原样写入ts/m4s
+// WebVtt为true时 CC1(608的field1 channel1)解码为文字, 每个切片生成一个同名的.vtt
+// 字幕m3u8 GET /live/yuankang.m3u8?vtt, 和视频的m3u8 切片序号和时长一样
+// 708(DTVCC) 只透传 不解码
+type HlsCaptionInfo struct {
+	HlsCaptions bool     // 检测到了字幕SEI, 会被http协程读取 要用HlsLock
+	HlsVtt      bool     // 已经生成了字幕m3u8, 会被http协程读取 要用HlsLock
+	VttM3u8Path string   // 字幕m3u8的存储路径 包含文件名
+	Cc          Cea608   // CC1的解码状态
+	VttText     string   // 正在显示的字幕, 为空表示没有显示
+	VttStart    uint32   // 正在显示的字幕 开始的时间戳(pts), 单位为毫秒
+	VttCues     []VttCue // 已经结束 还没写入.vtt的字幕
+	VttFrames   []VttCc  // 当前gop里 还没解码的cc_data, 按dts顺序
+}
+
+// cc_data要按显示顺序(pts)解码, 有B帧时 dts顺序是乱的
+type VttCc struct {
+	Pts uint32 // 单位为毫秒
+	Cc  []byte
+}
+
+type VttCue struct {
+	Start uint32 // 单位为毫秒
+	End   uint32
+	Text  string
+}
+
+/**********************************************************/
+/* sei
+/**********************************************************/
+// rtmp视频数据(AVCC)里 所有SEI中的cc_data, 每3字节一个: cc_valid+cc_type, cc_data_1, cc_data_2
+// 没有字幕时返回nil
+func CcDataGet(md []byte) []byte {
+	var cc []byte
+	d := md
+	for len(d) >= 4 {
+		n := ByteToUint32(d[:4], BE)
+		if n > uint32(len(d)-4) {
+			break
+		}
+		nalu := d[4 : 4+n]
+		d = d[4+n:]
+		if n > 1 && nalu[0]&0x1f == 6 {
+			cc = append(cc, SeiCcData(NaluUnescape(nalu))...)
+		}
+	}
+	return cc
+}
+
+// sei_message: payloadType(0xff累加) + payloadSize(0xff累加) + payload, 最后是rbsp_trailing_bits(0x80)
+// payloadType为4时 是user_data_registered_itu_t_t35:
+// country_code(0xb5) + provider_code(0x0031) + user_identifier("GA94") + user_data_type_code(0x03)
+// + process_em_data_flag(1bit) process_cc_data_flag(1bit) additional_data_flag(1bit) cc_count(5bit) + em_data(8bit) + cc_count*3字节
+func SeiCcData(sei []byte) []byte {
+	var cc []byte
+	i := 1 // 跳过nalu头
+	for i < len(sei) && sei[i] != 0x80 {
+		pt, ps := 0, 0
+		for i < len(sei) && sei[i] == 0xff {
+			pt += 255
+			i++
+		}
+		if i >= len(sei) {
+			break
+		}
+		pt += int(sei[i])
+		i++
+		for i < len(sei) && sei[i] == 0xff {
+			ps += 255
+			i++
+		}
+		if i >= len(sei) {
+			break
+		}
+		ps += int(sei[i])
+		i++
+		if i+ps > len(sei) {
+			break
+		}
+		p := sei[i : i+ps]
+		i += ps
+
+		if pt != 4 || len(p) < 10 || p[0] != 0xb5 || p[1] != 0x00 || p[2] != 0x31 ||
+			string(p[3:7]) != "GA94" || p[7] != 0x03 || p[8]&0x40 == 0 {
+			continue
+		}
+		n := int(p[8]&0x1f) * 3
+		if n > len(p)-10 {
+			n = (len(p) - 10) / 3 * 3
+		}
+		cc = append(cc, p[10:10+n]...)
+	}
+	return cc
+}
+
+// VideoHandle()里调用, 检测到一次就不再检测
+func CaptionDetect(s *Stream, c *Chunk) {
+	if !conf.HlsCaption.Enable || s.HlsCaptions || len(c.MsgData) <= 5 {
+		return
+	}
+	if len(CcDataGet(c.MsgData[5:])) == 0 {
+		return
+	}
+	s.log.Println("closed captions(CEA-608/708) found in SEI")
+	s.HlsLock.Lock()
+	s.HlsCaptions = true
+	s.HlsLock.Unlock()
+}
+
+/**********************************************************/
+/* master
+/**********************************************************/
+// master m3u8里 #EXT-X-STREAM-INF 前面的 #EXT-X-MEDIA
+// uri是视频m3u8的地址 如 yuankang.m3u8, token是 ?token=xxx 或空
+func HlsCaptionMediaCreate(s *Stream, uri, token string) string {
+	s.HlsLock.Lock()
+	defer s.HlsLock.Unlock()
+	var lang string
+	if conf.HlsCaption.Language != "" {
+		lang = fmt.Sprintf(",LANGUAGE=\"%s\"", conf.HlsCaption.Language)
+	}
+	var m string
+	if s.HlsCaptions {
+		m += fmt.Sprintf("#EXT-X-MEDIA:TYPE=CLOSED-CAPTIONS,GROUP-ID=\"cc\",NAME=\"CC1\"%s,INSTREAM-ID=\"CC1\",DEFAULT=YES,AUTOSELECT=YES\n", lang)
+	}
+	if s.HlsVtt {
+		if token != "" {
+			token = "&" + token[1:]
+		}
+		m += fmt.Sprintf("#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID=\"subs\",NAME=\"CC1\"%s,DEFAULT=NO,AUTOSELECT=YES,URI=\"%s?vtt%s\"\n", lang, uri, token)
+	}
+	return m
+}
+
+// #EXT-X-STREAM-INF 的属性, 调用者已经加了HlsLock
+func HlsCaptionAttrCreate(s *Stream) string {
+	var a string
+	if s.HlsCaptions {
+		a += ",CLOSED-CAPTIONS=\"cc\""
+	}
+	if s.HlsVtt {
+		a += ",SUBTITLES=\"subs\""
+	}
+	return a
+}
+
+/**********************************************************/
+/* cea-608
+/**********************************************************/
+// https://en.wikipedia.org/wiki/EIA-608
+// 只处理CC1, 控制码都会重复发送一次, 第二次忽略
+// popon: 在不显示的内存里写, EOC时 和显示的内存交换
+// rollup: 在最下面一行写, CR时 上滚一行, 最多显示Rows行
+// painton: 直接写显示的内存
+// rollup/painton 在CR和EDM时 才认为显示变化了, 避免每个字都生成一条字幕
+type Cea608 struct {
+	Mode     string   // popon, rollup, painton
+	Rows     int      // rollup时 显示的行数
+	Disp     []string // 显示的内存, 每行一个
+	NonDisp  []string // 不显示的内存, popon时用
+	Chan     uint8    // 当前数据属于哪个channel, 1或2
+	LastCtrl uint16   // 上一个控制码
+}
+
+// 0x11 + 0x30-0x3f 的特殊字符
+var Cea608Special = []string{"®", "°", "½", "¿", "™", "¢", "£", "♪", "à", " ", "è", "â", "ê", "î", "ô", "û"}
+
+// 基本字符 大部分和ascii一样
+func Cea608Char(b uint8) string {
+	switch b {
+	case 0x2a:
+		return "á"
+	case 0x5c:
+		return "é"
+	case 0x5e:
+		return "í"
+	case 0x5f:
+		return "ó"
+	case 0x60:
+		return "ú"
+	case 0x7b:
+		return "ç"
+	case 0x7c:
+		return "÷"
+	case 0x7d:
+		return "Ñ"
+	case 0x7e:
+		return "ñ"
+	case 0x7f:
+		return "█"
+	}
+	return string(rune(b))
+}
+
+// 写入的内存, popon时是NonDisp, 其他是Disp
+func Cea608Mem(d *Cea608) *[]string {
+	if d.Mode == "popon" {
+		return &d.NonDisp
+	}
+	return &d.Disp
+}
+
+func Cea608Write(d *Cea608, str string) {
+	m := Cea608Mem(d)
+	if len(*m) == 0 {
+		*m = append(*m, "")
+	}
+	(*m)[len(*m)-1] += str
+}
+
+// 新的一行, 当前行是空的时候 不用换行
+func Cea608NewRow(d *Cea608) {
+	m := Cea608Mem(d)
+	if len(*m) == 0 || (*m)[len(*m)-1] != "" {
+		*m = append(*m, "")
+	}
+}
+
+func Cea608Text(d *Cea608) string {
+	var rows []string
+	for _, r := range d.Disp {
+		if r = strings.TrimSpace(r); r != "" {
+			rows = append(rows, r)
+		}
+	}
+	return strings.Join(rows, "\n")
+}
+
+// b1 b2 已经去掉奇偶校验位, 显示的内容变化时返回true
+func Cea608Decode(d *Cea608, b1, b2 uint8) bool {
+	if b1 == 0 && b2 == 0 { // 填充
+		return false
+	}
+	if b1 < 0x10 { // XDS 不处理
+		d.LastCtrl = 0
+		return false
+	}
+	if b1 >= 0x20 { // 可显示字符
+		d.LastCtrl = 0
+		if d.Chan != 1 {
+			return false
+		}
+		Cea608Write(d, Cea608Char(b1))
+		if b2 >= 0x20 {
+			Cea608Write(d, Cea608Char(b2))
+		}
+		return false
+	}
+
+	ctrl := uint16(b1)<<8 | uint16(b2)
+	if ctrl == d.LastCtrl {
+		d.LastCtrl = 0
+		return false
+	}
+	d.LastCtrl = ctrl
+	d.Chan = 1
+	if b1 >= 0x18 {
+		d.Chan = 2
+		return false
+	}
+
+	switch {
+	case b1 == 0x14 && b2 >= 0x20 && b2 <= 0x2f:
+		return Cea608Command(d, b2)
+	case b1 == 0x11 && b2 >= 0x30 && b2 <= 0x3f:
+		Cea608Write(d, Cea608Special[b2-0x30])
+	case b1 == 0x11 && b2 >= 0x20 && b2 <= 0x2f: // mid-row, 占一个空格
+		Cea608Write(d, " ")
+	case b2 >= 0x40 && b2 <= 0x7f: // PAC, 换到某一行
+		if d.Mode != "rollup" {
+			Cea608NewRow(d)
+		}
+	}
+	// 0x12/0x13 扩展字符 前面已经发了一个替代字符, 不处理就保留替代字符
+	// 0x17 tab 不处理
+	return false
+}
+
+func Cea608Command(d *Cea608, b2 uint8) bool {
+	switch b2 {
+	case 0x20: // RCL, resume caption loading
+		d.Mode = "popon"
+	case 0x21: // BS, backspace
+		m := Cea608Mem(d)
+		if n := len(*m); n > 0 {
+			r := []rune((*m)[n-1])
+			if len(r) > 0 {
+				(*m)[n-1] = string(r[:len(r)-1])
+			}
+		}
+	case 0x25, 0x26, 0x27: // RU2 RU3 RU4, roll-up
+		if d.Mode != "rollup" {
+			d.Disp = nil
+		}
+		d.Mode = "rollup"
+		d.Rows = int(b2 - 0x23)
+	case 0x29: // RDC, resume direct captioning
+		d.Mode = "painton"
+	case 0x2c: // EDM, erase displayed memory
+		d.Disp = nil
+		return true
+	case 0x2d: // CR, carriage return
+		if d.Mode == "popon" {
+			return false
+		}
+		Cea608NewRow(d)
+		if d.Mode == "rollup" && len(d.Disp) > d.Rows {
+			d.Disp = d.Disp[len(d.Disp)-d.Rows:]
+		}
+		return true
+	case 0x2e: // ENM, erase non-displayed memory
+		d.NonDisp = nil
+	case 0x2f: // EOC, end of caption
+		d.Disp, d.NonDisp = d.NonDisp, nil
+		d.Mode = "popon"
+		return true
+	}
+	return false
+}
+
+/**********************************************************/
+/* webvtt
+/**********************************************************/
+// HlsCreator()里 每个视频帧调用, 时间用pts, 只处理h264的SEI
+// cc_data先缓存, 关键帧到达时 把前一个gop的按pts排序后解码
+// 关键帧在切片之前调用, 所以切片的.vtt里 有这个切片所有帧的字幕
+func HlsVttFrame(s *Stream, c *Chunk) {
+	if !conf.HlsCaption.Enable || !conf.HlsCaption.WebVtt || len(c.MsgData) <= 5 || c.MsgData[0]&0xf != 7 {
+		return
+	}
+	if c.DataType == "VideoKeyFrame" {
+		HlsVttFlush(s)
+	}
+	cc := CcDataGet(c.MsgData[5:])
+	if len(cc) == 0 {
+		return
+	}
+	pts := c.Timestamp
+	if cts := ByteToInt24(c.MsgData[2:5], BE); cts > 0 {
+		pts += uint32(cts)
+	}
+	s.VttFrames = append(s.VttFrames, VttCc{pts, cc})
+}
+
+func HlsVttFlush(s *Stream) {
+	sort.SliceStable(s.VttFrames, func(i, j int) bool {
+		return s.VttFrames[i].Pts < s.VttFrames[j].Pts
+	})
+	for _, f := range s.VttFrames {
+		cc := f.Cc
+		for i := 0; i+3 <= len(cc); i += 3 {
+			// cc_valid为1 并且 cc_type为0(field1) 才是CC1/CC2的数据
+			if cc[i]&0x4 == 0 || cc[i]&0x3 != 0 {
+				continue
+			}
+			if Cea608Decode(&s.Cc, cc[i+1]&0x7f, cc[i+2]&0x7f) {
+				HlsVttCueUpdate(s, Cea608Text(&s.Cc), f.Pts)
+			}
+		}
+	}
+	s.VttFrames = s.VttFrames[:0]
+}
+
+// 显示的字幕变了, 之前显示的 生成一条字幕
+func HlsVttCueUpdate(s *Stream, text string, ts uint32) {
+	if text == s.VttText {
+		return
+	}
+	if s.VttText != "" && ts > s.VttStart {
+		s.VttCues = append(s.VttCues, VttCue{s.VttStart, ts, s.VttText})
+	}
+	s.VttText, s.VttStart = text, ts
+	s.logHls.Printf("vtt text %q at %d", text, ts)
+}
+
+func HlsVttInit(s *Stream) {
+	if !conf.HlsCaption.Enable || !conf.HlsCaption.WebVtt {
+		return
+	}
+	s.VttM3u8Path = strings.TrimSuffix(s.M3u8Path, ".m3u8") + "_vtt.m3u8"
+}
+
+// 切片的.vtt, 和切片同名
+func HlsVttPath(fn string) string {
+	return strings.TrimSuffix(fn, path.Ext(fn)) + ".vtt"
+}
+
+func HlsVttRemove(s *Stream, ti TsInfo) {
+	if s.VttM3u8Path != "" {
+		HlsFileRemove(HlsVttPath(ti.TsFilepath))
+	}
+}
+
+// 00:01:02.345
+func VttTime(ms uint32) string {
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+func VttEscape(t string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(t)
+}
+
+// M3u8Update()里调用, 切片时间为 s.TsFirstTs 到 end
+// 字幕时间 是相对于rtmp时间戳0的, 用X-TIMESTAMP-MAP 对应到ts的pts(有TsDtsOffset) 或 m4s的时间
+// 跨切片的字幕 在切片结束处分开, 后一半写到下一个切片
+func HlsVttSegWrite(s *Stream, fn string, end uint32) {
+	if s.VttM3u8Path == "" {
+		return
+	}
+	var offset uint64
+	if !HlsIsFmp4() {
+		offset = TsTimestamp(TsDtsOffset)
+	}
+	vtt := fmt.Sprintf("WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:%d,LOCAL:00:00:00.000\n", offset)
+
+	var remain []VttCue
+	for _, cue := range s.VttCues {
+		if cue.Start >= end {
+			remain = append(remain, cue)
+			continue
+		}
+		vtt += fmt.Sprintf("\n%s --> %s\n%s\n", VttTime(cue.Start), VttTime(cue.End), VttEscape(cue.Text))
+	}
+	s.VttCues = remain
+	if s.VttText != "" && s.VttStart < end {
+		vtt += fmt.Sprintf("\n%s --> %s\n%s\n", VttTime(s.VttStart), VttTime(end), VttEscape(s.VttText))
+		s.VttStart = end
+	}
+
+	if err := HlsFileWrite(HlsVttPath(fn), []byte(vtt)); err != nil {
+		s.logHls.Println(err)
+	}
+}
+
+// 和视频m3u8一样的切片, 只是换成.vtt, end为 "\n#EXT-X-ENDLIST\n" 或空
+func HlsVttM3u8Write(s *Stream, end string) {
+	if s.VttM3u8Path == "" {
+		return
+	}
+	var tsMaxTime float64
+	var tis string
+	for e := s.TsList.Front(); e != nil; e = e.Next() {
+		ti := (e.Value).(TsInfo)
+		if tsMaxTime < ti.TsExtInfo {
+			tsMaxTime = ti.TsExtInfo
+		}
+		if ti.Disc {
+			tis += "\n#EXT-X-DISCONTINUITY"
+		}
+		tis += fmt.Sprintf("\n"+m3u8Body, ti.TsExtInfo, path.Base(HlsVttPath(ti.TsFilepath)))
+	}
+
+	m3u8 := fmt.Sprintf(m3u8Head, 3, uint32(math.Ceil(tsMaxTime)), s.TsFirstSeq)
+	m3u8 += HlsDiscSeqCreate(s)
+	m3u8 += HlsPlaylistTypeCreate(s)
+	if err := HlsFileWrite(s.VttM3u8Path, []byte(m3u8+tis+end)); err != nil {
+		s.logHls.Printf("Write %s fail, %s", s.VttM3u8Path, err)
+		return
+	}
+
+	s.HlsLock.Lock()
+	if s.HlsCaptions && !s.HlsVtt {
+		s.HlsVtt = true
+		s.logHls.Println("webvtt subtitles is available")
+	}
+	s.HlsLock.Unlock()
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+)
+
+/**********************************************************/
+/* hls encrypt
+/**********************************************************/
+// https://datatracker.ietf.org/doc/html/rfc8216#section-4.3.2.4
+// https://developer.apple.com/library/archive/documentation/AudioVideo/Conceptual/HLS_Sample_Encryption/
+// 按app配置加密规则, 每KeyRotate个切片换一次key
+// AES-128    整个切片用AES-128-CBC加密, PKCS7填充
+// SAMPLE-AES 只加密h264的1/5类型nalu 和 aac帧的部分数据, ts头和pes头不加密
+// 每个切片前都有 #EXT-X-KEY, IV是切片的序号
+// key文件名为 live_yuankang_8.key, 8是开始使用这个key的切片序号
+// GET /live/live_yuankang_8.key?token=xxx, KeyToken不为空时 token必须相同
+// 请求m3u8时带了token, m3u8里key的URI 也会带上这个token
+// ll-hls的part不能用AES-128, 改用SAMPLE-AES; fmp4的SAMPLE-AES需要cbcs, 不支持 改用AES-128
+type HlsEncryptInfo struct {
+	HlsEncMethod string        // AES-128 / SAMPLE-AES, 为空表示不加密
+	HlsEncRotate uint32        // 每HlsEncRotate个切片换一次key, 0表示不换
+	HlsKey       []byte        // 当前的key, 16字节
+	HlsKeyPath   string        // 当前key的存储路径 包含文件名
+	HlsKeySeq    uint32        // 开始使用当前key的切片序号
+	HlsIv        []byte        // 当前切片的IV, 16字节
+	HlsKeyStr    string        // m3u8里当前切片的 #EXT-X-KEY
+	HlsAesWriter *AesCbcWriter // AES-128时 切片数据先写到这里
+}
+
+const (
+	AesBlockSize       = 16
+	SampleAesLeader    = 32 // 视频nalu开头32字节不加密, 包括1字节的nalu头
+	SampleAesMinNalu   = 48 // 视频nalu小于等于48字节 不加密
+	SampleAesClearSize = 144
+	SampleAesAudioLead = 16 // 音频帧开头16字节不加密
+)
+
+func HlsEncryptRuleGet(app string) (HlsEncryptRule, bool) {
+	rs := conf.HlsEncrypt.Rules
+	if !conf.HlsEncrypt.Enable {
+		return HlsEncryptRule{}, false
+	}
+	i := AppRuleFind(len(rs), app, func(i int) string { return rs[i].App })
+	if i < 0 {
+		return HlsEncryptRule{}, false
+	}
+	return rs[i], true
+}
+
+// HlsCreator()开始时调用, 返回error时 不能生成hls
+func HlsEncryptInit(s *Stream) error {
+	rule, ok := HlsEncryptRuleGet(s.AmfInfo.App)
+	if !ok {
+		return nil
+	}
+	method := rule.Method
+	if method != "AES-128" && method != "SAMPLE-AES" {
+		return fmt.Errorf("hls encrypt method %s isn't support", method)
+	}
+	if method == "SAMPLE-AES" && HlsIsFmp4() {
+		s.logHls.Println("fmp4 SAMPLE-AES isn't support, use AES-128")
+		method = "AES-128"
+	}
+	if method == "AES-128" && conf.HlsPartTime > 0 {
+		if HlsIsFmp4() {
+			return fmt.Errorf("ll-hls fmp4 can't be encrypted")
+		}
+		s.logHls.Println("ll-hls part can't use AES-128, use SAMPLE-AES")
+		method = "SAMPLE-AES"
+	}
+	s.HlsEncMethod = method
+	s.HlsEncRotate = rule.KeyRotate
+	s.logHls.Printf("hls encrypt method %s, key rotate %d", method, rule.KeyRotate)
+	return nil
+}
+
+// 新切片开始时调用, 需要时换key, 并用新的key和IV 包装TsWriter
+func HlsEncryptSegStart(s *Stream) error {
+	if s.HlsEncMethod == "" {
+		return nil
+	}
+	seq := s.TsLastSeq
+	if s.HlsKey == nil || (s.HlsEncRotate > 0 && seq-s.HlsKeySeq >= s.HlsEncRotate) {
+		if err := HlsKeyCreate(s, seq); err != nil {
+			return err
+		}
+	}
+
+	s.HlsIv = make([]byte, AesBlockSize)
+	Uint32ToByte(seq, s.HlsIv[12:], BE)
+	s.HlsKeyStr = fmt.Sprintf("\n#EXT-X-KEY:METHOD=%s,URI=\"%s\",IV=0x%x",
+		s.HlsEncMethod, path.Base(s.HlsKeyPath), s.HlsIv)
+
+	if s.HlsEncMethod == "AES-128" {
+		aw, err := AesCbcWriterNew(s.TsWriter, s.HlsKey, s.HlsIv)
+		if err != nil {
+			return err
+		}
+		s.HlsAesWriter = aw
+		s.TsWriter = aw
+	}
+	return nil
+}
+
+// 切片结束时调用, 写入最后的填充数据
+func HlsEncryptSegEnd(s *Stream) {
+	if s.HlsAesWriter == nil {
+		return
+	}
+	if err := AesCbcClose(s.HlsAesWriter); err != nil {
+		s.logHls.Printf("Write ts fail, %s", err)
+	}
+	s.HlsAesWriter = nil
+}
+
+func HlsKeyCreate(s *Stream, seq uint32) error {
+	key := make([]byte, AesBlockSize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return err
+	}
+	fn := fmt.Sprintf("%s%s/%s_%d.key", conf.HlsSavePath, s.Key, s.Key, seq)
+	if err := HlsFileWrite(fn, key); err != nil {
+		return err
+	}
+	s.logHls.Println("hls key is", fn)
+	s.HlsKey = key
+	s.HlsKeyPath = fn
+	s.HlsKeySeq = seq
+	return nil
+}
+
+// 切片移出m3u8时调用, 后面的切片不再用这个key时 才删除
+func HlsKeyRemove(s *Stream, ti TsInfo) {
+	if ti.KeyPath == "" || ti.KeyPath == s.HlsKeyPath {
+		return
+	}
+	if e := s.TsList.Front(); e != nil && (e.Value).(TsInfo).KeyPath == ti.KeyPath {
+		return
+	}
+	HlsFileRemove(ti.KeyPath)
+}
+
+/**********************************************************/
+/* AES-128
+/**********************************************************/
+// 数据不是16字节的整数倍时, 剩下的留到下次写, 最后用PKCS7填充
+type AesCbcWriter struct {
+	W    io.Writer
+	Mode cipher.BlockMode
+	Buf  []byte
+}
+
+func AesCbcWriterNew(w io.Writer, key, iv []byte) (*AesCbcWriter, error) {
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &AesCbcWriter{W: w, Mode: cipher.NewCBCEncrypter(b, iv)}, nil
+}
+
+func (aw *AesCbcWriter) Write(d []byte) (int, error) {
+	aw.Buf = append(aw.Buf, d...)
+	n := len(aw.Buf) - len(aw.Buf)%AesBlockSize
+	if n == 0 {
+		return len(d), nil
+	}
+	out := make([]byte, n)
+	aw.Mode.CryptBlocks(out, aw.Buf[:n])
+	aw.Buf = append(aw.Buf[:0], aw.Buf[n:]...)
+	if _, err := aw.W.Write(out); err != nil {
+		return 0, err
+	}
+	return len(d), nil
+}
+
+// PKCS7填充, 数据正好是16字节的整数倍时 也要填充16字节
+func AesCbcClose(aw *AesCbcWriter) error {
+	pad := AesBlockSize - len(aw.Buf)
+	_, err := aw.Write(bytes.Repeat([]byte{byte(pad)}, pad))
+	return err
+}
+
+/**********************************************************/
+/* SAMPLE-AES
+/**********************************************************/
+// rtmp的数据不能修改(播放者也在用), 返回加密后的新chunk
+// 视频: nalu为4字节长度 + nalu, 加密后 长度可能变化
+// 音频: 2字节头 + aac帧, 加密后 长度不变
+// SAMPLE-AES只定义了H.264和AAC, hevc mp3 g711不加密, pmt里也是原来的stream_type
+func SampleAesChunk(s *Stream, c *Chunk) *Chunk {
+	if s.HlsEncMethod != "SAMPLE-AES" {
+		return c
+	}
+	var d []byte
+	switch c.DataType {
+	case "VideoKeyFrame", "VideoInterFrame":
+		if s.TsVideoType != 0x1b {
+			return c
+		}
+		d = SampleAesVideo(s, c.MsgData)
+	case "AudioAacFrame":
+		d = SampleAesAudio(s, c.MsgData)
+	default:
+		return c
+	}
+	nc := *c
+	nc.MsgData = d
+	nc.MsgLength = uint32(len(d))
+	return &nc
+}
+
+func SampleAesVideo(s *Stream, md []byte) []byte {
+	if len(md) <= 5 {
+		return md
+	}
+	out := append([]byte(nil), md[:5]...)
+	d := md[5:]
+	for len(d) >= 4 {
+		n := ByteToUint32(d[:4], BE)
+		if n > uint32(len(d)-4) {
+			s.logHls.Printf("nalu length %d is wrong, remain %d", n, len(d)-4)
+			break
+		}
+		nalu := d[4 : 4+n]
+		d = d[4+n:]
+
+		typ := uint8(0)
+		if n > 0 {
+			typ = nalu[0] & 0x1f
+		}
+		if (typ == 1 || typ == 5) && n > SampleAesMinNalu {
+			nalu = NaluEscape(SampleAesNalu(s, NaluUnescape(nalu)))
+		}
+		out = append(out, Uint32ToByte(uint32(len(nalu)), nil, BE)...)
+		out = append(out, nalu...)
+	}
+	return out
+}
+
+// 开头32字节不加密, 然后 加密16字节 不加密144字节 循环, 最后不足16字节的不加密
+// 每个nalu的CBC 都从IV重新开始
+func SampleAesNalu(s *Stream, nalu []byte) []byte {
+	d := append([]byte(nil), nalu...)
+	b, err := aes.NewCipher(s.HlsKey)
+	if err != nil {
+		s.logHls.Println(err)
+		return nalu
+	}
+	mode := cipher.NewCBCEncrypter(b, s.HlsIv)
+	for i := SampleAesLeader; i < len(d); {
+		if len(d)-i > AesBlockSize {
+			mode.CryptBlocks(d[i:i+AesBlockSize], d[i:i+AesBlockSize])
+			i += AesBlockSize
+		}
+		i += SampleAesClearSize
+	}
+	return d
+}
+
+// 开头16字节不加密, 之后所有完整的16字节都加密, 最后不足16字节的不加密
+// 每个aac帧的CBC 都从IV重新开始
+func SampleAesAudio(s *Stream, md []byte) []byte {
+	d := append([]byte(nil), md...)
+	start := 2 + SampleAesAudioLead
+	if len(d) < start+AesBlockSize {
+		return d
+	}
+	b, err := aes.NewCipher(s.HlsKey)
+	if err != nil {
+		s.logHls.Println(err)
+		return md
+	}
+	n := (len(d) - start) / AesBlockSize * AesBlockSize
+	cipher.NewCBCEncrypter(b, s.HlsIv).CryptBlocks(d[start:start+n], d[start:start+n])
+	return d
+}
+
+// SAMPLE-AES的pmt, stream_type不同 并且有描述符
+// 视频 0xdb, private_data_indicator_descriptor 'zavc'
+// 音频 0xcf, private_data_indicator_descriptor 'aacd'
+//
+//	registration_descriptor 'apad' + audio_setup_information
+func PmtSampleAesCreate(s *Stream) []byte {
+	var asc []byte
+	if s.HlsAudioHeader != nil && len(s.HlsAudioHeader.MsgData) > 2 {
+		asc = s.HlsAudioHeader.MsgData[2:]
+	}
+	ad := []byte{0x0f, 4, 'a', 'a', 'c', 'd'}
+	asi := []byte{'z', 'a', 'a', 'c', 0, 0, 1, uint8(len(asc))} // audio_type, priming, version, setup_data_length
+	asi = append(asi, asc...)
+	ad = append(ad, 0x05, uint8(4+len(asi)), 'a', 'p', 'a', 'd')
+	ad = append(ad, asi...)
+	vd := []byte{0x0f, 4, 'z', 'a', 'v', 'c'}
+
+	b := bytes.NewBuffer(nil)
+	WriteUint32(b, BE, 0x1, 2)                         // program_number
+	b.WriteByte(0x3<<6 | s.TsPmtVersion<<1 | 0x1)      // reserved, version_number, current_next_indicator
+	b.WriteByte(0x0)                                   // section_number
+	b.WriteByte(0x0)                                   // last_section_number
+	WriteUint32(b, BE, 0x7<<13|uint32(TsPcrPid(s)), 2) // reserved, PCR_PID
+	WriteUint32(b, BE, 0xf<<12, 2)                     // reserved, program_info_length
+	vt, at := s.TsVideoType, s.TsAudioType
+	if vt == 0 && at == 0 {
+		vt, at = 0x1b, 0x0f
+	}
+	if at == 0x0f {
+		b.WriteByte(0xcf)                              // stream_type
+		WriteUint32(b, BE, 0x7<<13|AudioPid, 2)        // reserved, elementary_PID
+		WriteUint32(b, BE, 0xf<<12|uint32(len(ad)), 2) // reserved, ES_info_length
+		b.Write(ad)
+	} else if at != 0 {
+		b.WriteByte(at)
+		WriteUint32(b, BE, 0x7<<13|AudioPid, 2)
+		WriteUint32(b, BE, 0xf<<12, 2)
+	}
+	if vt == 0x1b {
+		b.WriteByte(0xdb)
+		WriteUint32(b, BE, 0x7<<13|VideoPid, 2)
+		WriteUint32(b, BE, 0xf<<12|uint32(len(vd)), 2)
+		b.Write(vd)
+	} else if vt != 0 {
+		b.WriteByte(vt)
+		WriteUint32(b, BE, 0x7<<13|VideoPid, 2)
+		WriteUint32(b, BE, 0xf<<12, 2)
+	}
+
+	// section_length 包括后面的数据和CRC32
+	d := []byte{0x2, 0, 0}
+	Uint16ToByte(uint16(0xb<<12|(b.Len()+4)), d[1:3], BE)
+	d = append(d, b.Bytes()...)
+	return append(d, Uint32ToByte(Crc32Create(d), nil, BE)...)
+}
+
+/**********************************************************/
+/* http
+/**********************************************************/
+func HlsKeyTokenCheck(rule HlsEncryptRule, r *http.Request) bool {
+	if rule.KeyToken == "" {
+		return true
+	}
+	token := r.URL.Query().Get("token")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(rule.KeyToken)) == 1
+}
+
+// 请求m3u8时带了token, key的URI 也带上这个token
+func M3u8KeyTokenAdd(d []byte, r *http.Request) []byte {
+	token := r.URL.Query().Get("token")
+	if token == "" || !bytes.Contains(d, []byte("#EXT-X-KEY")) {
+		return d
+	}
+	uri := fmt.Sprintf(".key?token=%s\"", url.QueryEscape(token))
+	return bytes.ReplaceAll(d, []byte(".key\""), []byte(uri))
+}
+
+// GET /live/live_yuankang_8.key?token=xxx
+func GetHlsKey(w http.ResponseWriter, r *http.Request) {
+	app, stream, fn := GetPlayInfo(r.URL.Path)
+	rule, ok := HlsEncryptRuleGet(app)
+	if !ok || !HlsKeyTokenCheck(rule, r) {
+		log.Printf("hls key %s forbidden", r.URL.Path)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	file := fmt.Sprintf("%s%s_%s/%s", conf.HlsSavePath, app, stream, fn)
+	d, err := HlsFileRead(file)
+	if err != nil {
+		log.Println(err)
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Server", AppName)
+	w.Write(d)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+)
+
+/**********************************************************/
+/* hls fmp4(cmaf)
+/**********************************************************/
+// https://datatracker.ietf.org/doc/html/rfc8216#section-3.3
+// HlsFormat 为 fmp4 时, 用HlsChan的数据生成 init.mp4 和 m4s切片, 代替ts
+// init.mp4 为 ftyp + moov, m3u8里用 #EXT-X-MAP 指定, 文件名为 live_yuankang_0_init.mp4
+// init.mp4文件名里的序号 是第一个m4s的序号, 重新发布后 init.mp4可能不同 所以不能重名
+// m4s 为 moof + mdat, 文件名为 live_yuankang_8.m4s, 切片规则和ts一样
+// 开启ll-hls时 每个part是一个 moof + mdat, m4s就是part连起来
+// 切片的时间戳 直接用rtmp的时间戳, 不从0开始 播放器用tfdt定位
+// 视频支持H.264(avc1)和H.265(hvc1, safari要求hvc1), 音频只支持AAC(mp4a)
+// MP3和G.711 只能用ts, fmp4切片里没有这些音频
+// 发布中音视频头变了(如 分辨率变了), 下一个关键帧开始新的m4s 并生成新的init.mp4
+// m3u8里这个m4s前面加 #EXT-X-DISCONTINUITY 和新的 #EXT-X-MAP
+type Fmp4HlsInfo struct {
+	HlsVideoHeader *Chunk    // init.mp4里要用
+	HlsAudioHeader *Chunk    // init.mp4里要用
+	HlsMp4         *Mp4Muxer // m4s切片的封装器
+	HlsInitPath    string    // init.mp4路径, 包含文件名
+	HlsInitNew     bool      // 音视频头变了, 下一个m4s要用新的init.mp4
+}
+
+func HlsIsFmp4() bool {
+	return conf.HlsFormat == "fmp4"
+}
+
+// EXT-X-MAP 要求版本号不小于6, SAMPLE-AES 要求版本号不小于5
+func HlsVersion(s *Stream) int {
+	if HlsIsFmp4() {
+		return 6
+	}
+	if s.HlsEncMethod == "SAMPLE-AES" {
+		return 5
+	}
+	return 3
+}
+
+// m3u8头里的 #EXT-X-MAP, ts时为空
+// 是第一个切片的init.mp4, 重新发布后的init.mp4 在切片前面, 见HlsDiscTagCreate()
+func HlsMapCreate(s *Stream) string {
+	fn := s.HlsInitPath
+	if e := s.TsList.Front(); e != nil {
+		fn = (e.Value).(TsInfo).MapPath
+	}
+	if !HlsIsFmp4() || fn == "" {
+		return ""
+	}
+	return fmt.Sprintf("\n#EXT-X-MAP:URI=\"%s\"", path.Base(fn))
+}
+
+// 切片移出m3u8时调用, 后面的切片不再用这个init.mp4时 才删除
+func HlsInitRemove(s *Stream, ti TsInfo) {
+	if ti.MapPath == "" || ti.MapPath == s.HlsInitPath {
+		return
+	}
+	if e := s.TsList.Front(); e != nil && (e.Value).(TsInfo).MapPath == ti.MapPath {
+		return
+	}
+	HlsFileRemove(ti.MapPath)
+}
+
+// 音视频头 必须在第一个帧之前到达, init.mp4的moov里要用
+func Fmp4InitCreate(s *Stream) error {
+	m, err := Mp4MuxerNew(s.HlsVideoHeader, s.HlsAudioHeader)
+	if err != nil {
+		return err
+	}
+
+	fn := fmt.Sprintf("%s%s/%s_%d_init.mp4", conf.HlsSavePath, s.Key, s.Key, s.TsLastSeq)
+	err = HlsFileWrite(fn, Mp4InitCreate(m))
+	if err != nil {
+		return err
+	}
+	s.logHls.Println("init.mp4 is", fn)
+	s.HlsMp4 = m
+	s.HlsInitPath = fn
+	return nil
+}
+
+// HlsCreator()收到音视频头时调用, old是之前的音视频头
+// 第一次收到 或 没变时 不用换init.mp4
+func Fmp4HeaderCheck(s *Stream, old, c *Chunk) {
+	if !HlsIsFmp4() || s.HlsMp4 == nil || old == nil || bytes.Equal(old.MsgData, c.MsgData) {
+		return
+	}
+	s.logHls.Printf("%s changed, new init.mp4 at next segment", c.DataType)
+	s.HlsInitNew = true
+}
+
+// 新生成一个m4s返回true, 否则返回false
+func Fmp4Create(s *Stream, c *Chunk) bool {
+	s.TsExtInfo = float64(c.Timestamp-s.TsFirstTs) / 1000
+	s.logHls.Printf("c.Timestamp=%d, s.TsFirstTs=%d, s.TsExtInfo=%f, conf.HlsTsMaxTime=%d", c.Timestamp, s.TsFirstTs, s.TsExtInfo, conf.HlsTsMaxTime)
+
+	var tf bool
+	if HlsSegNeedCut(s, c) {
+		s.logHls.Println("--->> Fmp4FileCreate()")
+		Fmp4FileCreate(s, c)
+		tf = true
+	} else if conf.HlsPartTime > 0 {
+		Fmp4PartAppend(s, c) // 需要时 截断part
+	}
+
+	if s.TsPath != "" {
+		Mp4SampleAdd(s.HlsMp4, c, c.Timestamp)
+	}
+	return tf
+}
+
+func Fmp4FileCreate(s *Stream, c *Chunk) {
+	if s.TsPath != "" {
+		Fmp4FragmentWrite(s)
+		HlsSegClose(s)
+		if conf.HlsPartTime > 0 {
+			HlsPartEnd(s, c) // 上一个m4s的最后一个part
+		}
+		M3u8Update(s, c)
+		s.TsPath = ""
+	}
+
+	// 之前的sample已经写入, 可以换封装器了
+	if s.HlsInitNew {
+		s.HlsMp4 = nil
+		s.HlsInitNew = false
+		s.TsDisc = true
+	}
+	if s.HlsMp4 == nil {
+		if err := Fmp4InitCreate(s); err != nil {
+			s.logHls.Println(err)
+			return
+		}
+	}
+
+	s.TsPath = fmt.Sprintf("%s%s/%s_%d.m4s", conf.HlsSavePath, s.Key, s.Key, s.TsLastSeq)
+	s.logHls.Println(s.TsPath)
+
+	if err := HlsSegOpen(s); err != nil {
+		s.logHls.Println(err)
+		s.TsPath = ""
+		return
+	}
+	if conf.HlsPartTime > 0 {
+		HlsPartTsStart(s, c)
+	}
+
+	s.TsFirstTs = c.Timestamp
+	HlsDateTimeSet(s, c.Timestamp)
+	HlsCueSegStart(s)
+	s.TsLastSeq++
+	if conf.HlsPartTime > 0 {
+		M3u8LlUpdate(s)
+	}
+}
+
+// 把还没写入的sample 生成一个 moof + mdat 写入m4s
+func Fmp4FragmentWrite(s *Stream) error {
+	d := Mp4FragmentCreate(s.HlsMp4, 0)
+	if d == nil {
+		return nil
+	}
+	_, err := s.TsWriter.Write(d)
+	if err != nil {
+		s.logHls.Printf("Write m4s fail, %s", err)
+		return err
+	}
+	return nil
+}
+
+// sample写入fragment时才有数据, 所以不能用PartData判断part是否为空
+func Fmp4PartAppend(s *Stream, c *Chunk) {
+	if Fmp4HasSample(s.HlsMp4) && HlsPartIsFull(s, c) {
+		Fmp4FragmentWrite(s)
+		HlsPartEnd(s, c)
+		HlsPartStart(s, c)
+		M3u8LlUpdate(s)
+	}
+	s.PartLastTs = c.Timestamp
+}
+
+func Fmp4HasSample(m *Mp4Muxer) bool {
+	for _, t := range Mp4Tracks(m) {
+		if len(t.Samples) > 0 {
+			return true
+		}
+	}
+	return false
+}
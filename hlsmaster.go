@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+/**********************************************************/
+/* hls master
+/**********************************************************/
+// https://datatracker.ietf.org/doc/html/rfc8216#section-4.3.4.2
+// 音视频头到达时 记录CODECS和RESOLUTION, 每个切片完成时 用切片大小和时长计算BANDWIDTH
+// 只有音频时 没有RESOLUTION, CODECS只有mp4a, 只有视频时 CODECS只有avc1(hevc是hvc1)
+// GET /live/yuankang.m3u8?master 返回只有一个码率的master m3u8, 指向 /live/yuankang.m3u8
+// 配置了HlsMaster.Groups时, 发布者name_1080 name_720 name_360 是同一个流的不同码率
+// GET /live/name.m3u8 没有发布者name时, 返回包含各个码率的master m3u8
+// 组内的流 在HlsTsMaxTime整数倍的时间点之后的第一个关键帧截断切片
+// 编码器各个码率的关键帧和时间戳一致时(通常是这样) 切片就是对齐的
+type HlsMasterInfo struct {
+	HlsAligned   bool   // 属于某个码率组, 切片要对齐
+	HlsCodecs    string // 如 avc1.4d401f,mp4a.40.2
+	HlsWidth     uint32 // 视频宽, 0表示没有视频
+	HlsHeight    uint32 // 视频高
+	HlsBandwidth uint32 // 切片的最大码率, 单位为bit/s
+}
+
+// 有视频头 才有视频, 有音频头 才有音频
+// MP3和G.711没有音频头, 收到音频帧后 TsAudioType不为0, 见TsAudioTypeUpdate()
+func HlsHasVideo(s *Stream) bool {
+	return s.HlsVideoHeader != nil
+}
+
+func HlsHasAudio(s *Stream) bool {
+	return s.HlsAudioHeader != nil || s.TsAudioType != 0
+}
+
+// 音视频头到达时 和MP3/G.711的第一个音频帧到达时调用
+// CODECS要包括所有的音视频, 有一个不知道时(头不能解析, G.711没有CODECS) 不写入CODECS
+func HlsCodecsUpdate(s *Stream) {
+	var vc, ac string
+	var w, h uint32
+	if HlsHasVideo(s) && s.HlsVideoHeader.MsgData[0]&0xf == 12 {
+		if HevcC, err := HevcCParse(s.HlsVideoHeader.MsgData); err == nil {
+			vc = HevcCodecCreate(HevcC)
+			if sps, err := HevcSpsParse(NaluUnescape(HevcC.SpsData)); err == nil {
+				w, h = sps.Width, sps.Height
+			}
+		}
+	} else if HlsHasVideo(s) {
+		if AvcC, err := AvcCParse(s.HlsVideoHeader.MsgData); err == nil {
+			vc = fmt.Sprintf("avc1.%02x%02x%02x", AvcC.AVCProfileIndication,
+				AvcC.ProfileCompatibility, AvcC.AVCLevelIndication)
+			if sps, err := SpsParse(NaluUnescape(AvcC.SpsData)); err == nil {
+				w, h = sps.Width, sps.Height
+			}
+		}
+	}
+	if s.HlsAudioHeader != nil {
+		if AacC, err := AudioSpecificConfigParse(s.HlsAudioHeader.MsgData); err == nil {
+			ac = fmt.Sprintf("mp4a.40.%d", AacC.ObjectType)
+		}
+	} else if s.TsAudioType == 0x03 {
+		ac = "mp4a.40.34" // MP3
+	}
+
+	codecs := vc
+	if codecs != "" && ac != "" {
+		codecs += ","
+	}
+	codecs += ac
+	if (HlsHasVideo(s) && vc == "") || (HlsHasAudio(s) && ac == "") {
+		codecs = ""
+	}
+	s.HlsLock.Lock()
+	s.HlsCodecs, s.HlsWidth, s.HlsHeight = codecs, w, h
+	s.HlsLock.Unlock()
+	s.logHls.Printf("hls codecs is %s, resolution is %dx%d", codecs, w, h)
+}
+
+// 切片完成时调用, d是切片时长 单位为秒
+func HlsBandwidthUpdate(s *Stream, fn string, d float64) {
+	size, err := HlsFileSize(fn)
+	if err != nil || d <= 0 {
+		return
+	}
+	bw := uint32(float64(size*8) / d)
+	s.HlsLock.Lock()
+	if bw > s.HlsBandwidth {
+		s.HlsBandwidth = bw
+	}
+	s.HlsLock.Unlock()
+}
+
+// 还没有完成的切片时 BANDWIDTH为0, 播放器通常也能播放
+func HlsStreamInfCreate(s *Stream, uri string) string {
+	s.HlsLock.Lock()
+	defer s.HlsLock.Unlock()
+	inf := fmt.Sprintf("#EXT-X-STREAM-INF:BANDWIDTH=%d", s.HlsBandwidth)
+	if s.HlsCodecs != "" {
+		inf += fmt.Sprintf(",CODECS=\"%s\"", s.HlsCodecs)
+	}
+	if s.HlsWidth > 0 && s.HlsHeight > 0 {
+		inf += fmt.Sprintf(",RESOLUTION=%dx%d", s.HlsWidth, s.HlsHeight)
+	}
+	inf += HlsCaptionAttrCreate(s)
+	return fmt.Sprintf("%s\n%s\n", inf, uri)
+}
+
+// GET /live/yuankang.m3u8?master
+func GetM3u8Master(app, stream string, r *http.Request) ([]byte, error) {
+	s, ok := PublisherGet(fmt.Sprintf("%s_%s", app, stream))
+	if !ok {
+		return nil, fmt.Errorf("publisher %s_%s is not exist", app, stream)
+	}
+	uri := fmt.Sprintf("%s.m3u8", stream)
+	var token string
+	if t := r.URL.Query().Get("token"); t != "" {
+		token = "?token=" + url.QueryEscape(t)
+	}
+	m3u8 := fmt.Sprintf("#EXTM3U\n#EXT-X-VERSION:%d\n", HlsVersion(s))
+	m3u8 += HlsCaptionMediaCreate(s, uri, token)
+	return []byte(m3u8 + HlsStreamInfCreate(s, uri+token)), nil
+}
+
+/**********************************************************/
+/* rendition group
+/**********************************************************/
+func HlsMasterGroupGet(app string) (HlsMasterGroup, bool) {
+	gs := conf.HlsMaster.Groups
+	if !conf.HlsMaster.Enable {
+		return HlsMasterGroup{}, false
+	}
+	i := AppRuleFind(len(gs), app, func(i int) string { return gs[i].App })
+	if i < 0 {
+		return HlsMasterGroup{}, false
+	}
+	return gs[i], true
+}
+
+// stream以Suffixes里的某个结尾 就属于码率组
+func HlsMasterInit(s *Stream) {
+	g, ok := HlsMasterGroupGet(s.AmfInfo.App)
+	if !ok {
+		return
+	}
+	for _, sf := range g.Suffixes {
+		if len(s.AmfInfo.StreamName) > len(sf) && strings.HasSuffix(s.AmfInfo.StreamName, sf) {
+			s.HlsAligned = true
+			s.logHls.Printf("stream %s is in rendition group, align segments", s.AmfInfo.StreamName)
+			return
+		}
+	}
+}
+
+// 切片开始后 跨过了HlsTsMaxTime的整数倍 才截断
+// 不看切片时长, 上个切片的关键帧晚于对齐点时 这个切片会短一点, 但各个码率一样
+func HlsAlignedCut(s *Stream, c *Chunk) bool {
+	d := conf.HlsTsMaxTime * 1000
+	if d == 0 {
+		return true
+	}
+	return c.Timestamp/d != s.TsFirstTs/d
+}
+
+// 返回name下 已经发布的码率, 没有时返回空
+func HlsRenditionsGet(app, name string) []*Stream {
+	g, ok := HlsMasterGroupGet(app)
+	if !ok {
+		return nil
+	}
+	if _, ok := PublisherGet(fmt.Sprintf("%s_%s", app, name)); ok {
+		return nil // name本身是发布者, 返回它的m3u8
+	}
+	var ss []*Stream
+	for _, sf := range g.Suffixes {
+		if s, ok := PublisherGet(fmt.Sprintf("%s_%s%s", app, name, sf)); ok {
+			ss = append(ss, s)
+		}
+	}
+	return ss
+}
+
+// GET /live/name.m3u8, 码率按Suffixes的顺序
+func M3u8GroupCreate(ss []*Stream, r *http.Request) []byte {
+	var token string
+	if t := r.URL.Query().Get("token"); t != "" {
+		token = "?token=" + url.QueryEscape(t)
+	}
+	ver := 3
+	for _, s := range ss {
+		if v := HlsVersion(s); v > ver {
+			ver = v
+		}
+	}
+	m3u8 := fmt.Sprintf("#EXTM3U\n#EXT-X-VERSION:%d\n#EXT-X-INDEPENDENT-SEGMENTS\n", ver)
+	// 各个码率的字幕一样, 用第一个有字幕的码率
+	for _, s := range ss {
+		if m := HlsCaptionMediaCreate(s, s.AmfInfo.StreamName+".m3u8", token); m != "" {
+			m3u8 += m
+			break
+		}
+	}
+	for _, s := range ss {
+		m3u8 += HlsStreamInfCreate(s, fmt.Sprintf("%s.m3u8%s", s.AmfInfo.StreamName, token))
+	}
+	return []byte(m3u8)
+}
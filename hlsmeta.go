@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**********************************************************/
+/* hls timed metadata
+/**********************************************************/
+// https://developer.apple.com/library/archive/documentation/AudioVideo/Conceptual/HTTP_Live_Streaming_Metadata_Spec/
+// 推流里的onCuePoint/onTextData等数据消息(DataType为DataFrame, 见MetadataHandle())
+// ts时 封装为ID3的pes 写入Id3Pid, pmt里有Id3Pid 和ID3的描述符
+// onCuePoint的name为cue-out/cue-in时 是广告标记, 之后的第一个关键帧截断切片, 新切片前加标签
+// CueTag为cue时 是 #EXT-X-CUE-OUT:30.000 和 #EXT-X-CUE-IN
+// CueTag为daterange时 是 #EXT-X-DATERANGE, cue-out和cue-in 用同一个ID
+// fmp4时 只有广告标记, 没有ID3
+type HlsMetaInfo struct {
+	HlsId3      bool      // ts里有ID3, pmt里要有Id3Pid
+	Id3Counter  uint8     // 4bit, 0x0 - 0xf 循环
+	HlsCuePend  string    // out 或 in, 等下一个切片开始时 生成标签
+	HlsCueDur   float64   // cue-out的时长, 单位为秒, 0表示不知道
+	HlsCueId    string    // daterange时 cue-out的ID, cue-in要用
+	HlsCueStart time.Time // daterange时 cue-out的START-DATE, cue-in要用
+	HlsCueStr   string    // 当前切片前的广告标记
+}
+
+func HlsMetaInit(s *Stream) {
+	s.HlsId3 = conf.HlsTimedMeta.Enable && !HlsIsFmp4()
+}
+
+// HlsCreator()收到DataFrame时调用, 还没有切片时 ID3丢弃
+func HlsDataFrameHandle(s *Stream, c *Chunk) {
+	if !conf.HlsTimedMeta.Enable {
+		return
+	}
+	vs, err := AmfUnmarshal(s, bytes.NewReader(c.MsgData))
+	if err != nil && err != io.EOF {
+		s.logHls.Println(err)
+		return
+	}
+	name := DataMsgName(vs)
+	s.logHls.Printf("data frame %s, timestamp=%d", name, c.Timestamp)
+	if len(vs) == 0 || name == "" {
+		return
+	}
+
+	if s.HlsId3 && s.TsPath != "" {
+		if err := Id3Write(s, c, name, vs[1:]); err != nil {
+			s.logHls.Println(err)
+		}
+	}
+	if name == "onCuePoint" && len(vs) > 1 {
+		if o, ok := vs[1].(Object); ok {
+			HlsCueCheck(s, o)
+		}
+	}
+}
+
+/**********************************************************/
+/* id3
+/**********************************************************/
+// ID3v2.4, 只有一个TXXX帧, description是数据消息的名字 value是json
+// onTextData 只取text
+// 10(头) + 10(帧头) + 1(编码) + description + 1 + value
+func Id3Create(name string, vs []interface{}) ([]byte, error) {
+	var value string
+	if len(vs) == 1 {
+		if o, ok := vs[0].(Object); ok && name == "onTextData" {
+			value, _ = o["text"].(string)
+		}
+	}
+	if value == "" {
+		var v interface{} = vs
+		if len(vs) == 1 {
+			v = vs[0]
+		}
+		d, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		value = string(d)
+	}
+
+	f := []byte{0x03} // UTF-8
+	f = append(f, name...)
+	f = append(f, 0x00)
+	f = append(f, value...)
+
+	d := []byte{'I', 'D', '3', 0x04, 0x00, 0x00}
+	d = append(d, Id3SyncSafe(10+len(f))...)
+	d = append(d, 'T', 'X', 'X', 'X')
+	d = append(d, Id3SyncSafe(len(f))...)
+	d = append(d, 0x00, 0x00) // flags
+	return append(d, f...), nil
+}
+
+// ID3里的长度 每字节只用低7bit
+func Id3SyncSafe(n int) []byte {
+	return []byte{uint8(n>>21) & 0x7f, uint8(n>>14) & 0x7f, uint8(n>>7) & 0x7f, uint8(n) & 0x7f}
+}
+
+// pes的stream_id为0xbd(private_stream_1), 只有PTS, data_alignment_indicator为1
+func Id3Write(s *Stream, c *Chunk, name string, vs []interface{}) error {
+	id3, err := Id3Create(name, vs)
+	if err != nil {
+		return err
+	}
+	_, pesData := PesHeaderCreate(s, c)
+	pesData[3] = 0xbd
+	pesData[6] |= 0x1 << 2
+	pesData = append(pesData, id3...)
+	SetPesPakcetLength(pesData, len(pesData)-6)
+	return TsPesWrite(s, c, Id3Pid, pesData)
+}
+
+// pmt的program_info里加 metadata_pointer_descriptor, 最后加ID3的stream 带metadata_descriptor
+// pmt是PmtCreate()或PmtSampleAesCreate()生成的, 重新计算section_length和CRC32
+func PmtId3Add(pmt []byte) []byte {
+	pointer := []byte{0x25, 0x0f, 0xff, 0xff, 'I', 'D', '3', ' ', 0xff, 'I', 'D', '3', ' ', 0x00, 0x1f, 0x00, 0x01}
+	md := []byte{0x26, 0x0d, 0xff, 0xff, 'I', 'D', '3', ' ', 0xff, 'I', 'D', '3', ' ', 0x00, 0x0f}
+
+	piLen := int(ByteToUint32(pmt[10:12], BE) & 0xfff)
+	d := append([]byte{}, pmt[:12+piLen]...)
+	d = append(d, pointer...)
+	d = append(d, pmt[12+piLen:len(pmt)-4]...)
+	d = append(d, 0x15) // stream_type, Metadata carried in PES packets
+	d = append(d, Uint16ToByte(0x7<<13|Id3Pid, nil, BE)...)
+	d = append(d, Uint16ToByte(uint16(0xf<<12|len(md)), nil, BE)...)
+	d = append(d, md...)
+
+	Uint16ToByte(uint16(0xf<<12|(piLen+len(pointer))), d[10:12], BE)
+	Uint16ToByte(uint16(0xb<<12|(len(d)-3+4)), d[1:3], BE)
+	return append(d, Uint32ToByte(Crc32Create(d), nil, BE)...)
+}
+
+/**********************************************************/
+/* cue
+/**********************************************************/
+// onCuePoint如 {name:"cue-out", time:12.5, type:"event", parameters:{duration:"30"}}
+// duration 可以在parameters里 也可以在外层, 可以是数字 也可以是字符串
+func HlsCueCheck(s *Stream, o Object) {
+	name, _ := o["name"].(string)
+	switch strings.ToLower(name) {
+	case "cue-out", "cueout", "adstart":
+		s.HlsCuePend = "out"
+		s.HlsCueDur = HlsCueDuration(o)
+		if p, ok := o["parameters"].(Object); ok && s.HlsCueDur == 0 {
+			s.HlsCueDur = HlsCueDuration(p)
+		}
+	case "cue-in", "cuein", "adend":
+		s.HlsCuePend = "in"
+	default:
+		return
+	}
+	s.logHls.Printf("hls cue %s, duration %.3f", s.HlsCuePend, s.HlsCueDur)
+}
+
+func HlsCueDuration(o Object) float64 {
+	switch v := o["duration"].(type) {
+	case float64:
+		return v
+	case string:
+		d, _ := strconv.ParseFloat(v, 64)
+		return d
+	}
+	return 0
+}
+
+// 新切片开始时调用, 在HlsDateTimeSet()之后
+func HlsCueSegStart(s *Stream) {
+	s.HlsCueStr = ""
+	if s.HlsCuePend == "" {
+		return
+	}
+	dr := conf.HlsTimedMeta.CueTag == "daterange"
+	start := s.TsDateTime.UTC().Format("2006-01-02T15:04:05.000Z")
+	switch {
+	case s.HlsCuePend == "out" && dr:
+		s.HlsCueId = fmt.Sprintf("cue-%d", s.TsLastSeq)
+		s.HlsCueStart = s.TsDateTime
+		s.HlsCueStr = fmt.Sprintf("\n#EXT-X-DATERANGE:ID=\"%s\",START-DATE=\"%s\"", s.HlsCueId, start)
+		if s.HlsCueDur > 0 {
+			s.HlsCueStr += fmt.Sprintf(",PLANNED-DURATION=%.3f", s.HlsCueDur)
+		}
+	case s.HlsCuePend == "out":
+		s.HlsCueStr = "\n#EXT-X-CUE-OUT"
+		if s.HlsCueDur > 0 {
+			s.HlsCueStr += fmt.Sprintf(":%.3f", s.HlsCueDur)
+		}
+	case s.HlsCuePend == "in" && dr:
+		if s.HlsCueId == "" { // 没有cue-out
+			break
+		}
+		// 同一个ID 各个属性的值要和之前的一样, 所以START-DATE用cue-out的
+		s.HlsCueStr = fmt.Sprintf("\n#EXT-X-DATERANGE:ID=\"%s\",START-DATE=\"%s\",END-DATE=\"%s\"",
+			s.HlsCueId, s.HlsCueStart.UTC().Format("2006-01-02T15:04:05.000Z"), start)
+		s.HlsCueId = ""
+	case s.HlsCuePend == "in":
+		s.HlsCueStr = "\n#EXT-X-CUE-IN"
+	}
+	s.HlsCuePend, s.HlsCueDur = "", 0
+	s.logHls.Printf("hls cue tag is %s", s.HlsCueStr)
+}
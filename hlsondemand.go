@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+/**********************************************************/
+/* hls on demand
+/**********************************************************/
+// 配置了HlsOnDemand.Rules的app, 发布时不生成hls, 有人看hls时才生成
+// 第一个m3u8请求 通知发送协程, 发送协程等到下一个关键帧 才开启HlsCreator()
+// m3u8请求 最多等待WaitTime, 直到m3u8里有切片(ll-hls时 有part)
+// 超过IdleTime 没有m3u8和切片请求, 发送协程关闭HlsChan, HlsCreator()删除切片和m3u8
+// 序号通过HlsStateSave()接着用, 再次开始时 播放器不会看到序号倒退
+// HlsChan 只由发送协程(RtmpSender)创建和关闭
+type HlsOnDemandInfo struct {
+	HlsOdEnable bool       // 按需生成hls, PublisherStart()里设置 之后不变
+	HlsOdLock   sync.Mutex // HlsOdWant/HlsOdLast/HlsOdReady/HlsOdOk/HlsOdIdle 会被http协程读写
+	HlsOdWant   bool       // 有m3u8请求, 需要生成hls
+	HlsOdLast   time.Time  // 最后一次m3u8或切片请求的时间
+	HlsOdReady  chan bool  // m3u8里有切片时close, m3u8请求 等待它
+	HlsOdOk     bool       // HlsOdReady 已经close
+	HlsOdIdle   bool       // 空闲停止, HlsCreator()结束时 删除切片
+	HlsOdRun    bool       // HlsCreator()正在运行, 只有发送协程读写
+	HlsOdDone   chan bool  // HlsCreator()结束时close, 上次的结束后 才能再次开始
+}
+
+func HlsOnDemandRuleGet(app string) bool {
+	rs := conf.HlsOnDemand.Rules
+	if !conf.HlsOnDemand.Enable {
+		return false
+	}
+	return AppRuleFind(len(rs), app, func(i int) string { return rs[i].App }) >= 0
+}
+
+// PublisherStart()里调用, 返回true时 不开启HlsCreator()
+func HlsOnDemandInit(s *Stream) bool {
+	s.HlsOdEnable = HlsOnDemandRuleGet(s.AmfInfo.App)
+	if s.HlsOdEnable {
+		s.log.Printf("%s hls on demand", s.Key)
+	}
+	return s.HlsOdEnable
+}
+
+// IdleTime为0时 是60秒
+func HlsOnDemandIdleTime() time.Duration {
+	if conf.HlsOnDemand.IdleTime == 0 {
+		return 60 * time.Second
+	}
+	return time.Duration(conf.HlsOnDemand.IdleTime) * time.Second
+}
+
+// WaitTime为0时 是3倍的ts时长
+func HlsOnDemandWaitTime() time.Duration {
+	if conf.HlsOnDemand.WaitTime == 0 {
+		return 3 * time.Duration(conf.HlsTsMaxTime) * time.Second
+	}
+	return time.Duration(conf.HlsOnDemand.WaitTime) * time.Second
+}
+
+/**********************************************************/
+/* 发送协程
+/**********************************************************/
+// RtmpSender()里调用, 代替 s.HlsChan <- c
+func HlsChanSend(s *Stream, c *Chunk) {
+	if !s.HlsOdEnable {
+		s.HlsChan <- c // 发送数据给hls生产协程
+		return
+	}
+
+	s.HlsOdLock.Lock()
+	want, last := s.HlsOdWant, s.HlsOdLast
+	s.HlsOdLock.Unlock()
+
+	if s.HlsOdRun && time.Since(last) > HlsOnDemandIdleTime() {
+		s.log.Printf("%s hls idle, stop", s.Key)
+		HlsOnDemandStop(s, true)
+		return
+	}
+	if !s.HlsOdRun {
+		if !want || !HlsOnDemandStart(s, c) {
+			return
+		}
+	}
+	s.HlsChan <- c
+}
+
+// 有视频时 从关键帧开始, 只有音频时 从音频帧开始
+// 先发送缓存的音视频头, HlsCreator()才能封装
+func HlsOnDemandStart(s *Stream, c *Chunk) bool {
+	if s.HlsOdDone != nil {
+		select {
+		case <-s.HlsOdDone:
+		default:
+			return false // 上次的HlsCreator()还没结束
+		}
+	}
+	if s.GopCache.VideoHeader != nil && c.DataType != "VideoKeyFrame" {
+		return false
+	}
+	if s.GopCache.VideoHeader == nil && !ChunkIsAudioFrame(c) {
+		return false
+	}
+
+	s.HlsOdLock.Lock()
+	s.HlsOdIdle = false
+	s.HlsOdLock.Unlock()
+	s.HlsChan = make(chan *Chunk, 5)
+	s.HlsOdDone = make(chan bool)
+	s.HlsOdRun = true
+	s.log.Printf("%s hls start, timestamp=%d", s.Key, c.Timestamp)
+	go HlsCreator(s) // 开启hls生产协程
+
+	if s.GopCache.VideoHeader != nil {
+		s.HlsChan <- s.GopCache.VideoHeader
+	}
+	if s.GopCache.AudioHeader != nil {
+		s.HlsChan <- s.GopCache.AudioHeader
+	}
+	return true
+}
+
+// idle为true 是空闲停止, 为false 是发布结束
+func HlsOnDemandStop(s *Stream, idle bool) {
+	if !s.HlsOdRun {
+		return
+	}
+	s.HlsOdLock.Lock()
+	s.HlsOdIdle = idle
+	s.HlsOdWant = false
+	s.HlsOdReady, s.HlsOdOk = nil, false
+	s.HlsOdLock.Unlock()
+	close(s.HlsChan)
+	s.HlsOdRun = false
+}
+
+/**********************************************************/
+/* HlsCreator
+/**********************************************************/
+func HlsOnDemandDone(s *Stream) {
+	if s.HlsOdDone != nil {
+		close(s.HlsOdDone)
+	}
+}
+
+// m3u8写入后调用, m3u8里有切片 或 ll-hls时有part 才通知
+func HlsOnDemandReady(s *Stream) {
+	if !s.HlsOdEnable || (s.TsNum == 0 && len(s.PartList) == 0) {
+		return
+	}
+	s.HlsOdLock.Lock()
+	if !s.HlsOdIdle && s.HlsOdReady != nil && !s.HlsOdOk {
+		close(s.HlsOdReady)
+		s.HlsOdOk = true
+	}
+	s.HlsOdLock.Unlock()
+}
+
+// 空闲停止时 HlsCreator()结束前调用, 删除所有切片和m3u8, 只保留序号
+// 正在生成的切片 序号已经用了, 也删除
+func HlsOnDemandClear(s *Stream) {
+	s.HlsOdLock.Lock()
+	idle := s.HlsOdIdle
+	s.HlsOdLock.Unlock()
+	if !idle {
+		return
+	}
+
+	if s.TsPath != "" {
+		HlsSegClose(s)
+		HlsFileRemove(s.TsPath)
+	}
+	for e := s.TsList.Front(); e != nil; e = s.TsList.Front() {
+		ti := (e.Value).(TsInfo)
+		HlsFileRemove(ti.TsFilepath)
+		HlsPartRemove(ti)
+		s.TsList.Remove(e)
+		HlsKeyRemove(s, ti)
+		HlsInitRemove(s, ti)
+		HlsVttRemove(s, ti)
+		HlsTsInfoEvict(s, ti)
+	}
+	// 当前的key和init.mp4 HlsKeyRemove()和HlsInitRemove()不删除
+	// 删除后要清空, 再次开始时 HlsEncryptSegStart()和Fmp4FileCreate() 才会重新生成
+	if s.HlsKeyPath != "" {
+		HlsFileRemove(s.HlsKeyPath)
+	}
+	if s.HlsInitPath != "" {
+		HlsFileRemove(s.HlsInitPath)
+	}
+	s.HlsKey, s.HlsKeyPath, s.HlsKeySeq, s.HlsKeyStr = nil, "", 0, ""
+	HlsFileRemove(s.M3u8Path)
+	if s.VttM3u8Path != "" {
+		HlsFileRemove(s.VttM3u8Path)
+	}
+	s.TsPath, s.HlsInitPath = "", ""
+	s.PartList = nil
+	s.HlsMp4, s.HlsInitNew = nil, false
+	s.logHls.Printf("hls idle clear, seq %d-%d", s.TsFirstSeq, s.TsLastSeq)
+}
+
+/**********************************************************/
+/* http
+/**********************************************************/
+// m3u8请求时调用, 通知发送协程生成hls, 等到m3u8里有切片 最多等WaitTime
+// 码率组时 各个码率同时开始, 一起等待
+func HlsOnDemandWait(ss ...*Stream) {
+	var rs []chan bool
+	for _, s := range ss {
+		if !s.HlsOdEnable {
+			continue
+		}
+		s.HlsOdLock.Lock()
+		s.HlsOdWant = true
+		s.HlsOdLast = time.Now()
+		if s.HlsOdReady == nil {
+			s.HlsOdReady = make(chan bool)
+		}
+		rs = append(rs, s.HlsOdReady)
+		s.HlsOdLock.Unlock()
+	}
+
+	timeout := time.After(HlsOnDemandWaitTime())
+	for _, r := range rs {
+		select {
+		case <-r:
+		case <-timeout:
+			return
+		}
+	}
+}
+
+// 切片请求时调用, 只更新请求时间
+func HlsOnDemandTouch(app, stream string) {
+	s, ok := PublisherGet(fmt.Sprintf("%s_%s", app, stream))
+	if !ok || !s.HlsOdEnable {
+		return
+	}
+	s.HlsOdLock.Lock()
+	s.HlsOdLast = time.Now()
+	s.HlsOdLock.Unlock()
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+/**********************************************************/
+/* hls playlist
+/**********************************************************/
+// https://datatracker.ietf.org/doc/html/rfc8216#section-4.3.2.6
+// https://datatracker.ietf.org/doc/html/rfc8216#section-4.3.3.5
+// 按app配置m3u8的类型, 没有匹配的规则时为live
+// live  滑动窗口, 保留HlsM3u8TsNum个切片, 和原来一样
+// event 整个发布过程的切片都保留, m3u8有 #EXT-X-PLAYLIST-TYPE:EVENT, 发布结束时加 #EXT-X-ENDLIST
+// dvr   滑动窗口, 保留DvrMinutes分钟的切片, 可以回看
+// 每个切片前都有 #EXT-X-PROGRAM-DATE-TIME, 是切片第一帧的时间(墙上时间)
+// 用第一个切片开始时的本地时间 加上rtmp时间戳的差值计算, 避免切片时间抖动
+// event和dvr 切片多, HlsStore为memory时 注意内存用量
+// HlsStore为memory时 发布结束会清空内存里的切片, event结束后无法回放, 所以不能用event, 改为live
+type HlsPlaylistInfo struct {
+	HlsPlType    string    // live / event / dvr
+	HlsDvrTime   float64   // dvr时 m3u8里切片的最大总时长, 单位为秒
+	HlsStartTime time.Time // 第一个切片开始时的本地时间
+	HlsStartTs   uint32    // 第一个切片开始时的rtmp时间戳
+	TsDateTime   time.Time // 当前切片第一帧的时间
+	TsListTime   float64   // m3u8里切片的总时长, 单位为秒
+}
+
+func HlsPlaylistRuleGet(app string) (HlsPlaylistRule, bool) {
+	rs := conf.HlsPlaylist.Rules
+	if !conf.HlsPlaylist.Enable {
+		return HlsPlaylistRule{}, false
+	}
+	i := AppRuleFind(len(rs), app, func(i int) string { return rs[i].App })
+	if i < 0 {
+		return HlsPlaylistRule{}, false
+	}
+	return rs[i], true
+}
+
+func HlsPlaylistInit(s *Stream) {
+	s.HlsPlType, s.HlsDvrTime = HlsPlaylistTypeGet(s.AmfInfo.App, s.logHls)
+	s.logHls.Printf("playlist type is %s, dvr time %.0fs", s.HlsPlType, s.HlsDvrTime)
+}
+
+// 返回m3u8的类型 和dvr时切片的最大总时长(秒), dash的mpd也用这个
+func HlsPlaylistTypeGet(app string, l *log.Logger) (string, float64) {
+	r, ok := HlsPlaylistRuleGet(app)
+	if !ok {
+		return "live", 0
+	}
+	switch r.Type {
+	case "event":
+		if !HlsStoreIsDisk() {
+			l.Printf("app %s event playlist needs disk store, use live", r.App)
+			return "live", 0
+		}
+		return r.Type, 0
+	case "dvr":
+		if r.DvrMinutes == 0 {
+			l.Printf("app %s dvr DvrMinutes is 0, use live", r.App)
+			return "live", 0
+		}
+		return r.Type, float64(r.DvrMinutes) * 60
+	case "live", "":
+	default:
+		l.Printf("app %s playlist type %s is unknown, use live", r.App, r.Type)
+	}
+	return "live", 0
+}
+
+// 新切片开始时调用, ts是切片第一帧的rtmp时间戳
+func HlsDateTimeSet(s *Stream, ts uint32) {
+	if s.HlsStartTime.IsZero() {
+		s.HlsStartTime = time.Now()
+		s.HlsStartTs = ts
+	}
+	d := time.Duration(ts-s.HlsStartTs) * time.Millisecond
+	s.TsDateTime = s.HlsStartTime.Add(d)
+}
+
+// 当前切片前面的标签, 重新发布后有 #EXT-X-DISCONTINUITY, 加密时有 #EXT-X-KEY, 有广告标记时 在最后
+func HlsSegTagCreate(s *Stream) string {
+	dt := s.TsDateTime.UTC().Format("2006-01-02T15:04:05.000Z")
+	return fmt.Sprintf("%s%s\n#EXT-X-PROGRAM-DATE-TIME:%s%s", HlsDiscTagCreate(s), s.HlsKeyStr, dt, s.HlsCueStr)
+}
+
+// 加入新切片前 判断是否要淘汰最老的切片, d是新切片的时长
+func HlsNeedEvict(s *Stream, d float64) bool {
+	return HlsEvictCheck(s.HlsPlType, s.HlsDvrTime, s.TsNum, s.TsListTime, d)
+}
+
+// hls和dash共用的淘汰规则, num是现有的切片数, listTime是现有切片的总时长(秒)
+func HlsEvictCheck(plType string, dvrTime float64, num uint32, listTime, d float64) bool {
+	if num == 0 {
+		return false
+	}
+	switch plType {
+	case "event":
+		return false
+	case "dvr":
+		return listTime+d > dvrTime
+	}
+	return num >= uint32(conf.HlsM3u8TsNum)
+}
+
+// m3u8头里的 #EXT-X-PLAYLIST-TYPE, live和dvr时为空
+func HlsPlaylistTypeCreate(s *Stream) string {
+	if s.HlsPlType != "event" {
+		return ""
+	}
+	return "\n#EXT-X-PLAYLIST-TYPE:EVENT"
+}
+
+// 发布结束时调用, event的m3u8加上 #EXT-X-ENDLIST, 播放器不再刷新
+// 正在生成的切片和part 不写入m3u8
+func HlsPlaylistEnd(s *Stream) {
+	if s.HlsPlType != "event" || s.TsNum == 0 {
+		return
+	}
+	s.M3u8Data = M3u8Create(s) + "\n#EXT-X-ENDLIST\n"
+	err := HlsFileWrite(s.M3u8Path, []byte(s.M3u8Data))
+	if err != nil {
+		s.logHls.Printf("Write %s fail, %s", s.M3u8Path, err)
+	}
+	HlsVttM3u8Write(s, "\n#EXT-X-ENDLIST\n")
+}
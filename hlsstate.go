@@ -0,0 +1,167 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"path"
+	"sync"
+	"time"
+)
+
+/**********************************************************/
+/* hls state
+/**********************************************************/
+// https://datatracker.ietf.org/doc/html/rfc8216#section-4.3.3.3
+// 发布者断开重连时 会新建Stream, 如果ts序号从0开始, 播放器会看到序号倒退 并且读到缓存里同名的ts
+// 所以发布结束时 按s.Key保存hls的状态, 同一个流再次发布时 接着用
+// 序号接着上次的, 上次还在m3u8里的切片 继续保留, 新切片前加 #EXT-X-DISCONTINUITY
+// 带 #EXT-X-DISCONTINUITY 的切片移出m3u8时, #EXT-X-DISCONTINUITY-SEQUENCE 加1
+// HlsStore为memory时 发布结束会清空内存里的切片, 所以只接着用序号
+// 状态只存在内存里, sms重启后 序号从0开始
+// 超过HlsStateMaxAge没有再次发布的流 删除状态和还保留的切片
+// 新的发布者开始时 上次的HlsCreator()可能还没结束, 要等它保存状态和清理内存后 才能开始
+type HlsState struct {
+	TsFirstSeq uint32
+	TsLastSeq  uint32
+	TsDiscSeq  uint32
+	TsList     *list.List
+	TsNum      uint32
+	TsListTime float64
+	SaveTime   time.Time
+}
+
+type HlsStateStore struct {
+	sync.Mutex
+	States  map[string]HlsState
+	Running map[string]chan bool // 正在运行的HlsCreator(), 结束时close
+}
+
+var HlsStates = HlsStateStore{States: make(map[string]HlsState), Running: make(map[string]chan bool)}
+
+const HlsStateMaxAge = 24 * time.Hour
+
+// HlsCreator()开始时调用, 同一个流上次的HlsCreator()还没结束时 等待它结束
+// 返回的chan 在HlsCreator()结束时 传给HlsStateDone()
+func HlsStateWait(s *Stream) chan bool {
+	done := make(chan bool)
+	HlsStates.Lock()
+	prev := HlsStates.Running[s.Key]
+	HlsStates.Running[s.Key] = done
+	HlsStates.Unlock()
+	if prev != nil {
+		s.logHls.Printf("wait last hls creator of %s stop", s.Key)
+		<-prev
+	}
+	return done
+}
+
+// HlsCreator()结束时调用, 在HlsStateSave()和HlsMemClear()之后
+func HlsStateDone(s *Stream, done chan bool) {
+	HlsStates.Lock()
+	if HlsStates.Running[s.Key] == done {
+		delete(HlsStates.Running, s.Key)
+	}
+	HlsStates.Unlock()
+	close(done)
+}
+
+// 发布结束时调用, 正在生成的切片 不写入m3u8, 但是序号已经用了
+func HlsStateSave(s *Stream) {
+	now := time.Now()
+	HlsStates.Lock()
+	HlsStates.States[s.Key] = HlsState{s.TsFirstSeq, s.TsLastSeq, s.TsDiscSeq, s.TsList, s.TsNum, s.TsListTime, now}
+	var olds []HlsState
+	for k, st := range HlsStates.States {
+		if now.Sub(st.SaveTime) > HlsStateMaxAge {
+			olds = append(olds, st)
+			delete(HlsStates.States, k)
+		}
+	}
+	HlsStates.Unlock()
+	for _, st := range olds {
+		HlsStateRemove(st)
+	}
+}
+
+// 过期的状态 删除还保留的切片 和切片用的key、init.mp4、vtt
+func HlsStateRemove(st HlsState) {
+	for e := st.TsList.Front(); e != nil; e = e.Next() {
+		ti := (e.Value).(TsInfo)
+		HlsFileRemove(ti.TsFilepath)
+		HlsFileRemove(HlsVttPath(ti.TsFilepath))
+		HlsPartRemove(ti)
+		if ti.KeyPath != "" {
+			HlsFileRemove(ti.KeyPath)
+		}
+		if ti.MapPath != "" {
+			HlsFileRemove(ti.MapPath)
+		}
+	}
+}
+
+// HlsCreator()开始时调用, 重新发布时 m3u8里是上次保留的切片, 不能是空文件
+func HlsStateM3u8Write(s *Stream) error {
+	var d []byte
+	if s.TsNum > 0 {
+		s.M3u8Data = M3u8Create(s)
+		d = []byte(s.M3u8Data)
+	}
+	return HlsFileWrite(s.M3u8Path, d)
+}
+
+// HlsCreator()开始时调用, 切片文件已经不存在的 不再保留
+func HlsStateLoad(s *Stream) {
+	HlsStates.Lock()
+	st, ok := HlsStates.States[s.Key]
+	delete(HlsStates.States, s.Key)
+	HlsStates.Unlock()
+	if !ok {
+		return
+	}
+
+	s.TsFirstSeq, s.TsLastSeq, s.TsDiscSeq = st.TsFirstSeq, st.TsLastSeq, st.TsDiscSeq
+	s.TsList, s.TsNum, s.TsListTime = st.TsList, st.TsNum, st.TsListTime
+	for e := s.TsList.Front(); e != nil; e = s.TsList.Front() {
+		ti := (e.Value).(TsInfo)
+		if HlsFileExist(ti.TsFilepath) {
+			break
+		}
+		s.TsList.Remove(e)
+		HlsTsInfoEvict(s, ti)
+	}
+	if s.TsNum == 0 {
+		s.TsFirstSeq = s.TsLastSeq
+	} else {
+		s.TsDisc = true
+	}
+	s.logHls.Printf("hls state restore, seq %d-%d, discontinuity seq %d", s.TsFirstSeq, s.TsLastSeq, s.TsDiscSeq)
+}
+
+// 切片移出m3u8后调用
+func HlsTsInfoEvict(s *Stream, ti TsInfo) {
+	s.TsNum--
+	s.TsFirstSeq++
+	s.TsListTime -= ti.TsExtInfo
+	if ti.Disc {
+		s.TsDiscSeq++
+	}
+}
+
+// m3u8头里的 #EXT-X-DISCONTINUITY-SEQUENCE, 为0时不写
+func HlsDiscSeqCreate(s *Stream) string {
+	if s.TsDiscSeq == 0 {
+		return ""
+	}
+	return fmt.Sprintf("\n#EXT-X-DISCONTINUITY-SEQUENCE:%d", s.TsDiscSeq)
+}
+
+// 重新发布后 或 fmp4的音视频头变了, 第一个切片前 加 #EXT-X-DISCONTINUITY, fmp4时还要换成新的init.mp4
+func HlsDiscTagCreate(s *Stream) string {
+	if !s.TsDisc {
+		return ""
+	}
+	if HlsIsFmp4() && s.HlsInitPath != "" {
+		return fmt.Sprintf("\n#EXT-X-DISCONTINUITY\n#EXT-X-MAP:URI=\"%s\"", path.Base(s.HlsInitPath))
+	}
+	return "\n#EXT-X-DISCONTINUITY"
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"utils"
+)
+
+/**********************************************************/
+/* hls store
+/**********************************************************/
+// HlsStore 决定 m3u8/ts/m4s/mpd 等文件存在哪里
+// disk   存磁盘, http从磁盘读取, 为空时也是disk
+// memory 存内存, http从内存读取, 不写磁盘 适合只读或tmpfs很小的容器
+// both   存内存 也存磁盘, http从内存读取, 磁盘上的文件用于持久化
+// 内存里的key是文件路径 和磁盘上的一样, 淘汰规则和磁盘一样 只保留m3u8里的切片
+type HlsMemStore struct {
+	sync.RWMutex
+	Files map[string][]byte
+}
+
+var HlsMem = HlsMemStore{Files: make(map[string][]byte)}
+
+func HlsStoreIsMem() bool {
+	return conf.HlsStore == "memory" || conf.HlsStore == "both"
+}
+
+func HlsStoreIsDisk() bool {
+	return conf.HlsStore != "memory"
+}
+
+// 磁盘上 先写临时文件再改名, 避免http读到不完整的文件
+func HlsFileWrite(fn string, d []byte) error {
+	if HlsStoreIsMem() {
+		HlsMem.Lock()
+		HlsMem.Files[fn] = d
+		HlsMem.Unlock()
+	}
+	if !HlsStoreIsDisk() {
+		return nil
+	}
+	err := ioutil.WriteFile(fn+".tmp", d, 0644)
+	if err == nil {
+		err = os.Rename(fn+".tmp", fn)
+	}
+	return err
+}
+
+func HlsFileRead(fn string) ([]byte, error) {
+	if !HlsStoreIsMem() {
+		return utils.ReadAllFile(fn)
+	}
+	HlsMem.RLock()
+	d, ok := HlsMem.Files[fn]
+	HlsMem.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%s is not exist", fn)
+	}
+	return d, nil
+}
+
+func HlsFileExist(fn string) bool {
+	if !HlsStoreIsMem() {
+		_, err := os.Stat(fn)
+		return err == nil
+	}
+	HlsMem.RLock()
+	_, ok := HlsMem.Files[fn]
+	HlsMem.RUnlock()
+	return ok
+}
+
+func HlsFileSize(fn string) (int64, error) {
+	if !HlsStoreIsMem() {
+		fi, err := os.Stat(fn)
+		if err != nil {
+			return 0, err
+		}
+		return fi.Size(), nil
+	}
+	HlsMem.RLock()
+	d, ok := HlsMem.Files[fn]
+	HlsMem.RUnlock()
+	if !ok {
+		return 0, fmt.Errorf("%s is not exist", fn)
+	}
+	return int64(len(d)), nil
+}
+
+// 切片移出m3u8时调用, 内存和磁盘上的都删除
+func HlsFileRemove(fn string) {
+	HlsMem.Lock()
+	delete(HlsMem.Files, fn)
+	HlsMem.Unlock()
+	if HlsStoreIsDisk() {
+		os.Remove(fn)
+	}
+}
+
+// 发布者结束时调用, 只删除内存里的, 磁盘上的保留(和原来一样)
+// folder 是 HlsSavePath/live_yuankang
+func HlsMemClear(folder string) {
+	prefix := folder + "/"
+	HlsMem.Lock()
+	for fn := range HlsMem.Files {
+		if strings.HasPrefix(fn, prefix) {
+			delete(HlsMem.Files, fn)
+		}
+	}
+	HlsMem.Unlock()
+}
+
+// 正在生成的切片 写到磁盘文件 和/或 内存, 生成完成后 才放入HlsMem
+func HlsSegOpen(s *Stream) error {
+	s.TsFile, s.TsBuf = nil, nil
+	if HlsStoreIsDisk() {
+		var err error
+		s.TsFile, err = os.OpenFile(s.TsPath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+		if err != nil {
+			return err
+		}
+	}
+	if HlsStoreIsMem() {
+		s.TsBuf = bytes.NewBuffer(nil)
+	}
+	s.TsWriter = HlsSegWriter(s)
+	if err := HlsEncryptSegStart(s); err != nil {
+		HlsSegClose(s)
+		return err
+	}
+	return nil
+}
+
+func HlsSegWriter(s *Stream) io.Writer {
+	switch {
+	case s.TsFile != nil && s.TsBuf != nil:
+		return io.MultiWriter(s.TsFile, s.TsBuf)
+	case s.TsFile != nil:
+		return s.TsFile
+	}
+	return s.TsBuf
+}
+
+func HlsSegClose(s *Stream) {
+	HlsEncryptSegEnd(s)
+	if s.TsFile != nil {
+		s.TsFile.Close()
+		s.TsFile = nil
+	}
+	if s.TsBuf != nil {
+		HlsMem.Lock()
+		HlsMem.Files[s.TsPath] = s.TsBuf.Bytes()
+		HlsMem.Unlock()
+		s.TsBuf = nil
+	}
+}
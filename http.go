@@ -15,6 +15,17 @@ type Rsps struct {
 	Msg  string `json:"msg"`
 }
 
+// 需要返回http状态码的错误, 如ll-hls阻塞请求 参数错误返回400 超时返回503
+// 其他错误 http状态码为200, body里的code为500
+type HttpError struct {
+	Code int
+	Msg  string
+}
+
+func (e *HttpError) Error() string {
+	return e.Msg
+}
+
 func GetRsps(code int, msg string) []byte {
 	r := Rsps{code, msg}
 	d, err := json.Marshal(r)
@@ -33,8 +44,25 @@ func GetVersion(w http.ResponseWriter, r *http.Request) ([]byte, error) {
 }
 
 // GET http://www.domain.com/live/yuankang.flv
+// GET ws://www.domain.com/live/yuankang.flv
+// GET ws://www.domain.com/live/yuankang.flv?publish
+// POST http://www.domain.com/live/yuankang.flv
+// GET http://www.domain.com/live/yuankang/yuankang_20220405102030.flv
+// GET http://www.domain.com/live/yuankang/yuankang_20220405102030.mp4
 // GET http://www.domain.com/live/yuankang.m3u8
+// GET http://www.domain.com/live/yuankang.m3u8?master
+// GET http://www.domain.com/live/yuankang.m3u8?vtt
+// GET http://www.domain.com/live/yuankang.m3u8?start=20220405102030&end=20220405112030
+// GET http://www.domain.com/archive/live/yuankang/yuankang_1649125230123.ts
+// GET http://www.domain.com/live/yuankang.ts
+// GET http://www.domain.com/live/live_yuankang_0_init.mp4
+// GET http://www.domain.com/live/live_yuankang_0.m4s
+// GET http://www.domain.com/live/live_yuankang_0.vtt
+// GET http://www.domain.com/live/yuankang.mpd
+// GET http://www.domain.com/live/live_yuankang_0.key?token=xxx
 // GET http://www.domain.com/api/version
+// POST http://www.domain.com/api/filelive/start?token=xxx
+// POST http://www.domain.com/api/filelive/stop?token=xxx
 func HttpServer(w http.ResponseWriter, r *http.Request) {
 	log.Println("====== new http request ======")
 	log.Println(r.Proto, r.Method, r.URL, r.RemoteAddr, r.Host)
@@ -50,8 +78,20 @@ func HttpServer(w http.ResponseWriter, r *http.Request) {
 				log.Println(err)
 				goto ERR
 			}
+		} else if app, fn, ok := HlsArchiveFilename(r.URL.Path); ok {
+			GetHlsArchive(w, r, app, fn)
+			return
+		} else if fn, ok := VodHttpFilename(r.URL.Path); ok && !WsIsUpgrade(r) {
+			GetVod(w, r, fn)
+			return
 		} else if strings.Contains(r.URL.String(), ".flv") {
-			GetFlv(w, r)
+			if _, ok := r.URL.Query()["publish"]; ok && WsIsUpgrade(r) {
+				GetWsFlvPublish(w, r)
+			} else if WsIsUpgrade(r) {
+				GetWsFlv(w, r)
+			} else {
+				GetFlv(w, r)
+			}
 			return
 		} else if strings.Contains(r.URL.String(), ".m3u8") {
 			rsps, err = GetM3u8(w, r)
@@ -61,6 +101,33 @@ func HttpServer(w http.ResponseWriter, r *http.Request) {
 			}
 			// safari地址栏输入播放地址  必须有这个 才能播放
 			w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		} else if strings.HasSuffix(r.URL.Path, ".key") {
+			GetHlsKey(w, r)
+			return
+		} else if strings.HasSuffix(r.URL.Path, ".mpd") {
+			rsps, err = GetMpd(w, r)
+			if err != nil {
+				log.Println(err)
+				goto ERR
+			}
+			w.Header().Set("Content-Type", "application/dash+xml")
+		} else if p, ok := TsLivePublisherGet(r.URL.Path); ok {
+			GetTsLive(w, r, p)
+			return
+		} else if strings.HasSuffix(r.URL.Path, ".m4s") || strings.HasSuffix(r.URL.Path, "_init.mp4") {
+			rsps, err = GetTs(w, r)
+			if err != nil {
+				log.Println(err)
+				goto ERR
+			}
+			w.Header().Set("Content-Type", "video/mp4")
+		} else if strings.HasSuffix(r.URL.Path, ".vtt") {
+			rsps, err = GetTs(w, r)
+			if err != nil {
+				log.Println(err)
+				goto ERR
+			}
+			w.Header().Set("Content-Type", "text/vtt")
 		} else if strings.Contains(r.URL.String(), ".ts") {
 			rsps, err = GetTs(w, r)
 			if err != nil {
@@ -73,15 +140,37 @@ func HttpServer(w http.ResponseWriter, r *http.Request) {
 			goto ERR
 		}
 	} else if r.Method == "POST" {
-		d, err := ioutil.ReadAll(r.Body)
+		// http-flv推流, body是持续不断的flv数据 不能一次读完
+		if strings.HasSuffix(r.URL.Path, ".flv") {
+			PostFlv(w, r)
+			return
+		}
+
+		var d []byte
+		d, err = ioutil.ReadAll(r.Body)
 		if err != nil {
 			log.Println(err)
 			goto ERR
 		}
 		log.Println(string(d))
 
-		err = fmt.Errorf("undefined POST request")
-		goto ERR
+		if strings.Contains(r.URL.String(), "/api/filelive/") {
+			if err = FileLiveTokenCheck(r); err != nil {
+				log.Println(err)
+				goto ERR
+			}
+		}
+		if strings.Contains(r.URL.String(), "/api/filelive/start") {
+			rsps, err = FileLiveStartApi(d)
+		} else if strings.Contains(r.URL.String(), "/api/filelive/stop") {
+			rsps, err = FileLiveStopApi(d)
+		} else {
+			err = fmt.Errorf("undefined POST request")
+		}
+		if err != nil {
+			log.Println(err)
+			goto ERR
+		}
 	}
 
 	w.Header().Set("Access-Control-Allow-Origin", "*")
@@ -92,9 +181,16 @@ func HttpServer(w http.ResponseWriter, r *http.Request) {
 	return
 ERR:
 	//w.WriteHeader(500)
-	rsps = GetRsps(500, err.Error())
+	code := 500
+	if he, ok := err.(*HttpError); ok {
+		code = he.Code
+	}
+	rsps = GetRsps(code, err.Error())
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Content-length", strconv.Itoa(len(rsps)))
 	w.Header().Set("Server", AppName)
+	if code != 500 {
+		w.WriteHeader(code)
+	}
 	w.Write(rsps)
 }
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+/**********************************************************/
+/* http-ts
+/**********************************************************/
+// 机顶盒和vlc 更喜欢连续的ts流, 而不是hls
+// GET http://www.domain.com/live/yuankang.ts
+// hls的ts地址是 /live/live_yuankang_0.ts, 用Publishers里是否有发布者来区分
+// 每个播放者 有自己的ContinuityCounter, sps/pps, adts, 复用hls的ts封装函数
+// /live/yuankang.ts 对应的发布者存在时 返回发布者
+func TsLivePublisherGet(url string) (*Stream, bool) {
+	ss := strings.Split(strings.TrimPrefix(url, "/"), "/")
+	if len(ss) != 2 || !strings.HasSuffix(ss[1], ".ts") {
+		return nil, false
+	}
+	key := fmt.Sprintf("%s_%s", ss[0], strings.TrimSuffix(ss[1], ".ts"))
+	p, ok := PublisherGet(key)
+	return p, ok
+}
+
+// 和GetFlv()一样, 播放者存入发布者的Players里, 由发布者的发送协程写数据
+func GetTsLive(w http.ResponseWriter, r *http.Request, p *Stream) {
+	s := NewStream(nil)
+	s.StreamType = "tsPlayer"
+	s.AmfInfo.App = p.AmfInfo.App
+	s.AmfInfo.StreamName = p.AmfInfo.StreamName
+	s.RemoteAddr = r.RemoteAddr
+	s.IsPublisher = false
+	s.TsWriter = w
+	s.HttpDone = make(chan bool, 1)
+
+	s.log.Printf("---> the stream is publisher %t", s.IsPublisher)
+	StreamLogRename(s, "ts")
+	s.logHls = s.log // ts封装函数里用logHls打印日志
+
+	s.Key = fmt.Sprintf("%s_%s_%s", s.AmfInfo.App,
+		s.AmfInfo.StreamName, s.RemoteAddr)
+	s.log.Println("player key is", s.Key)
+
+	// 不设置Content-length, 会使用chunked方式发送
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Connection", "Keep-Alive")
+	w.Header().Set("Content-Type", "video/mp2t")
+	w.Header().Set("Server", AppName)
+	w.WriteHeader(http.StatusOK)
+	TsFlush(s)
+
+	PlayerAdd(p, s)
+	select {
+	case <-s.HttpDone:
+	case <-r.Context().Done():
+	}
+	// 删除后 发送协程就不会再写http.ResponseWriter了
+	PlayerDelete(p, s)
+	s.log.Printf("%s TsPlayer stop", s.Key)
+}
+
+// 新播放者 先准备sps/pps和adts, 再发送缓存的gop
+func GopCacheSendTs(s *Stream, gop *GopCache) error {
+	if gop.VideoHeader != nil {
+		MessageSendTs(s, gop.VideoHeader)
+	}
+	if gop.AudioHeader != nil {
+		MessageSendTs(s, gop.AudioHeader)
+	}
+
+	s.log.Println("@@@ GopCache.MediaData len", gop.MediaData.Len())
+	for e := gop.MediaData.Front(); e != nil; e = e.Next() {
+		if err := MessageSendTs(s, (e.Value).(*Chunk)); err != nil {
+			s.log.Println(err)
+			return err
+		}
+	}
+	s.log.Println("@@@ GopCacheSendTs() ok")
+	return nil
+}
+
+// 有视频时 从关键帧开始发送, 关键帧前 和 每隔TsPatPmtInterval 发送pat/pmt, 见TsPatPmtCheck()
+func MessageSendTs(s *Stream, c *Chunk) error {
+	switch c.DataType {
+	case "Metadata":
+		return nil
+	case "VideoHeader":
+		PrepareSpsPpsData(s, c)
+		return nil
+	case "AudioHeader":
+		PrepareAdtsData(s, c)
+		ParseAdtsData(s)
+		return nil
+	case "AudioAacFrame":
+		if s.AdtsData == nil { // 还没收到AudioHeader
+			return nil
+		}
+	case "AudioFrame": // MP3和G.711没有AudioHeader
+		TsAudioTypeUpdate(s, c)
+	case "VideoKeyFrame", "VideoInterFrame":
+		if s.SpsPpsData == nil { // 还没收到VideoHeader
+			return nil
+		}
+	default:
+		return nil
+	}
+
+	if !s.TsStarted {
+		if s.SpsPpsData != nil && c.DataType != "VideoKeyFrame" {
+			return nil
+		}
+		s.TsStarted = true
+	}
+
+	// pat/pmt 在TsFileAppend()里写
+	if err := TsFileAppend(s, c); err != nil {
+		return err
+	}
+	TsFlush(s)
+	return nil
+}
+
+// 每帧数据写完 马上发送
+func TsFlush(s *Stream) {
+	if f, ok := s.TsWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
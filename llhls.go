@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**********************************************************/
+/* ll-hls
+/**********************************************************/
+// https://datatracker.ietf.org/doc/html/draft-pantos-hls-rfc8216bis
+// HlsPartTime > 0 时开启, ts在生成的同时 按HlsPartTime切成part
+// part文件名为 live_yuankang_8.3.ts, 表示第8个ts的第3个part, fmp4时为 live_yuankang_8.3.m4s
+// m3u8里 最近2个ts和当前ts 列出part, 最后是下一个part的PRELOAD-HINT
+// GET /live/yuankang.m3u8?_HLS_msn=8&_HLS_part=3 阻塞到m3u8里有这个part
+// GET /live/live_yuankang_8.4.ts 还没生成时 阻塞到生成
+type LlHlsInfo struct {
+	PartFirstTs     uint32        // 当前part中第一个时间戳
+	PartLastTs      uint32        // 当前part中最后一个时间戳
+	PartSeq         uint32        // 当前part在ts里的序号, 从0开始
+	PartIndependent bool          // 当前part是否以关键帧开始
+	PartData        *bytes.Buffer // 当前part的内容, 完成后写入文件
+	PartList        []HlsPart     // 当前ts里已完成的part
+	HlsLock         sync.Mutex    // M3u8Msn/M3u8Part/M3u8Notify 和HlsMasterInfo 会被http协程读取
+	M3u8Msn         uint32        // 正在生成的ts的序号
+	M3u8Part        uint32        // 正在生成的ts里 已完成的part个数
+	M3u8Notify      chan bool     // m3u8更新时close, 通知阻塞的http请求
+}
+
+type HlsPart struct {
+	Path        string  // part存储路径 包含文件名
+	Duration    float64 // 单位为秒
+	Independent bool    // 以关键帧开始, 可以独立解码
+}
+
+var m3u8LlHead = `#EXTM3U
+#EXT-X-VERSION:6
+#EXT-X-TARGETDURATION:%d
+#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.3f
+#EXT-X-PART-INF:PART-TARGET=%.3f
+#EXT-X-MEDIA-SEQUENCE:%d`
+
+func LlHlsInit(s *Stream) {
+	s.PartData = bytes.NewBuffer(nil)
+	s.HlsLock.Lock()
+	if s.M3u8Notify == nil { // 按需生成 再次开始时 http协程可能在等待
+		s.M3u8Notify = make(chan bool)
+	}
+	s.HlsLock.Unlock()
+}
+
+// 新ts的第一个part, TsFileCreate()里调用
+func HlsPartTsStart(s *Stream, c *Chunk) {
+	s.PartSeq = 0
+	s.PartList = nil
+	HlsPartStart(s, c)
+}
+
+// c是part里的第一个数据
+func HlsPartStart(s *Stream, c *Chunk) {
+	s.PartFirstTs = c.Timestamp
+	s.PartLastTs = c.Timestamp
+	s.PartIndependent = c.DataType == "VideoKeyFrame" || s.SpsPpsData == nil
+	s.PartData.Reset()
+	s.TsWriter = io.MultiWriter(HlsSegWriter(s), s.PartData)
+}
+
+// 加上c的时长会超过HlsPartTime时 在c之前截断part
+func HlsPartNeedCut(s *Stream, c *Chunk) bool {
+	if s.PartData.Len() == 0 {
+		return false
+	}
+	return HlsPartIsFull(s, c)
+}
+
+// c的时长 用前后两帧的间隔估算
+func HlsPartIsFull(s *Stream, c *Chunk) bool {
+	gap := c.Timestamp - s.PartLastTs
+	return c.Timestamp-s.PartFirstTs+gap > conf.HlsPartTime
+}
+
+// c是下一个part的第一个数据, 也可能是下一个ts的第一个数据
+func HlsPartEnd(s *Stream, c *Chunk) {
+	if s.PartData.Len() == 0 {
+		return
+	}
+	ext := path.Ext(s.TsPath)
+	fn := fmt.Sprintf("%s.%d%s", strings.TrimSuffix(s.TsPath, ext), s.PartSeq, ext)
+	// PartData会复用, 要拷贝一份
+	d := append([]byte(nil), s.PartData.Bytes()...)
+	if err := HlsFileWrite(fn, d); err != nil {
+		s.logHls.Println(err)
+	}
+
+	p := HlsPart{fn, float64(c.Timestamp-s.PartFirstTs) / 1000, s.PartIndependent}
+	s.logHls.Printf("part %s, duration %.3f, independent %t", p.Path, p.Duration, p.Independent)
+	s.PartList = append(s.PartList, p)
+	s.PartSeq++
+	s.PartData.Reset()
+}
+
+// 写入ts数据前调用, 需要时截断part 并更新m3u8
+func HlsPartAppend(s *Stream, c *Chunk) {
+	if HlsPartNeedCut(s, c) {
+		HlsPartEnd(s, c)
+		HlsPartStart(s, c)
+		M3u8LlUpdate(s)
+	}
+	s.PartLastTs = c.Timestamp
+}
+
+func HlsPartRemove(ti TsInfo) {
+	for _, p := range ti.Parts {
+		HlsFileRemove(p.Path)
+	}
+}
+
+// 最近2个ts 和 当前ts 列出part
+func M3u8LlCreate(s *Stream) string {
+	var tsMaxTime float64
+	var tis string
+	i, n := 0, s.TsList.Len()
+	for e := s.TsList.Front(); e != nil; e = e.Next() {
+		ti := (e.Value).(TsInfo)
+		if tsMaxTime < ti.TsExtInfo {
+			tsMaxTime = ti.TsExtInfo
+		}
+		tis += ti.TagStr
+		if i >= n-2 {
+			tis += M3u8PartCreate(ti.Parts)
+		}
+		tis = fmt.Sprintf("%s\n%s", tis, ti.TsInfoStr)
+		i++
+	}
+	tis += HlsSegTagCreate(s)
+	tis += M3u8PartCreate(s.PartList)
+	ext := path.Ext(s.TsPath)
+	next := fmt.Sprintf("%s.%d%s", strings.TrimSuffix(path.Base(s.TsPath), ext), s.PartSeq, ext)
+	tis += fmt.Sprintf("\n#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"%s\"", next)
+
+	td := uint32(math.Ceil(tsMaxTime))
+	if td == 0 {
+		td = conf.HlsTsMaxTime
+	}
+	pt := float64(conf.HlsPartTime) / 1000
+	m3u8 := fmt.Sprintf(m3u8LlHead, td, 3*pt, pt, s.TsFirstSeq)
+	m3u8 += HlsDiscSeqCreate(s)
+	m3u8 += HlsPlaylistTypeCreate(s)
+	m3u8 += HlsMapCreate(s)
+	return fmt.Sprintf("%s%s\n", m3u8, tis)
+}
+
+func M3u8PartCreate(parts []HlsPart) string {
+	var s string
+	for _, p := range parts {
+		s += fmt.Sprintf("\n#EXT-X-PART:DURATION=%.3f,URI=\"%s\"", p.Duration, path.Base(p.Path))
+		if p.Independent {
+			s += ",INDEPENDENT=YES"
+		}
+	}
+	return s
+}
+
+// 写完后 通知阻塞的http请求
+func M3u8LlUpdate(s *Stream) {
+	s.M3u8Data = M3u8LlCreate(s)
+	err := HlsFileWrite(s.M3u8Path, []byte(s.M3u8Data))
+	if err != nil {
+		s.logHls.Printf("Write %s fail, %s", s.M3u8Path, err)
+		return
+	}
+
+	s.HlsLock.Lock()
+	s.M3u8Msn = s.TsLastSeq - 1
+	s.M3u8Part = s.PartSeq
+	close(s.M3u8Notify)
+	s.M3u8Notify = make(chan bool)
+	s.HlsLock.Unlock()
+	HlsOnDemandReady(s)
+}
+
+// 等待m3u8更新, 超时返回false
+func M3u8LlWaitNotify(s *Stream, timeout <-chan time.Time) bool {
+	s.HlsLock.Lock()
+	ch := s.M3u8Notify
+	s.HlsLock.Unlock()
+	if ch == nil {
+		return false
+	}
+	select {
+	case <-ch:
+		return true
+	case <-timeout:
+		return false
+	}
+}
+
+// 阻塞的最长时间 是3倍的ts时长
+func LlHlsTimeout() <-chan time.Time {
+	return time.After(3 * time.Duration(conf.HlsTsMaxTime) * time.Second)
+}
+
+// _HLS_msn=M&_HLS_part=N, m3u8里有第M个ts的第N个part 或 更新的 才返回
+// 只有_HLS_msn时, m3u8里有完整的第M个ts 才返回
+// 参数错误 或 太远的请求 返回400, 超时返回503
+func M3u8LlWait(app, stream string, r *http.Request) error {
+	q := r.URL.Query()
+	if q.Get("_HLS_msn") == "" {
+		return nil
+	}
+	msn, err := strconv.ParseUint(q.Get("_HLS_msn"), 10, 32)
+	if err != nil {
+		return &HttpError{400, fmt.Sprintf("invalid _HLS_msn %s", q.Get("_HLS_msn"))}
+	}
+	part := int64(-1)
+	if q.Get("_HLS_part") != "" {
+		part, err = strconv.ParseInt(q.Get("_HLS_part"), 10, 32)
+		if err != nil || part < 0 {
+			return &HttpError{400, fmt.Sprintf("invalid _HLS_part %s", q.Get("_HLS_part"))}
+		}
+	}
+
+	s, ok := PublisherGet(fmt.Sprintf("%s_%s", app, stream))
+	if !ok {
+		return nil
+	}
+
+	timeout := LlHlsTimeout()
+	for {
+		s.HlsLock.Lock()
+		curMsn, curPart := uint64(s.M3u8Msn), int64(s.M3u8Part)
+		s.HlsLock.Unlock()
+
+		if msn > curMsn+2 { // 太远的请求 不等待
+			return &HttpError{400, fmt.Sprintf("_HLS_msn %d is too far, current is %d", msn, curMsn)}
+		}
+		if msn < curMsn || (msn == curMsn && part >= 0 && part < curPart) {
+			return nil
+		}
+		if !M3u8LlWaitNotify(s, timeout) {
+			return &HttpError{503, fmt.Sprintf("wait _HLS_msn %d _HLS_part %d timeout", msn, part)}
+		}
+	}
+}
+
+// PRELOAD-HINT的part 请求时还没生成, 等到生成后再返回
+// 只等待 正在生成的ts和下一个ts 的part, 已删除的ts和part 直接返回
+func HlsPartWait(app, stream, file string) {
+	s, ok := PublisherGet(fmt.Sprintf("%s_%s", app, stream))
+	if !ok {
+		return
+	}
+	// live_yuankang_8.3 -> 8.3 -> 8
+	base := strings.TrimSuffix(path.Base(file), path.Ext(file))
+	ss := strings.Split(base[strings.LastIndex(base, "_")+1:], ".")
+	if len(ss) != 2 {
+		return
+	}
+	seq, err := strconv.ParseUint(ss[0], 10, 32)
+	if err != nil {
+		return
+	}
+	s.HlsLock.Lock()
+	curMsn := uint64(s.M3u8Msn)
+	s.HlsLock.Unlock()
+	if seq < curMsn || seq > curMsn+1 {
+		return
+	}
+
+	timeout := LlHlsTimeout()
+	for {
+		if HlsFileExist(file) {
+			return
+		}
+		if !M3u8LlWaitNotify(s, timeout) {
+			return
+		}
+	}
+}
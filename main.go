@@ -9,6 +9,7 @@ import (
 	"os"
 	"os/signal"
 	"runtime"
+	"sync"
 	"syscall"
 	"utils"
 
@@ -30,10 +31,11 @@ const (
 //http://c.biancheng.net/view/34.html
 //https://blog.csdn.net/u010230794/article/details/82143179
 var (
-	h, v, d, u bool
-	c          string
-	conf       Config
-	Publishers map[string]*Stream // App_PublishName
+	h, v, d, u     bool
+	c              string
+	conf           Config
+	Publishers     map[string]*Stream // App_PublishName
+	PublishersLock sync.RWMutex       // 读取用PublisherGet()
 )
 
 // json嵌套的解析 有2点要注意 否则 获取不到内层json的值
@@ -55,10 +57,133 @@ type Config struct {
 	LogStreamPath string
 	HlsM3u8TsNum  uint32
 	HlsTsMaxTime  uint32
+	HlsPartTime   uint32 // 单位为毫秒, 0表示不开启ll-hls
+	HlsFormat     string // ts 或 fmp4, 为空时是ts
+	DashEnable    bool   // 生成dash, 切片规则和hls一样
+	HlsStore      string // disk 或 memory 或 both, 为空时是disk
 	HlsSavePath   string
+	HlsEncrypt    HlsEncrypt
+	HlsPlaylist   HlsPlaylist
+	HlsArchive    HlsArchive
+	HlsMaster     HlsMaster
+	HlsTimedMeta  HlsTimedMeta
+	HlsCaption    HlsCaption
+	HlsOnDemand   HlsOnDemand
+	Record        Record
+	Vod           Vod
+	FileLive      []FileLive
+	FileLivePath  string // 接口开启的文件 必须在这个目录下, 为空时使用Vod.Path
+	FileLiveToken string // 接口的token参数 必须相同, 为空时 接口不能用
 	Gb28181       Gb28181
 }
 
+type Record struct {
+	Enable     bool
+	SavePath   string
+	MaxAge     int // 单位为天, 0表示不按时间删除
+	MaxDiskUse int // 单位为MB, 0表示不按大小删除
+	Rules      []RecordRule
+}
+
+// App为*表示匹配所有app
+type RecordRule struct {
+	App         string
+	Flv         bool
+	Mp4         bool   // 录制为fmp4
+	Mp4Finalize bool   // 录制结束后 fmp4转为普通mp4
+	SegmentTime uint32 // 单位为秒, 0表示不按时长分割
+	SegmentSize uint32 // 单位为MB, 0表示不按大小分割
+}
+
+type HlsEncrypt struct {
+	Enable bool
+	Rules  []HlsEncryptRule
+}
+
+// App为*表示匹配所有app
+type HlsEncryptRule struct {
+	App       string
+	Method    string // AES-128 或 SAMPLE-AES
+	KeyRotate uint32 // 每KeyRotate个切片换一次key, 0表示不换
+	KeyToken  string // 请求key时 token参数必须相同, 为空时不验证
+}
+
+type HlsPlaylist struct {
+	Enable bool
+	Rules  []HlsPlaylistRule
+}
+
+// App为*表示匹配所有app, 没有匹配的规则时为live
+type HlsPlaylistRule struct {
+	App        string
+	Type       string // live 或 event 或 dvr
+	DvrMinutes uint32 // dvr时 m3u8里保留多少分钟的切片
+}
+
+type HlsArchive struct {
+	Enable   bool
+	SavePath string
+	MaxAge   int // 单位为天, 0表示不删除
+	Rules    []HlsArchiveRule
+}
+
+// App为*表示匹配所有app
+type HlsArchiveRule struct {
+	App string
+}
+
+type HlsMaster struct {
+	Enable bool
+	Groups []HlsMasterGroup
+}
+
+// App为*表示匹配所有app, Suffixes的顺序 就是master里的顺序
+// 如Suffixes为["_1080", "_720"], 发布者name_1080和name_720 组成/live/name.m3u8
+type HlsMasterGroup struct {
+	App      string
+	Suffixes []string
+}
+
+// CueTag为cue 或 daterange, 为空时是cue
+type HlsTimedMeta struct {
+	Enable bool
+	CueTag string
+}
+
+// Language为字幕的语言 如en, 为空时不写; WebVtt为true时 608字幕(CC1)转为webvtt字幕
+type HlsCaption struct {
+	Enable   bool
+	Language string
+	WebVtt   bool
+}
+
+// IdleTime单位为秒, 超过IdleTime 没有m3u8和切片请求 停止生成hls, 0表示60秒
+// WaitTime单位为秒, m3u8请求 最多等待WaitTime 到m3u8里有切片, 0表示3倍的ts时长
+type HlsOnDemand struct {
+	Enable   bool
+	IdleTime uint32
+	WaitTime uint32
+	Rules    []HlsOnDemandRule
+}
+
+// App为*表示匹配所有app
+type HlsOnDemandRule struct {
+	App string
+}
+
+// Path为空时 使用录制文件的路径
+type Vod struct {
+	Enable bool
+	Path   string
+}
+
+// File为flv/mp4文件, 相对路径是相对于WorkDir
+type FileLive struct {
+	App    string
+	Stream string
+	File   string
+}
+
 type Gb28181 struct {
 	Enable     bool
 	SipListen  string
@@ -66,6 +191,17 @@ type Gb28181 struct {
 	RtcpListen string
 }
 
+// 各个按app配置的规则 都用这个查找, ruleApp返回第i条规则的App, App为*表示匹配所有app
+// 返回第一条匹配的规则的下标, 没有时返回-1
+func AppRuleFind(n int, app string, ruleApp func(i int) string) int {
+	for i := 0; i < n; i++ {
+		if a := ruleApp(i); a == app || a == "*" {
+			return i
+		}
+	}
+	return -1
+}
+
 func InitConf(file string) {
 	s, err := utils.ReadAllFile(file)
 	if err != nil {
@@ -89,6 +225,18 @@ func InitConf(file string) {
 	conf.LogFile = fmt.Sprintf("%s/%s", conf.WorkDir, conf.LogFile)
 	conf.LogStreamPath = fmt.Sprintf("%s/%s", conf.WorkDir, conf.LogStreamPath)
 	conf.HlsSavePath = fmt.Sprintf("%s/%s", conf.WorkDir, conf.HlsSavePath)
+	conf.HlsArchive.SavePath = fmt.Sprintf("%s/%s", conf.WorkDir, conf.HlsArchive.SavePath)
+	conf.Record.SavePath = fmt.Sprintf("%s/%s", conf.WorkDir, conf.Record.SavePath)
+	if conf.Vod.Path == "" {
+		conf.Vod.Path = conf.Record.SavePath
+	} else {
+		conf.Vod.Path = fmt.Sprintf("%s/%s", conf.WorkDir, conf.Vod.Path)
+	}
+	if conf.FileLivePath == "" {
+		conf.FileLivePath = conf.Vod.Path
+	} else {
+		conf.FileLivePath = fmt.Sprintf("%s/%s", conf.WorkDir, conf.FileLivePath)
+	}
 }
 
 func InitLog(file string) {
@@ -134,6 +282,17 @@ func (p *program) run() {
 
 	go RtmpServer()
 	go SipServer()
+	if conf.Record.Enable {
+		go RecordCleaner()
+	}
+	if conf.HlsArchive.Enable {
+		go HlsArchiveCleaner()
+	}
+	for _, fl := range conf.FileLive {
+		if err := FileLiveStart(fl); err != nil {
+			log.Println(err)
+		}
+	}
 
 	http.HandleFunc("/", HttpServer)
 
@@ -0,0 +1,1212 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+/**********************************************************/
+/* mp4 box
+/**********************************************************/
+// mp4文件由box组成, box = size(4) + type(4) + payload
+// fullbox = size(4) + type(4) + version(1) + flags(3) + payload
+// 普通mp4: ftyp + moov + mdat, moov里有所有sample的索引, 录制结束才能生成
+// fmp4: ftyp + moov(mvex) + moof + mdat + moof + mdat ...
+// fmp4的每个moof+mdat都是完整的, 程序崩溃只会丢失最后一个fragment
+// ISO/IEC 14496-12 (ISO base media file format)
+// ISO/IEC 14496-14 (MP4 file format)
+// ISO/IEC 14496-15 (AVC/HEVC file format)
+func Mp4Box(typ string, payload ...[]byte) []byte {
+	size := 8
+	for _, p := range payload {
+		size += len(p)
+	}
+	buf := make([]byte, 8, size)
+	Uint32ToByte(uint32(size), buf[0:4], BE)
+	copy(buf[4:8], typ)
+	for _, p := range payload {
+		buf = append(buf, p...)
+	}
+	return buf
+}
+
+func Mp4FullBox(typ string, version uint8, flags uint32, payload ...[]byte) []byte {
+	vf := Uint32ToByte(uint32(version)<<24|(flags&0xffffff), nil, BE)
+	return Mp4Box(typ, append([][]byte{vf}, payload...)...)
+}
+
+// 单位矩阵, tkhd和mvhd里要用
+var Mp4Matrix = []uint32{
+	0x00010000, 0, 0,
+	0, 0x00010000, 0,
+	0, 0, 0x40000000,
+}
+
+// sample_flags
+// 关键帧: sample_depends_on=2(不依赖其他帧)
+// 非关键帧: sample_depends_on=1(依赖其他帧), sample_is_non_sync_sample=1
+const (
+	Mp4SampleFlagKey    = 0x02000000
+	Mp4SampleFlagNonKey = 0x01010000
+)
+
+// 解析mp4文件时 一个track最多的sample个数, 30fps时 约6天
+const Mp4SampleMaxNum = 1 << 24
+
+/**********************************************************/
+/* mp4 muxer
+/**********************************************************/
+type Mp4Sample struct {
+	Dts      uint64 // 单位是track的Timescale
+	Duration uint32 // 单位是track的Timescale
+	Cts      int32  // pts - dts, 单位是track的Timescale
+	Size     uint32
+	KeyFrame bool
+	Offset   int64  // sample数据在文件中的位置
+	Data     []byte // sample数据, 写入fragment后就不保存了
+}
+
+type Mp4Track struct {
+	TrackId      uint32
+	Handler      string // vide / soun
+	Timescale    uint32 // 视频90000, 音频为采样率
+	Config       []byte // avcC 或 hvcC 或 AudioSpecificConfig
+	Width        uint32
+	Height       uint32
+	SampleRate   uint32
+	ChannelNum   uint16
+	Codec        string      // avc1.4d401f / hvc1.1.6.L93.90 / mp4a.40.2, hls和dash要用
+	Samples      []Mp4Sample // 还没写入fragment的sample
+	AllSamples   []Mp4Sample // 已写入fragment的sample, 只有KeepAll时才保存
+	LastDuration uint32      // 最后一个sample的时长 无法计算, 用前一个的
+	Duration     uint64      // 已写入fragment的总时长
+}
+
+// 视频支持h264(avc1)和h265(hvc1), 音频只支持aac
+type Mp4Muxer struct {
+	Video   *Mp4Track
+	Audio   *Mp4Track
+	SeqNum  uint32 // moof的序号, 从1开始
+	KeepAll bool   // 保存所有sample的索引, 生成普通mp4时要用
+}
+
+// vh 是VideoHeader, ah 是AudioHeader, 可以有一个为nil
+func Mp4MuxerNew(vh, ah *Chunk) (*Mp4Muxer, error) {
+	m := &Mp4Muxer{SeqNum: 1}
+	var id uint32 = 1
+	if vh != nil && len(vh.MsgData) > 0 && vh.MsgData[0]&0xf == 12 {
+		HevcC, err := HevcCParse(vh.MsgData)
+		if err != nil {
+			return nil, err
+		}
+		t := &Mp4Track{
+			TrackId:      id,
+			Handler:      "vide",
+			Timescale:    90000,
+			Config:       Mp4HvcCComplete(vh.MsgData[5:]),
+			LastDuration: 3600, // 25fps
+		}
+		t.Codec = HevcCodecCreate(HevcC)
+		sps, err := HevcSpsParse(NaluUnescape(HevcC.SpsData))
+		if err == nil {
+			t.Width = sps.Width
+			t.Height = sps.Height
+		}
+		m.Video = t
+		id++
+	} else if vh != nil {
+		AvcC, err := AvcCParse(vh.MsgData)
+		if err != nil {
+			return nil, err
+		}
+		t := &Mp4Track{
+			TrackId:      id,
+			Handler:      "vide",
+			Timescale:    90000,
+			Config:       vh.MsgData[5:],
+			LastDuration: 3600, // 25fps
+		}
+		t.Codec = fmt.Sprintf("avc1.%02x%02x%02x", AvcC.AVCProfileIndication,
+			AvcC.ProfileCompatibility, AvcC.AVCLevelIndication)
+		sps, err := SpsParse(NaluUnescape(AvcC.SpsData))
+		if err == nil {
+			t.Width = sps.Width
+			t.Height = sps.Height
+		}
+		m.Video = t
+		id++
+	}
+	if ah != nil {
+		AacC, err := AudioSpecificConfigParse(ah.MsgData)
+		if err != nil {
+			return nil, err
+		}
+		t := &Mp4Track{
+			TrackId:      id,
+			Handler:      "soun",
+			Config:       ah.MsgData[2:],
+			SampleRate:   AacSampleRates[AacC.SamplingIdx],
+			ChannelNum:   uint16(AacC.ChannelNum),
+			LastDuration: 1024,
+		}
+		t.Timescale = t.SampleRate
+		t.Codec = fmt.Sprintf("mp4a.40.%d", AacC.ObjectType)
+		m.Audio = t
+	}
+	if m.Video == nil && m.Audio == nil {
+		return nil, fmt.Errorf("no video header and no audio header")
+	}
+	return m, nil
+}
+
+func Mp4TrackIsHevc(t *Mp4Track) bool {
+	return strings.HasPrefix(t.Codec, "hvc1") || strings.HasPrefix(t.Codec, "hev1")
+}
+
+// hvc1要求 vps/sps/pps只在hvcC里, 且array_completeness为1
+// 返回的是副本, 不修改VideoHeader
+func Mp4HvcCComplete(d []byte) []byte {
+	c := append([]byte(nil), d...)
+	if len(c) < 23 {
+		return c
+	}
+	p := c[23:]
+	for i := 0; i < int(c[22]) && len(p) >= 3; i++ {
+		if t := p[0] & 0x3f; t >= 32 && t <= 34 {
+			p[0] |= 0x80
+		}
+		n := int(ByteToUint16(p[1:3], BE))
+		p = p[3:]
+		for j := 0; j < n && len(p) >= 2; j++ {
+			size := int(ByteToUint16(p[0:2], BE))
+			if size > len(p)-2 {
+				return c
+			}
+			p = p[2+size:]
+		}
+	}
+	return c
+}
+
+// 去掉sample里的vps/sps/pps(nalu type 32-34), 编码器通常在关键帧前 带上这些
+// 没有时 直接返回d, 有时 返回新的[]byte
+func Mp4HevcParamStrip(d []byte) []byte {
+	var out []byte
+	for p := d; len(p) >= 4; {
+		n := int(ByteToUint32(p[:4], BE))
+		if n > len(p)-4 {
+			break
+		}
+		if t := (p[4] >> 1) & 0x3f; n > 0 && t >= 32 && t <= 34 {
+			if out == nil {
+				out = append(make([]byte, 0, len(d)), d[:len(d)-len(p)]...)
+			}
+		} else if out != nil {
+			out = append(out, p[:4+n]...)
+		}
+		p = p[4+n:]
+	}
+	if out == nil {
+		return d
+	}
+	return out
+}
+
+func Mp4Tracks(m *Mp4Muxer) []*Mp4Track {
+	var ts []*Mp4Track
+	if m.Video != nil {
+		ts = append(ts, m.Video)
+	}
+	if m.Audio != nil {
+		ts = append(ts, m.Audio)
+	}
+	return ts
+}
+
+// ts 是毫秒时间戳, 由调用者决定从几开始
+func Mp4SampleAdd(m *Mp4Muxer, c *Chunk, ts uint32) {
+	var t *Mp4Track
+	var sp Mp4Sample
+	switch c.MsgTypeId {
+	case MsgTypeIdVideo:
+		if m.Video == nil || len(c.MsgData) <= 5 {
+			return
+		}
+		t = m.Video
+		sp.Dts = uint64(ts) * H264ClockFrequency
+		sp.Cts = ByteToInt24(c.MsgData[2:5], BE) * H264ClockFrequency
+		sp.KeyFrame = c.DataType == "VideoKeyFrame"
+		sp.Data = c.MsgData[5:]
+		if Mp4TrackIsHevc(t) {
+			sp.Data = Mp4HevcParamStrip(sp.Data)
+		}
+	case MsgTypeIdAudio:
+		if m.Audio == nil || len(c.MsgData) <= 2 {
+			return
+		}
+		t = m.Audio
+		sp.Dts = uint64(ts) * uint64(t.SampleRate) / 1000
+		sp.KeyFrame = true
+		sp.Data = c.MsgData[2:]
+	default:
+		return
+	}
+	sp.Size = uint32(len(sp.Data))
+
+	// 前一个sample的时长, 要等到这个sample来了才知道
+	if n := len(t.Samples); n > 0 && sp.Dts > t.Samples[n-1].Dts {
+		t.Samples[n-1].Duration = uint32(sp.Dts - t.Samples[n-1].Dts)
+		t.LastDuration = t.Samples[n-1].Duration
+	}
+	t.Samples = append(t.Samples, sp)
+}
+
+// 还没写入fragment的数据时长, 单位毫秒
+func Mp4PendingDuration(t *Mp4Track) uint32 {
+	n := len(t.Samples)
+	if n == 0 {
+		return 0
+	}
+	d := t.Samples[n-1].Dts - t.Samples[0].Dts
+	return uint32(d * 1000 / uint64(t.Timescale))
+}
+
+/**********************************************************/
+/* init segment: ftyp + moov
+/**********************************************************/
+func Mp4FtypCreate() []byte {
+	b := bytes.NewBuffer(nil)
+	b.WriteString("isom")        // major_brand
+	WriteUint32(b, BE, 0x200, 4) // minor_version
+	b.WriteString("isomiso2iso5iso6avc1mp41")
+	return Mp4Box("ftyp", b.Bytes())
+}
+
+// duration 单位毫秒, fmp4的为0
+func Mp4MvhdCreate(m *Mp4Muxer, duration uint64) []byte {
+	b := bytes.NewBuffer(nil)
+	WriteUint32(b, BE, 0, 4)                // creation_time
+	WriteUint32(b, BE, 0, 4)                // modification_time
+	WriteUint32(b, BE, 1000, 4)             // timescale
+	WriteUint32(b, BE, uint32(duration), 4) // duration
+	WriteUint32(b, BE, 0x00010000, 4)       // rate, 1.0
+	WriteUint32(b, BE, 0x0100, 2)           // volume, 1.0
+	b.Write(make([]byte, 10))               // reserved
+	for _, v := range Mp4Matrix {
+		WriteUint32(b, BE, v, 4)
+	}
+	b.Write(make([]byte, 24))                          // pre_defined
+	WriteUint32(b, BE, uint32(len(Mp4Tracks(m))+1), 4) // next_track_ID
+	return Mp4FullBox("mvhd", 0, 0, b.Bytes())
+}
+
+func Mp4TkhdCreate(t *Mp4Track, duration uint64) []byte {
+	b := bytes.NewBuffer(nil)
+	WriteUint32(b, BE, 0, 4)                // creation_time
+	WriteUint32(b, BE, 0, 4)                // modification_time
+	WriteUint32(b, BE, t.TrackId, 4)        // track_ID
+	WriteUint32(b, BE, 0, 4)                // reserved
+	WriteUint32(b, BE, uint32(duration), 4) // duration, 单位是mvhd的timescale
+	b.Write(make([]byte, 8))                // reserved
+	WriteUint32(b, BE, 0, 2)                // layer
+	WriteUint32(b, BE, 0, 2)                // alternate_group
+	if t.Handler == "soun" {
+		WriteUint32(b, BE, 0x0100, 2) // volume
+	} else {
+		WriteUint32(b, BE, 0, 2)
+	}
+	WriteUint32(b, BE, 0, 2) // reserved
+	for _, v := range Mp4Matrix {
+		WriteUint32(b, BE, v, 4)
+	}
+	WriteUint32(b, BE, t.Width<<16, 4)  // 16.16定点数
+	WriteUint32(b, BE, t.Height<<16, 4) // 16.16定点数
+	// flags: track_enabled | track_in_movie
+	return Mp4FullBox("tkhd", 0, 0x3, b.Bytes())
+}
+
+func Mp4MdiaCreate(t *Mp4Track, stbl []byte) []byte {
+	b := bytes.NewBuffer(nil)
+	WriteUint32(b, BE, 0, 4)                  // creation_time
+	WriteUint32(b, BE, 0, 4)                  // modification_time
+	WriteUint32(b, BE, t.Timescale, 4)        // timescale
+	WriteUint32(b, BE, uint32(t.Duration), 4) // duration
+	WriteUint32(b, BE, 0x55c4, 2)             // language, und
+	WriteUint32(b, BE, 0, 2)                  // pre_defined
+	mdhd := Mp4FullBox("mdhd", 0, 0, b.Bytes())
+
+	name := "VideoHandler"
+	if t.Handler == "soun" {
+		name = "SoundHandler"
+	}
+	b = bytes.NewBuffer(nil)
+	WriteUint32(b, BE, 0, 4) // pre_defined
+	b.WriteString(t.Handler)
+	b.Write(make([]byte, 12)) // reserved
+	b.WriteString(name)
+	b.WriteByte(0x0)
+	hdlr := Mp4FullBox("hdlr", 0, 0, b.Bytes())
+
+	var xmhd []byte
+	if t.Handler == "soun" {
+		xmhd = Mp4FullBox("smhd", 0, 0, make([]byte, 4)) // balance + reserved
+	} else {
+		xmhd = Mp4FullBox("vmhd", 0, 1, make([]byte, 8)) // graphicsmode + opcolor
+	}
+	url := Mp4FullBox("url ", 0, 1) // 数据就在本文件里
+	dref := Mp4FullBox("dref", 0, 0, Uint32ToByte(1, nil, BE), url)
+	dinf := Mp4Box("dinf", dref)
+	minf := Mp4Box("minf", xmhd, dinf, stbl)
+	return Mp4Box("mdia", mdhd, hdlr, minf)
+}
+
+func Mp4StsdCreate(t *Mp4Track) []byte {
+	b := bytes.NewBuffer(nil)
+	b.Write(make([]byte, 6)) // reserved
+	WriteUint32(b, BE, 1, 2) // data_reference_index
+	var entry []byte
+	if t.Handler == "vide" {
+		b.Write(make([]byte, 16))         // pre_defined + reserved
+		WriteUint32(b, BE, t.Width, 2)    // width
+		WriteUint32(b, BE, t.Height, 2)   // height
+		WriteUint32(b, BE, 0x00480000, 4) // horizresolution, 72dpi
+		WriteUint32(b, BE, 0x00480000, 4) // vertresolution, 72dpi
+		WriteUint32(b, BE, 0, 4)          // reserved
+		WriteUint32(b, BE, 1, 2)          // frame_count
+		b.Write(make([]byte, 32))         // compressorname
+		WriteUint32(b, BE, 0x18, 2)       // depth
+		WriteUint32(b, BE, 0xffff, 2)     // pre_defined, -1
+		if Mp4TrackIsHevc(t) {
+			entry = Mp4Box("hvc1", b.Bytes(), Mp4Box("hvcC", t.Config))
+		} else {
+			entry = Mp4Box("avc1", b.Bytes(), Mp4Box("avcC", t.Config))
+		}
+	} else {
+		b.Write(make([]byte, 8))                    // reserved
+		WriteUint32(b, BE, uint32(t.ChannelNum), 2) // channelcount
+		WriteUint32(b, BE, 16, 2)                   // samplesize
+		WriteUint32(b, BE, 0, 4)                    // pre_defined + reserved
+		WriteUint32(b, BE, t.SampleRate<<16, 4)     // samplerate, 16.16定点数
+		entry = Mp4Box("mp4a", b.Bytes(), Mp4EsdsCreate(t))
+	}
+	return Mp4FullBox("stsd", 0, 0, Uint32ToByte(1, nil, BE), entry)
+}
+
+// ISO/IEC 14496-1, ES_Descriptor
+// tag(1) + len(1) + data, len小于128时 用1个字节表示
+func Mp4EsdsCreate(t *Mp4Track) []byte {
+	dsi := append([]byte{0x05, byte(len(t.Config))}, t.Config...) // DecoderSpecificInfo
+	dcd := bytes.NewBuffer(nil)                                   // DecoderConfigDescriptor
+	dcd.WriteByte(0x04)
+	dcd.WriteByte(byte(13 + len(dsi)))
+	dcd.WriteByte(0x40)        // objectTypeIndication, 0x40 is aac
+	dcd.WriteByte(0x15)        // streamType(6bit)=5 audio, upStream(1bit)=0, reserved(1bit)=1
+	WriteUint32(dcd, BE, 0, 3) // bufferSizeDB
+	WriteUint32(dcd, BE, 0, 4) // maxBitrate
+	WriteUint32(dcd, BE, 0, 4) // avgBitrate
+	dcd.Write(dsi)
+	slc := []byte{0x06, 0x01, 0x02} // SLConfigDescriptor, predefined=2
+
+	esd := bytes.NewBuffer(nil) // ES_Descriptor
+	esd.WriteByte(0x03)
+	esd.WriteByte(byte(3 + dcd.Len() + len(slc)))
+	WriteUint32(esd, BE, 0, 2) // ES_ID
+	esd.WriteByte(0x0)         // flags
+	esd.Write(dcd.Bytes())
+	esd.Write(slc)
+	return Mp4FullBox("esds", 0, 0, esd.Bytes())
+}
+
+// offsets 为nil时, 生成fmp4用的空索引
+func Mp4StblCreate(t *Mp4Track, offsets []int64, co64 bool) []byte {
+	var samples []Mp4Sample
+	if offsets != nil {
+		samples = t.AllSamples
+	}
+	n := uint32(len(samples))
+
+	// stts, 相同时长的sample合并为一条
+	var stts, ctts, stss, stsz, stco bytes.Buffer
+	var sttsNum, cttsNum, stssNum uint32
+	hasCts := false
+	for i := 0; i < len(samples); i++ {
+		j := i
+		for j+1 < len(samples) && samples[j+1].Duration == samples[i].Duration {
+			j++
+		}
+		WriteUint32(&stts, BE, uint32(j-i+1), 4)
+		WriteUint32(&stts, BE, samples[i].Duration, 4)
+		sttsNum++
+		i = j
+	}
+	for i := 0; i < len(samples); i++ {
+		if samples[i].Cts != 0 {
+			hasCts = true
+		}
+		j := i
+		for j+1 < len(samples) && samples[j+1].Cts == samples[i].Cts {
+			j++
+		}
+		WriteUint32(&ctts, BE, uint32(j-i+1), 4)
+		WriteUint32(&ctts, BE, uint32(samples[i].Cts), 4)
+		cttsNum++
+		i = j
+	}
+	for i, sp := range samples {
+		if sp.KeyFrame {
+			WriteUint32(&stss, BE, uint32(i+1), 4)
+			stssNum++
+		}
+		WriteUint32(&stsz, BE, sp.Size, 4)
+		if co64 {
+			WriteUint64(&stco, BE, uint64(offsets[i]), 8)
+		} else {
+			WriteUint32(&stco, BE, uint32(offsets[i]), 4)
+		}
+	}
+
+	boxes := [][]byte{Mp4StsdCreate(t)}
+	boxes = append(boxes, Mp4FullBox("stts", 0, 0, Uint32ToByte(sttsNum, nil, BE), stts.Bytes()))
+	if hasCts {
+		// version 1 的 sample_offset 是有符号数
+		boxes = append(boxes, Mp4FullBox("ctts", 1, 0, Uint32ToByte(cttsNum, nil, BE), ctts.Bytes()))
+	}
+	if t.Handler == "vide" && n > 0 {
+		boxes = append(boxes, Mp4FullBox("stss", 0, 0, Uint32ToByte(stssNum, nil, BE), stss.Bytes()))
+	}
+	// 每个chunk只有1个sample
+	stsc := Uint32ToByte(0, nil, BE)
+	if n > 0 {
+		stsc = []byte{0, 0, 0, 1, 0, 0, 0, 1, 0, 0, 0, 1, 0, 0, 0, 1}
+	}
+	boxes = append(boxes, Mp4FullBox("stsc", 0, 0, stsc))
+	boxes = append(boxes, Mp4FullBox("stsz", 0, 0, Uint32ToByte(0, nil, BE), Uint32ToByte(n, nil, BE), stsz.Bytes()))
+	if co64 {
+		boxes = append(boxes, Mp4FullBox("co64", 0, 0, Uint32ToByte(n, nil, BE), stco.Bytes()))
+	} else {
+		boxes = append(boxes, Mp4FullBox("stco", 0, 0, Uint32ToByte(n, nil, BE), stco.Bytes()))
+	}
+	return Mp4Box("stbl", boxes...)
+}
+
+// 时长 从track的timescale 转为 毫秒
+func Mp4TrackDurationMs(t *Mp4Track) uint64 {
+	return t.Duration * 1000 / uint64(t.Timescale)
+}
+
+// fmp4的初始化数据: ftyp + moov(mvex)
+func Mp4InitCreate(m *Mp4Muxer) []byte {
+	var traks, trexs [][]byte
+	for _, t := range Mp4Tracks(m) {
+		trak := Mp4Box("trak", Mp4TkhdCreate(t, 0), Mp4MdiaCreate(t, Mp4StblCreate(t, nil, false)))
+		traks = append(traks, trak)
+
+		b := bytes.NewBuffer(nil)
+		WriteUint32(b, BE, t.TrackId, 4) // track_ID
+		WriteUint32(b, BE, 1, 4)         // default_sample_description_index
+		WriteUint32(b, BE, 0, 4)         // default_sample_duration
+		WriteUint32(b, BE, 0, 4)         // default_sample_size
+		WriteUint32(b, BE, 0, 4)         // default_sample_flags
+		trexs = append(trexs, Mp4FullBox("trex", 0, 0, b.Bytes()))
+	}
+	mvex := Mp4Box("mvex", trexs...)
+	moov := Mp4Box("moov", append(append([][]byte{Mp4MvhdCreate(m, 0)}, traks...), mvex)...)
+	return append(Mp4FtypCreate(), moov...)
+}
+
+/**********************************************************/
+/* fragment: moof + mdat
+/**********************************************************/
+// offset 是moof在文件中的位置, 用于记录sample的位置
+// 没有数据时返回nil
+func Mp4FragmentCreate(m *Mp4Muxer, offset int64) []byte {
+	var tracks []*Mp4Track
+	for _, t := range Mp4Tracks(m) {
+		if len(t.Samples) > 0 {
+			tracks = append(tracks, t)
+		}
+	}
+	if len(tracks) == 0 {
+		return nil
+	}
+
+	for _, t := range tracks {
+		n := len(t.Samples)
+		if t.Samples[n-1].Duration == 0 {
+			t.Samples[n-1].Duration = t.LastDuration
+		}
+	}
+
+	// moof的大小和data_offset的值无关, 先算出moof的大小
+	moof := Mp4MoofCreate(m, tracks, 0)
+	moof = Mp4MoofCreate(m, tracks, uint32(len(moof)+8))
+
+	mdat := bytes.NewBuffer(nil)
+	pos := offset + int64(len(moof)) + 8
+	for _, t := range tracks {
+		for _, sp := range t.Samples {
+			mdat.Write(sp.Data)
+			if m.KeepAll {
+				sp.Offset = pos
+				sp.Data = nil
+				t.AllSamples = append(t.AllSamples, sp)
+			}
+			pos += int64(sp.Size)
+		}
+		last := t.Samples[len(t.Samples)-1]
+		t.Duration = last.Dts + uint64(last.Duration)
+		t.Samples = nil
+	}
+	m.SeqNum++
+	return append(moof, Mp4Box("mdat", mdat.Bytes())...)
+}
+
+// dataOffset 是第一个sample数据 相对于moof开始位置的偏移
+func Mp4MoofCreate(m *Mp4Muxer, tracks []*Mp4Track, dataOffset uint32) []byte {
+	boxes := [][]byte{Mp4FullBox("mfhd", 0, 0, Uint32ToByte(m.SeqNum, nil, BE))}
+	for _, t := range tracks {
+		// flags: default-base-is-moof
+		tfhd := Mp4FullBox("tfhd", 0, 0x020000, Uint32ToByte(t.TrackId, nil, BE))
+		tfdt := Mp4FullBox("tfdt", 1, 0, Uint64ToByte(t.Samples[0].Dts, nil, BE))
+
+		b := bytes.NewBuffer(nil)
+		WriteUint32(b, BE, uint32(len(t.Samples)), 4) // sample_count
+		WriteUint32(b, BE, dataOffset, 4)             // data_offset
+		for _, sp := range t.Samples {
+			flags := uint32(Mp4SampleFlagNonKey)
+			if sp.KeyFrame {
+				flags = Mp4SampleFlagKey
+			}
+			WriteUint32(b, BE, sp.Duration, 4)
+			WriteUint32(b, BE, sp.Size, 4)
+			WriteUint32(b, BE, flags, 4)
+			WriteUint32(b, BE, uint32(sp.Cts), 4)
+			dataOffset += sp.Size
+		}
+		// flags: data-offset | sample-duration | sample-size | sample-flags | sample-composition-time-offsets
+		// version 1 的 sample_composition_time_offset 是有符号数
+		trun := Mp4FullBox("trun", 1, 0xf01, b.Bytes())
+		boxes = append(boxes, Mp4Box("traf", tfhd, tfdt, trun))
+	}
+	return Mp4Box("moof", boxes...)
+}
+
+/**********************************************************/
+/* finalize: fmp4 -> mp4
+/**********************************************************/
+// 普通mp4的moov
+func Mp4MoovCreate(m *Mp4Muxer, offsets map[*Mp4Track][]int64, co64 bool) []byte {
+	var duration uint64
+	var traks [][]byte
+	for _, t := range Mp4Tracks(m) {
+		d := Mp4TrackDurationMs(t)
+		if d > duration {
+			duration = d
+		}
+		stbl := Mp4StblCreate(t, offsets[t], co64)
+		traks = append(traks, Mp4Box("trak", Mp4TkhdCreate(t, d), Mp4MdiaCreate(t, stbl)))
+	}
+	return Mp4Box("moov", append([][]byte{Mp4MvhdCreate(m, duration)}, traks...)...)
+}
+
+// fmp4文件 转为 普通mp4文件(ftyp + moov + mdat), 需要 KeepAll 为true
+// 先写到临时文件, 成功后再覆盖fmp4文件
+func Mp4Finalize(m *Mp4Muxer, src string) error {
+	type SampleRef struct {
+		t *Mp4Track
+		i int
+	}
+	var refs []SampleRef
+	var mdatSize int64
+	for _, t := range Mp4Tracks(m) {
+		for i, sp := range t.AllSamples {
+			refs = append(refs, SampleRef{t, i})
+			mdatSize += int64(sp.Size)
+		}
+	}
+	if len(refs) == 0 {
+		return fmt.Errorf("%s has no sample", src)
+	}
+	// 按在fmp4文件中的位置排序, 写入mdat时 保持音视频的交错顺序
+	sort.Slice(refs, func(i, j int) bool {
+		return refs[i].t.AllSamples[refs[i].i].Offset < refs[j].t.AllSamples[refs[j].i].Offset
+	})
+
+	ftyp := Mp4FtypCreate()
+	mdatHeadLen := int64(8)
+	if mdatSize+8 > 0xffffffff {
+		mdatHeadLen = 16
+	}
+	offsets := make(map[*Mp4Track][]int64)
+	for _, t := range Mp4Tracks(m) {
+		offsets[t] = make([]int64, len(t.AllSamples))
+	}
+	// moov的大小 和offsets的值无关, 先算出moov的大小
+	co64 := false
+	moovLen := int64(len(Mp4MoovCreate(m, offsets, co64)))
+	if int64(len(ftyp))+moovLen+mdatHeadLen+mdatSize > 0xffffffff {
+		co64 = true
+		moovLen = int64(len(Mp4MoovCreate(m, offsets, co64)))
+	}
+	pos := int64(len(ftyp)) + moovLen + mdatHeadLen
+	for _, r := range refs {
+		offsets[r.t][r.i] = pos
+		pos += int64(r.t.AllSamples[r.i].Size)
+	}
+	moov := Mp4MoovCreate(m, offsets, co64)
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	dst := src + ".tmp"
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	mdatHead := make([]byte, mdatHeadLen)
+	if mdatHeadLen == 16 {
+		Uint32ToByte(1, mdatHead[0:4], BE)
+		copy(mdatHead[4:8], "mdat")
+		Uint64ToByte(uint64(mdatSize+16), mdatHead[8:16], BE)
+	} else {
+		Uint32ToByte(uint32(mdatSize+8), mdatHead[0:4], BE)
+		copy(mdatHead[4:8], "mdat")
+	}
+	for _, d := range [][]byte{ftyp, moov, mdatHead} {
+		if _, err = out.Write(d); err != nil {
+			out.Close()
+			os.Remove(dst)
+			return err
+		}
+	}
+	for _, r := range refs {
+		sp := r.t.AllSamples[r.i]
+		sr := io.NewSectionReader(in, sp.Offset, int64(sp.Size))
+		if _, err = io.Copy(out, sr); err != nil {
+			out.Close()
+			os.Remove(dst)
+			return err
+		}
+	}
+	if err = out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Rename(dst, src)
+}
+
+/**********************************************************/
+/* mp4 demuxer
+/**********************************************************/
+// 读取mp4或fmp4文件的索引, 点播时用; sample数据不读入内存
+// 结果放在Mp4Muxer里, 每个track的所有sample都在AllSamples里
+// 视频只支持avc1和hvc1/hev1, 音频只支持mp4a, 其他track忽略
+type Mp4BoxHead struct {
+	Type    string
+	Offset  int64 // box在文件中的位置
+	Size    int64 // 包括box头
+	HeadLen int64 // 8 或 16
+}
+
+func Mp4BoxHeadRead(r io.ReaderAt, off, fileSize int64) (Mp4BoxHead, error) {
+	h := Mp4BoxHead{Offset: off, HeadLen: 8}
+	b := make([]byte, 16)
+	if _, err := r.ReadAt(b[:8], off); err != nil {
+		return h, err
+	}
+	h.Size = int64(ByteToUint32(b[0:4], BE))
+	h.Type = string(b[4:8])
+	switch h.Size {
+	case 0: // 一直到文件结尾
+		h.Size = fileSize - off
+	case 1:
+		if _, err := r.ReadAt(b[8:16], off+8); err != nil {
+			return h, err
+		}
+		h.Size = int64(ByteToUint64(b[8:16], BE))
+		h.HeadLen = 16
+	}
+	if h.Size < h.HeadLen || off+h.Size > fileSize {
+		return h, fmt.Errorf("invalid box %s, offset %d, size %d", h.Type, off, h.Size)
+	}
+	return h, nil
+}
+
+// 遍历d里的子box, fn的参数是box类型和box的内容(不包括box头)
+func Mp4BoxRange(d []byte, fn func(typ string, payload []byte) error) error {
+	for len(d) >= 8 {
+		size := uint64(ByteToUint32(d[0:4], BE))
+		typ := string(d[4:8])
+		hl := uint64(8)
+		if size == 1 && len(d) >= 16 {
+			size = ByteToUint64(d[8:16], BE)
+			hl = 16
+		} else if size == 0 {
+			size = uint64(len(d))
+		}
+		if size < hl || size > uint64(len(d)) {
+			return fmt.Errorf("invalid box %s, size %d", typ, size)
+		}
+		if err := fn(typ, d[hl:size]); err != nil {
+			return err
+		}
+		d = d[size:]
+	}
+	return nil
+}
+
+func Mp4FileParse(f *os.File) (*Mp4Muxer, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	fileSize := fi.Size()
+
+	m := &Mp4Muxer{KeepAll: true}
+	tracks := make(map[uint32]*Mp4Track)
+	trexs := make(map[uint32][]byte) // fmp4的sample默认值
+	var off int64
+	for off < fileSize {
+		h, err := Mp4BoxHeadRead(f, off, fileSize)
+		if err != nil {
+			if m.Video != nil || m.Audio != nil {
+				break // 文件结尾不完整, 比如还在录制中
+			}
+			return nil, err
+		}
+		switch h.Type {
+		case "moov", "moof":
+			d := make([]byte, h.Size-h.HeadLen)
+			if _, err = f.ReadAt(d, off+h.HeadLen); err != nil {
+				return nil, err
+			}
+			if h.Type == "moov" {
+				err = Mp4MoovParse(m, tracks, trexs, d)
+			} else {
+				err = Mp4MoofParse(tracks, trexs, d, off)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		off += h.Size
+	}
+	if m.Video == nil && m.Audio == nil {
+		return nil, fmt.Errorf("no avc1, hvc1 or mp4a track")
+	}
+	for _, t := range Mp4Tracks(m) {
+		if n := len(t.AllSamples); n > 0 {
+			t.Duration = t.AllSamples[n-1].Dts + uint64(t.AllSamples[n-1].Duration)
+		}
+	}
+	return m, nil
+}
+
+func Mp4MoovParse(m *Mp4Muxer, tracks map[uint32]*Mp4Track, trexs map[uint32][]byte, d []byte) error {
+	return Mp4BoxRange(d, func(typ string, p []byte) error {
+		switch typ {
+		case "trak":
+			t, err := Mp4TrakParse(p)
+			if err != nil || t == nil {
+				return err
+			}
+			if t.Handler == "vide" && m.Video == nil {
+				m.Video = t
+			} else if t.Handler == "soun" && m.Audio == nil {
+				m.Audio = t
+			} else {
+				return nil
+			}
+			tracks[t.TrackId] = t
+		case "mvex":
+			return Mp4BoxRange(p, func(typ string, p []byte) error {
+				if typ == "trex" && len(p) >= 24 {
+					trexs[ByteToUint32(p[4:8], BE)] = p[4:24]
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+}
+
+// 不支持的track 返回nil
+func Mp4TrakParse(d []byte) (*Mp4Track, error) {
+	t := &Mp4Track{}
+	var stts, ctts, stss, stsz, stsc, stco []byte
+	co64 := false
+	var walk func(typ string, p []byte) error
+	walk = func(typ string, p []byte) error {
+		switch typ {
+		case "mdia", "minf", "stbl":
+			return Mp4BoxRange(p, walk)
+		case "tkhd":
+			if len(p) >= 24 && p[0] == 1 {
+				t.TrackId = ByteToUint32(p[20:24], BE)
+			} else if len(p) >= 16 {
+				t.TrackId = ByteToUint32(p[12:16], BE)
+			}
+		case "mdhd":
+			if len(p) >= 24 && p[0] == 1 {
+				t.Timescale = ByteToUint32(p[20:24], BE)
+			} else if len(p) >= 16 {
+				t.Timescale = ByteToUint32(p[12:16], BE)
+			}
+		case "hdlr":
+			if len(p) >= 12 {
+				t.Handler = string(p[8:12])
+			}
+		case "stsd":
+			if len(p) >= 8 {
+				return Mp4BoxRange(p[8:], func(typ string, p []byte) error {
+					return Mp4SampleEntryParse(t, typ, p)
+				})
+			}
+		case "stts":
+			stts = p
+		case "ctts":
+			ctts = p
+		case "stss":
+			stss = p
+		case "stsz":
+			stsz = p
+		case "stsc":
+			stsc = p
+		case "stco":
+			stco = p
+		case "co64":
+			stco = p
+			co64 = true
+		}
+		return nil
+	}
+	if err := Mp4BoxRange(d, walk); err != nil {
+		return nil, err
+	}
+	if t.Config == nil || t.Timescale == 0 {
+		return nil, nil
+	}
+	if t.Handler == "soun" && t.SampleRate == 0 {
+		t.SampleRate = t.Timescale
+	}
+	if stsz == nil || stco == nil || stsc == nil || stts == nil {
+		return t, nil // fmp4的moov里没有sample
+	}
+
+	// 每个sample的大小, sample个数是文件里的 不能直接信任
+	// 每个sample有大小时 个数不能超过stsz的长度, 大小都一样时 个数不能超过Mp4SampleMaxNum
+	var sizes []uint32
+	if len(stsz) >= 12 {
+		n := ByteToUint32(stsz[8:12], BE)
+		same := ByteToUint32(stsz[4:8], BE)
+		if same == 0 && int64(n) > int64(len(stsz)-12)/4 {
+			return nil, fmt.Errorf("stsz sample num %d, but only %d sizes", n, (len(stsz)-12)/4)
+		}
+		if same != 0 && n > Mp4SampleMaxNum {
+			return nil, fmt.Errorf("stsz sample num %d > %d", n, Mp4SampleMaxNum)
+		}
+		sizes = make([]uint32, n)
+		for i := range sizes {
+			if same != 0 {
+				sizes[i] = same
+			} else {
+				sizes[i] = ByteToUint32(stsz[12+i*4:16+i*4], BE)
+			}
+		}
+	}
+	samples := make([]Mp4Sample, len(sizes))
+	for i := range samples {
+		samples[i].Size = sizes[i]
+		samples[i].KeyFrame = stss == nil
+	}
+
+	// 时间戳 和 时长
+	var dts uint64
+	idx := 0
+	for i := 0; len(stts) >= 8 && 8+i*8+8 <= len(stts) && i < int(ByteToUint32(stts[4:8], BE)); i++ {
+		e := stts[8+i*8:]
+		count := ByteToUint32(e[0:4], BE)
+		delta := ByteToUint32(e[4:8], BE)
+		for j := uint32(0); j < count && idx < len(samples); j++ {
+			samples[idx].Dts = dts
+			samples[idx].Duration = delta
+			dts += uint64(delta)
+			idx++
+		}
+	}
+	idx = 0
+	for i := 0; len(ctts) >= 8 && 8+i*8+8 <= len(ctts) && i < int(ByteToUint32(ctts[4:8], BE)); i++ {
+		e := ctts[8+i*8:]
+		count := ByteToUint32(e[0:4], BE)
+		offset := int32(ByteToUint32(e[4:8], BE))
+		for j := uint32(0); j < count && idx < len(samples); j++ {
+			samples[idx].Cts = offset
+			idx++
+		}
+	}
+	for i := 0; len(stss) >= 8 && 8+i*4+4 <= len(stss) && i < int(ByteToUint32(stss[4:8], BE)); i++ {
+		n := ByteToUint32(stss[8+i*4:12+i*4], BE)
+		if n >= 1 && int(n) <= len(samples) {
+			samples[n-1].KeyFrame = true
+		}
+	}
+
+	// 每个sample的位置, stsc: first_chunk + samples_per_chunk + sample_description_index
+	var chunks []int64
+	es := 4
+	if co64 {
+		es = 8
+	}
+	for i := 0; len(stco) >= 8 && 8+i*es+es <= len(stco) && i < int(ByteToUint32(stco[4:8], BE)); i++ {
+		if co64 {
+			chunks = append(chunks, int64(ByteToUint64(stco[8+i*8:16+i*8], BE)))
+		} else {
+			chunks = append(chunks, int64(ByteToUint32(stco[8+i*4:12+i*4], BE)))
+		}
+	}
+	var stscNum int
+	if len(stsc) >= 8 {
+		stscNum = int(ByteToUint32(stsc[4:8], BE))
+	}
+	idx = 0
+	for i := 0; i < stscNum && 8+i*12+12 <= len(stsc); i++ {
+		e := stsc[8+i*12:]
+		first := int(ByteToUint32(e[0:4], BE))
+		per := int(ByteToUint32(e[4:8], BE))
+		last := len(chunks) + 1
+		if i+1 < stscNum && 8+(i+1)*12+4 <= len(stsc) {
+			last = int(ByteToUint32(stsc[8+(i+1)*12:12+(i+1)*12], BE))
+		}
+		for c := first; c < last && c >= 1 && c <= len(chunks); c++ {
+			pos := chunks[c-1]
+			for j := 0; j < per && idx < len(samples); j++ {
+				samples[idx].Offset = pos
+				pos += int64(samples[idx].Size)
+				idx++
+			}
+		}
+	}
+	t.AllSamples = samples[:idx]
+	return t, nil
+}
+
+func Mp4SampleEntryParse(t *Mp4Track, typ string, p []byte) error {
+	switch typ {
+	case "avc1", "hvc1", "hev1":
+		// SampleEntry(8) + VisualSampleEntry(70)
+		if len(p) < 78 {
+			return nil
+		}
+		entry := typ
+		t.Width = uint32(ByteToUint16(p[24:26], BE))
+		t.Height = uint32(ByteToUint16(p[26:28], BE))
+		return Mp4BoxRange(p[78:], func(typ string, p []byte) error {
+			if typ == "avcC" && entry == "avc1" && len(p) >= 4 {
+				t.Config = p
+				t.Codec = fmt.Sprintf("avc1.%02x%02x%02x", p[1], p[2], p[3])
+			}
+			if typ == "hvcC" && entry != "avc1" {
+				// HevcCParse()要的是flv的MsgData, 前面补5个字节
+				HevcC, err := HevcCParse(append(make([]byte, 5), p...))
+				if err != nil {
+					return nil
+				}
+				t.Config = p
+				t.Codec = entry + strings.TrimPrefix(HevcCodecCreate(HevcC), "hvc1")
+			}
+			return nil
+		})
+	case "mp4a":
+		// SampleEntry(8) + AudioSampleEntry(20)
+		if len(p) < 28 {
+			return nil
+		}
+		t.ChannelNum = ByteToUint16(p[16:18], BE)
+		t.SampleRate = ByteToUint32(p[24:28], BE) >> 16
+		return Mp4BoxRange(p[28:], func(typ string, p []byte) error {
+			if typ == "esds" && len(p) > 4 {
+				t.Config = Mp4EsdsParse(p[4:])
+				if len(t.Config) > 0 {
+					t.Codec = fmt.Sprintf("mp4a.40.%d", t.Config[0]>>3)
+				}
+			}
+			return nil
+		})
+	}
+	return nil
+}
+
+// 从ES_Descriptor里 找到DecoderSpecificInfo(tag为0x05)
+func Mp4EsdsParse(d []byte) []byte {
+	for len(d) >= 2 {
+		tag := d[0]
+		// 长度是变长的, 每个字节的最高位为1 表示后面还有
+		var size, i int
+		for i = 1; i < len(d) && i <= 4; i++ {
+			size = size<<7 | int(d[i]&0x7f)
+			if d[i]&0x80 == 0 {
+				break
+			}
+		}
+		if i >= len(d) { // 长度没有结束 数据就没了
+			return nil
+		}
+		d = d[i+1:]
+		if size > len(d) {
+			return nil
+		}
+		switch tag {
+		case 0x03: // ES_Descriptor: ES_ID(2) + flags(1)
+			if len(d) < 3 {
+				return nil
+			}
+			flags := d[2]
+			n := 3
+			if flags&0x80 != 0 {
+				n += 2
+			}
+			if flags&0x40 != 0 && len(d) > n {
+				n += 1 + int(d[n])
+			}
+			if flags&0x20 != 0 {
+				n += 2
+			}
+			if n > len(d) {
+				return nil
+			}
+			d = d[n:]
+		case 0x04: // DecoderConfigDescriptor
+			if len(d) < 13 {
+				return nil
+			}
+			d = d[13:]
+		case 0x05:
+			return d[:size]
+		default:
+			d = d[size:]
+		}
+	}
+	return nil
+}
+
+// fmp4的moof, off是moof在文件中的位置
+func Mp4MoofParse(tracks map[uint32]*Mp4Track, trexs map[uint32][]byte, d []byte, off int64) error {
+	return Mp4BoxRange(d, func(typ string, p []byte) error {
+		if typ != "traf" {
+			return nil
+		}
+		var t *Mp4Track
+		var base int64 = off
+		var defDuration, defSize, defFlags uint32
+		var dts uint64
+		hasTfdt := false
+		return Mp4BoxRange(p, func(typ string, p []byte) error {
+			switch typ {
+			case "tfhd":
+				if len(p) < 8 {
+					return nil
+				}
+				flags := ByteToUint32(p[0:4], BE) & 0xffffff
+				t = tracks[ByteToUint32(p[4:8], BE)]
+				if t == nil {
+					return nil
+				}
+				if trex, ok := trexs[t.TrackId]; ok {
+					defDuration = ByteToUint32(trex[8:12], BE)
+					defSize = ByteToUint32(trex[12:16], BE)
+					defFlags = ByteToUint32(trex[16:20], BE)
+				}
+				q := p[8:]
+				if flags&0x1 != 0 && len(q) >= 8 {
+					base = int64(ByteToUint64(q[0:8], BE))
+					q = q[8:]
+				}
+				if flags&0x2 != 0 && len(q) >= 4 {
+					q = q[4:]
+				}
+				if flags&0x8 != 0 && len(q) >= 4 {
+					defDuration = ByteToUint32(q[0:4], BE)
+					q = q[4:]
+				}
+				if flags&0x10 != 0 && len(q) >= 4 {
+					defSize = ByteToUint32(q[0:4], BE)
+					q = q[4:]
+				}
+				if flags&0x20 != 0 && len(q) >= 4 {
+					defFlags = ByteToUint32(q[0:4], BE)
+				}
+			case "tfdt":
+				if len(p) >= 12 && p[0] == 1 {
+					dts = ByteToUint64(p[4:12], BE)
+					hasTfdt = true
+				} else if len(p) >= 8 {
+					dts = uint64(ByteToUint32(p[4:8], BE))
+					hasTfdt = true
+				}
+			case "trun":
+				if t == nil || len(p) < 8 {
+					return nil
+				}
+				if !hasTfdt {
+					dts = t.Duration
+				}
+				flags := ByteToUint32(p[0:4], BE) & 0xffffff
+				n := ByteToUint32(p[4:8], BE)
+				q := p[8:]
+				pos := base
+				if flags&0x1 != 0 && len(q) >= 4 {
+					pos = base + int64(int32(ByteToUint32(q[0:4], BE)))
+					q = q[4:]
+				}
+				firstFlags, hasFirst := uint32(0), false
+				if flags&0x4 != 0 && len(q) >= 4 {
+					firstFlags, hasFirst = ByteToUint32(q[0:4], BE), true
+					q = q[4:]
+				}
+				for i := uint32(0); i < n; i++ {
+					sp := Mp4Sample{Dts: dts, Duration: defDuration, Size: defSize}
+					sf := defFlags
+					if i == 0 && hasFirst {
+						sf = firstFlags
+					}
+					for _, fl := range []uint32{0x100, 0x200, 0x400, 0x800} {
+						if flags&fl == 0 {
+							continue
+						}
+						if len(q) < 4 {
+							return fmt.Errorf("trun is too short")
+						}
+						v := ByteToUint32(q[0:4], BE)
+						q = q[4:]
+						switch fl {
+						case 0x100:
+							sp.Duration = v
+						case 0x200:
+							sp.Size = v
+						case 0x400:
+							sf = v
+						case 0x800:
+							sp.Cts = int32(v)
+						}
+					}
+					sp.KeyFrame = sf&0x10000 == 0 // sample_is_non_sync_sample
+					sp.Offset = pos
+					pos += int64(sp.Size)
+					dts += uint64(sp.Duration)
+					t.AllSamples = append(t.AllSamples, sp)
+				}
+				t.Duration = dts
+				hasTfdt = false
+			}
+			return nil
+		})
+	})
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+/**********************************************************/
+/* record
+/**********************************************************/
+// 录制由配置文件的Rules决定, 和推流端publish的类型(live/record/append)无关
+// 录制文件的存储路径
+// RecordSavePath/live/cctv1/cctv1_20220405102030.flv
+// RecordSavePath/live/cctv1/cctv1_20220405102030.mp4
+// 每个录制文件都从关键帧开始, 文件开头先写 Metadata VideoHeader AudioHeader
+// 录制文件里的时间戳 都从0开始
+// 发布中音视频头变了(如 分辨率变了), flv文件里 直接写入新的头
+// mp4的moov里只能有一个头, 下一个关键帧开始新的mp4文件
+type RecordInfo struct {
+	LogRecFn       string      // 文件名 包括路径
+	logRec         *log.Logger // 每个发布者的录制日志都是独立的
+	RecRule        RecordRule  // 匹配到的录制规则
+	RecMetaData    *Chunk      // 每个录制文件开头都要写
+	RecVideoHeader *Chunk      // 每个录制文件开头都要写
+	RecAudioHeader *Chunk      // 每个录制文件开头都要写
+	FlvRecPath     string      // flv录制文件路径, 包含文件名
+	FlvRecFile     *os.File    // flv录制文件描述符
+	FlvRecSize     int64       // flv录制文件当前大小
+	FlvRecFirstTs  uint32      // flv录制文件中第一个时间戳
+	Mp4RecPath     string      // mp4录制文件路径, 包含文件名
+	Mp4RecFile     *os.File    // mp4录制文件描述符
+	Mp4RecSize     int64       // mp4录制文件当前大小
+	Mp4RecFirstTs  uint32      // mp4录制文件中第一个时间戳
+	Mp4Rec         *Mp4Muxer   // mp4录制文件的封装器
+	Mp4RecNew      bool        // 音视频头变了, 下一个关键帧开始新的mp4文件
+}
+
+// 返回app匹配到的第一条录制规则
+func RecordRuleGet(app string) (RecordRule, bool) {
+	rs := conf.Record.Rules
+	if !conf.Record.Enable {
+		return RecordRule{}, false
+	}
+	i := AppRuleFind(len(rs), app, func(i int) string { return rs[i].App })
+	if i < 0 {
+		return RecordRule{}, false
+	}
+	return rs[i], true
+}
+
+// 录制文件的文件名 stream_开始时间.ext, 同一秒内重名的 加序号
+func RecordFilename(s *Stream, ext string) (string, error) {
+	folder := fmt.Sprintf("%s%s/%s", conf.Record.SavePath, s.AmfInfo.App, s.AmfInfo.StreamName)
+	err := os.MkdirAll(folder, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	st := time.Now().Format("20060102150405")
+	fn := fmt.Sprintf("%s/%s_%s.%s", folder, s.AmfInfo.StreamName, st, ext)
+	for i := 1; ; i++ {
+		if _, err = os.Stat(fn); os.IsNotExist(err) {
+			break
+		}
+		fn = fmt.Sprintf("%s/%s_%s_%d.%s", folder, s.AmfInfo.StreamName, st, i, ext)
+	}
+	return fn, nil
+}
+
+/**********************************************************/
+/* Recorder()
+/**********************************************************/
+func Recorder(s *Stream) {
+	s.LogRecFn = fmt.Sprintf("%s%s/%s_recorder_%s.log", conf.LogStreamPath, s.Key, s.Key, s.RemoteAddr)
+	s.logRec, _ = StreamLogCreate(s.LogRecFn)
+	s.logRec.Printf("%s Recorder start, %#v", s.Key, s.RecRule)
+
+	for {
+		c, ok := <-s.RecChan
+		if !ok {
+			s.logRec.Printf("%s Recorder stop", s.Key)
+			FlvRecordClose(s)
+			Mp4RecordClose(s)
+			return
+		}
+
+		switch c.DataType {
+		case "Metadata":
+			s.RecMetaData = c
+			continue
+		case "VideoHeader":
+			RecordHeaderUpdate(s, s.RecVideoHeader, c)
+			s.RecVideoHeader = c
+			continue
+		case "AudioHeader":
+			RecordHeaderUpdate(s, s.RecAudioHeader, c)
+			s.RecAudioHeader = c
+			continue
+		case "VideoKeyFrame", "VideoInterFrame", "AudioAacFrame", "AudioFrame":
+		default:
+			continue
+		}
+
+		if s.RecRule.Flv {
+			FlvRecordAppend(s, c)
+		}
+		if s.RecRule.Mp4 {
+			Mp4RecordAppend(s, c)
+		}
+	}
+}
+
+// old是之前的音视频头, 录制开始前收到的 文件开头会写
+func RecordHeaderUpdate(s *Stream, old, c *Chunk) {
+	if old != nil && bytes.Equal(old.MsgData, c.MsgData) {
+		return
+	}
+	if s.FlvRecFile != nil {
+		s.logRec.Printf("%s changed, write it to %s", c.DataType, s.FlvRecPath)
+		ts := RecordTimestamp(c.Timestamp, s.FlvRecFirstTs)
+		FlvRecordWrite(s, FlvTagCreate(uint8(c.MsgTypeId), ts, c.MsgData))
+	}
+	if s.Mp4RecFile != nil {
+		s.logRec.Printf("%s changed, new mp4 file at next keyframe", c.DataType)
+		s.Mp4RecNew = true
+	}
+}
+
+// 有视频时 只在关键帧处开始录制和切分文件, 只有音频时 任意音频帧都可以
+func RecordIsKeyFrame(s *Stream, c *Chunk) bool {
+	if c.DataType == "VideoKeyFrame" {
+		return true
+	}
+	return s.RecVideoHeader == nil && ChunkIsAudioFrame(c)
+}
+
+// 录制文件里的时间戳从0开始, 音频时间戳可能比关键帧的略小
+func RecordTimestamp(ts, firstTs uint32) uint32 {
+	if ts < firstTs {
+		return 0
+	}
+	return ts - firstTs
+}
+
+// firstTs 和 size 是当前录制文件的第一个时间戳和大小
+func RecordNeedSplit(s *Stream, c *Chunk, firstTs uint32, size int64) bool {
+	r := s.RecRule
+	ts := RecordTimestamp(c.Timestamp, firstTs)
+	if r.SegmentTime > 0 && ts >= r.SegmentTime*1000 {
+		return true
+	}
+	if r.SegmentSize > 0 && size >= int64(r.SegmentSize)*1024*1024 {
+		return true
+	}
+	return false
+}
+
+/**********************************************************/
+/* flv record
+/**********************************************************/
+func FlvRecordAppend(s *Stream, c *Chunk) {
+	if RecordIsKeyFrame(s, c) {
+		if s.FlvRecFile == nil {
+			FlvRecordCreate(s, c)
+		} else if RecordNeedSplit(s, c, s.FlvRecFirstTs, s.FlvRecSize) {
+			FlvRecordClose(s)
+			FlvRecordCreate(s, c)
+		}
+	}
+	if s.FlvRecFile == nil {
+		return
+	}
+
+	ts := RecordTimestamp(c.Timestamp, s.FlvRecFirstTs)
+	FlvRecordWrite(s, FlvTagCreate(uint8(c.MsgTypeId), ts, c.MsgData))
+}
+
+func FlvRecordCreate(s *Stream, c *Chunk) {
+	var err error
+	s.FlvRecPath, err = RecordFilename(s, "flv")
+	if err != nil {
+		s.logRec.Println(err)
+		return
+	}
+
+	s.FlvRecFile, err = os.OpenFile(s.FlvRecPath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		s.logRec.Println(err)
+		s.FlvRecPath = ""
+		return
+	}
+	s.logRec.Println("flv record start", s.FlvRecPath)
+	s.FlvRecSize = 0
+	s.FlvRecFirstTs = c.Timestamp
+
+	var h FlvHead
+	h.Signature0 = 0x46
+	h.Signature1 = 0x4c
+	h.Signature2 = 0x56
+	h.Version = 0x01
+	h.Offset = 0x9
+	if s.RecAudioHeader != nil {
+		h.FlagAudio = 0x1
+	}
+	if s.RecVideoHeader != nil {
+		h.FlagVideo = 0x1
+	}
+	FlvRecordWrite(s, FlvHeadCreate(h))
+
+	if s.RecMetaData != nil {
+		d := MetaDataStrip(s.RecMetaData.MsgData)
+		FlvRecordWrite(s, FlvTagCreate(MsgTypeIdDataAmf0, 0, d))
+	}
+	if s.RecVideoHeader != nil {
+		d := s.RecVideoHeader.MsgData
+		FlvRecordWrite(s, FlvTagCreate(MsgTypeIdVideo, 0, d))
+	}
+	if s.RecAudioHeader != nil {
+		d := s.RecAudioHeader.MsgData
+		FlvRecordWrite(s, FlvTagCreate(MsgTypeIdAudio, 0, d))
+	}
+}
+
+func FlvRecordWrite(s *Stream, d []byte) {
+	if s.FlvRecFile == nil {
+		return
+	}
+	n, err := s.FlvRecFile.Write(d)
+	s.FlvRecSize += int64(n)
+	if err != nil {
+		s.logRec.Printf("Write %s fail, %s", s.FlvRecPath, err)
+		FlvRecordClose(s)
+	}
+}
+
+func FlvRecordClose(s *Stream) {
+	if s.FlvRecFile == nil {
+		return
+	}
+	err := s.FlvRecFile.Close()
+	if err != nil {
+		s.logRec.Println(err)
+	}
+	s.logRec.Printf("flv record stop %s, size %d", s.FlvRecPath, s.FlvRecSize)
+	s.FlvRecFile = nil
+}
+
+/**********************************************************/
+/* mp4 record
+/**********************************************************/
+// 录制为fmp4, 每个gop写一个fragment, 只有音频时 大约每秒写一个
+// 程序崩溃时 fmp4文件也是可以播放的
+// Mp4Finalize为true时, 文件录制结束后 转为普通mp4(moov在前面)
+func Mp4RecordAppend(s *Stream, c *Chunk) {
+	if RecordIsKeyFrame(s, c) {
+		if s.Mp4RecFile == nil {
+			Mp4RecordCreate(s, c)
+		} else if s.Mp4RecNew || RecordNeedSplit(s, c, s.Mp4RecFirstTs, s.Mp4RecSize) {
+			Mp4RecordClose(s)
+			Mp4RecordCreate(s, c)
+		} else if Mp4RecordNeedFlush(s, c) {
+			Mp4RecordFlush(s)
+		}
+	}
+	if s.Mp4RecFile == nil {
+		return
+	}
+
+	ts := RecordTimestamp(c.Timestamp, s.Mp4RecFirstTs)
+	Mp4SampleAdd(s.Mp4Rec, c, ts)
+}
+
+func Mp4RecordNeedFlush(s *Stream, c *Chunk) bool {
+	if c.DataType == "VideoKeyFrame" {
+		return true
+	}
+	m := s.Mp4Rec
+	return m.Video == nil && m.Audio != nil && Mp4PendingDuration(m.Audio) >= 1000
+}
+
+func Mp4RecordCreate(s *Stream, c *Chunk) {
+	s.Mp4RecNew = false
+	var err error
+	// 音视频头 必须在第一个帧之前到达, mp4的moov里要用
+	s.Mp4Rec, err = Mp4MuxerNew(s.RecVideoHeader, s.RecAudioHeader)
+	if err != nil {
+		s.logRec.Println(err)
+		return
+	}
+	s.Mp4Rec.KeepAll = s.RecRule.Mp4Finalize
+
+	s.Mp4RecPath, err = RecordFilename(s, "mp4")
+	if err != nil {
+		s.logRec.Println(err)
+		return
+	}
+
+	s.Mp4RecFile, err = os.OpenFile(s.Mp4RecPath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		s.logRec.Println(err)
+		s.Mp4RecPath = ""
+		return
+	}
+	s.logRec.Println("mp4 record start", s.Mp4RecPath)
+	s.Mp4RecSize = 0
+	s.Mp4RecFirstTs = c.Timestamp
+
+	Mp4RecordWrite(s, Mp4InitCreate(s.Mp4Rec))
+}
+
+func Mp4RecordFlush(s *Stream) {
+	d := Mp4FragmentCreate(s.Mp4Rec, s.Mp4RecSize)
+	if d != nil {
+		Mp4RecordWrite(s, d)
+	}
+}
+
+func Mp4RecordWrite(s *Stream, d []byte) {
+	if s.Mp4RecFile == nil {
+		return
+	}
+	n, err := s.Mp4RecFile.Write(d)
+	s.Mp4RecSize += int64(n)
+	if err != nil {
+		s.logRec.Printf("Write %s fail, %s", s.Mp4RecPath, err)
+		s.Mp4Rec.KeepAll = false // 文件不完整, 不再转为普通mp4
+		Mp4RecordClose(s)
+	}
+}
+
+func Mp4RecordClose(s *Stream) {
+	if s.Mp4RecFile == nil {
+		return
+	}
+	Mp4RecordFlush(s)
+	if s.Mp4RecFile == nil { // Flush时写文件失败, 已经关闭了
+		return
+	}
+	err := s.Mp4RecFile.Close()
+	if err != nil {
+		s.logRec.Println(err)
+	}
+	s.logRec.Printf("mp4 record stop %s, size %d", s.Mp4RecPath, s.Mp4RecSize)
+	s.Mp4RecFile = nil
+
+	// 转换要读写整个文件, 不能阻塞录制协程
+	if s.Mp4Rec.KeepAll {
+		go Mp4RecordFinalize(s.logRec, s.Mp4Rec, s.Mp4RecPath)
+	}
+	s.Mp4Rec = nil
+}
+
+func Mp4RecordFinalize(l *log.Logger, m *Mp4Muxer, fn string) {
+	err := Mp4Finalize(m, fn)
+	if err != nil {
+		l.Printf("mp4 finalize %s fail, %s", fn, err)
+		return
+	}
+	l.Println("mp4 finalize ok", fn)
+}
+
+/**********************************************************/
+/* record clean
+/**********************************************************/
+type RecordFile struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+}
+
+// 每分钟清理一次录制文件
+func RecordCleaner() {
+	log.Println("start record cleaner on", conf.Record.SavePath)
+	for {
+		RecordClean()
+		time.Sleep(1 * time.Minute)
+	}
+}
+
+// 1 删除超过MaxAge天的文件
+// 2 总大小超过MaxDiskUse, 从最旧的文件开始删除
+func RecordClean() {
+	var files []RecordFile
+	var total int64
+	expire := time.Now().AddDate(0, 0, -conf.Record.MaxAge)
+
+	filepath.Walk(conf.Record.SavePath, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return nil
+		}
+		if conf.Record.MaxAge > 0 && fi.ModTime().Before(expire) {
+			log.Printf("record %s is expired, remove it", p)
+			os.Remove(p)
+			return nil
+		}
+		files = append(files, RecordFile{p, fi.Size(), fi.ModTime()})
+		total += fi.Size()
+		return nil
+	})
+
+	if conf.Record.MaxDiskUse <= 0 {
+		return
+	}
+	max := int64(conf.Record.MaxDiskUse) * 1024 * 1024
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime.Before(files[j].ModTime)
+	})
+	for i := 0; i < len(files) && total > max; i++ {
+		log.Printf("record disk use %d > %d, remove %s", total, max, files[i].Path)
+		if err := os.Remove(files[i].Path); err != nil {
+			log.Println(err)
+			continue
+		}
+		total -= files[i].Size
+	}
+}
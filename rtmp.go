@@ -12,6 +12,8 @@ import (
 	"net"
 	"os"
 	"path"
+	"strings"
+	"sync"
 	"time"
 	"utils"
 )
@@ -75,7 +77,7 @@ var (
 // HlsDisk/live_cctv1/live_cctv1_12345.ts
 type Stream struct {
 	Key                 string
-	StreamType          string      // rtmpPublisher/ rtmpPlayer/ flvPlayer
+	StreamType          string      // rtmpPublisher/ filePublisher/ flvPublisher/ rtmpPlayer/ flvPlayer/ tsPlayer/ vodPlayer
 	LogFilename         string      // Stream_Timestamp.log
 	log                 *log.Logger // 每个发布者、播放者的日志都是独立的
 	Conn                net.Conn
@@ -91,11 +93,29 @@ type Stream struct {
 	RecvMsgLen          uint32 // 用于ACK回应,接收消息的总长度(不包括ChunkHeader)
 	TransmitSwitch      string
 	Players             map[string]*Stream // key use player's ip_port
+	PlayersLock         sync.Mutex         // Players 会被多个协程读写
 	NewPlayer           bool               // player use, 新来的播放者要先发GopCache
+	PlayOnly            string             // player use, audio/video 只播放音频或视频, 为空都播放
 	DataChan            chan *Chunk        // 发布者和播放者的数据通道, 有缓存的
+	FileLiveQuit        chan struct{}      // 文件转直播 停止时写入, 见FileLiveStop()
 	HlsChan             chan *Chunk        // 发布者和hls生产者的数据通道
+	RecChan             chan *Chunk        // 发布者和录制协程的数据通道, 不录制时为nil
+	DashChan            chan *Chunk        // 发布者和dash生产者的数据通道, 不开启dash时为nil
+	FlvWriter           io.Writer          // flvPlayer use, 数据直接写到http.ResponseWriter
+	HttpDone            chan bool          // flvPlayer/tsPlayer use, 发送失败或发布者结束时 通知http协程
 	GopCache
 	HlsInfo
+	LlHlsInfo
+	Fmp4HlsInfo
+	HlsEncryptInfo
+	HlsPlaylistInfo
+	HlsArchiveInfo
+	HlsMasterInfo
+	HlsMetaInfo
+	HlsCaptionInfo
+	HlsOnDemandInfo
+	DashInfo
+	RecordInfo
 }
 
 func NewStream(c net.Conn) *Stream {
@@ -326,7 +346,8 @@ func RtmpHandshakeServer(s *Stream) (err error) {
 // 聚合消息(22), 用户控制消息(4)
 //DataType    string
 // "Metadata", "VideoHeader", "AudioHeader",
-// "VideoKeyFrame", "VideoInterFrame", "AudioAacFrame"
+// "VideoKeyFrame", "VideoInterFrame", "AudioAacFrame",
+// "AudioFrame"(没有sequence header的音频帧, MP3和G.711), "DataFrame"
 type Chunk struct {
 	FmtFirst    uint32 // 2bit, 发送的时候要用
 	Fmt         uint32 // 2bit, format
@@ -701,19 +722,15 @@ func RtmpServer() {
 			log.Println(err)
 			continue
 		}
-		log.Printf("tcp first byte is %#x, 0xff is flvPlay, 0x03 is rtmp", ui8)
+		log.Printf("tcp first byte is %#x, 0x03 is rtmp", ui8)
 
-		if ui8 == 0xff {
-			go FlvPlayer(c)
-		} else {
-			// 0x03 rtmp协议版本号, 明文; 0x06 密文;
-			if ui8 != 3 {
-				log.Printf("invalid rtmp client version %d", ui8)
-				c.Close()
-				continue
-			}
-			go RtmpHandler(c)
+		// 0x03 rtmp协议版本号, 明文; 0x06 密文;
+		if ui8 != 3 {
+			log.Printf("invalid rtmp client version %d", ui8)
+			c.Close()
+			continue
 		}
+		go RtmpHandler(c)
 	}
 }
 
@@ -752,12 +769,65 @@ func RtmpHandler(c net.Conn) {
 	}
 }
 
+// 文件转直播的发布者 没有网络连接, Conn为nil
 func RtmpPublishStop(s *Stream) {
 	time.Sleep(1 * time.Second)
 	close(s.DataChan)
-	close(s.HlsChan)
-	s.Conn.Close()
+	if !s.HlsOdEnable { // 按需生成时 由发送协程关闭
+		close(s.HlsChan)
+	}
+	if s.RecChan != nil {
+		close(s.RecChan)
+	}
+	if s.DashChan != nil {
+		close(s.DashChan)
+	}
+	if s.Conn != nil {
+		s.Conn.Close()
+	}
+	PublishersLock.Lock()
 	delete(Publishers, s.Key)
+	PublishersLock.Unlock()
+}
+
+// Publishers会被rtmp和http协程 同时读写, 读取都要用这个
+func PublisherGet(key string) (*Stream, bool) {
+	PublishersLock.RLock()
+	defer PublishersLock.RUnlock()
+	s, ok := Publishers[key]
+	return s, ok
+}
+
+// 发布者存入Publishers, 并开启 hls生产、录制、发送 协程
+// rtmp推流 和 文件转直播 都用这个, 发布者已存在时返回false
+func PublisherStart(s *Stream) bool {
+	PublishersLock.Lock()
+	_, ok := Publishers[s.Key]
+	if !ok {
+		Publishers[s.Key] = s
+	}
+	PublishersLock.Unlock()
+	if ok {
+		s.log.Printf("publisher %s is exist", s.Key)
+		return false
+	}
+
+	if !HlsOnDemandInit(s) {
+		go HlsCreator(s) // 开启hls生产协程
+	}
+	if rule, ok := RecordRuleGet(s.AmfInfo.App); ok {
+		s.RecRule = rule
+		s.RecChan = make(chan *Chunk, 5)
+		go Recorder(s) // 开启录制协程
+	}
+	if conf.DashEnable && !DashSharedInit(s) {
+		s.DashChan = make(chan *Chunk, 5)
+		go DashCreator(s) // 开启dash生产协程
+	}
+	go RtmpSender(s) // 给所有播放者发送数据
+
+	s.TransmitSwitch = "on"
+	return true
 }
 
 func RtmpPublisher(s *Stream) {
@@ -765,18 +835,11 @@ func RtmpPublisher(s *Stream) {
 		s.AmfInfo.StreamName)
 	s.log.Println("publisher key is", s.Key)
 
-	_, ok := Publishers[s.Key]
-	if ok { // 发布者已存在, 断开当前连接并返回错误
-		s.log.Printf("publisher %s is exist", s.Key)
+	if !PublisherStart(s) { // 发布者已存在, 断开当前连接并返回错误
 		s.Conn.Close()
 		return
 	}
-	Publishers[s.Key] = s
-
-	go HlsCreator(s) // 开启hls生产协程
-	go RtmpSender(s) // 给所有播放者发送数据
 
-	s.TransmitSwitch = "on"
 	i := 0
 	for {
 		s.log.Println("====================>> message", i)
@@ -870,11 +933,24 @@ func RtmpSender(s *Stream) {
 		c, ok := <-s.DataChan
 		if !ok {
 			s.log.Printf("%s RtmpSender stop", s.Key)
+			HlsOnDemandStop(s, false)
+			s.PlayersLock.Lock()
+			for _, p := range s.Players {
+				PlayerStop(p)
+			}
+			s.PlayersLock.Unlock()
 			return
 		}
-		s.HlsChan <- c // 发送数据给hls生产协程
+		HlsChanSend(s, c) // 发送数据给hls生产协程
+		if s.RecChan != nil {
+			s.RecChan <- c // 发送数据给录制协程
+		}
+		if s.DashChan != nil {
+			s.DashChan <- c // 发送数据给dash生产协程
+		}
 
 		s.log.Println("@@@ RtmpSender() start")
+		s.PlayersLock.Lock()
 		s.log.Printf("@@@ player num is %d, send DataType is %s, size is %d", len(s.Players), c.DataType, c.MsgLength)
 		for _, p := range s.Players {
 			// 新播放者，先发送缓存的gop数据，再发送最新数据
@@ -886,12 +962,20 @@ func RtmpSender(s *Stream) {
 					err = GopCacheSend(p, &s.GopCache)
 				} else if p.StreamType == "flvPlayer" {
 					err = GopCacheSendFlv(p, &s.GopCache)
+				} else if p.StreamType == "tsPlayer" {
+					err = GopCacheSendTs(p, &s.GopCache)
 				}
 			} else {
+				pc := PlayerChunk(p, c)
+				if pc == nil { // 只播放音频或视频, 不需要的数据不发送
+					continue
+				}
 				if p.StreamType == "rtmpPlayer" {
-					err = MessageSplit(p, c)
+					err = MessageSplit(p, pc)
 				} else if p.StreamType == "flvPlayer" {
-					err = MessageSendFlv(p, c)
+					err = MessageSendFlv(p, pc)
+				} else if p.StreamType == "tsPlayer" {
+					err = MessageSendTs(p, pc)
 				}
 			}
 
@@ -900,8 +984,10 @@ func RtmpSender(s *Stream) {
 				s.log.Printf("@@@ send data to player %s error, %t",
 					p.Key, p.NewPlayer)
 				delete(s.Players, p.Key)
+				PlayerStop(p)
 			}
 		}
+		s.PlayersLock.Unlock()
 		s.log.Println("@@@ RtmpSender() stop")
 	}
 }
@@ -910,8 +996,14 @@ func RtmpPlayer(s *Stream) {
 	key := fmt.Sprintf("%s_%s", s.AmfInfo.App, s.AmfInfo.StreamName)
 	s.log.Println("publisher key is", key)
 
-	p, ok := Publishers[key]
-	if !ok { // 发布者不存在, 断开连接并返回错误
+	p, ok := PublisherGet(key)
+	if !ok { // 发布者不存在, 点播录制文件
+		if fn, ok := VodFilename(s.AmfInfo.App, s.AmfInfo.StreamName); ok {
+			s.StreamType = "vodPlayer"
+			VodPlayer(s, fn)
+			return
+		}
+		// 点播文件也不存在, 断开连接并返回错误
 		s.log.Printf("publisher %s isn't exist", key)
 		s.Conn.Close()
 		return
@@ -920,7 +1012,124 @@ func RtmpPlayer(s *Stream) {
 	s.Key = fmt.Sprintf("%s_%s_%s", s.AmfInfo.App,
 		s.AmfInfo.StreamName, s.RemoteAddr)
 	s.log.Println("player key is", s.Key)
+	PlayerAdd(p, s)
+}
+
+// 播放者存入发布者的Players里, 由发布者的发送协程 给播放者发送数据
+func PlayerAdd(p, s *Stream) {
+	p.PlayersLock.Lock()
 	p.Players[s.Key] = s
+	p.PlayersLock.Unlock()
+}
+
+func PlayerDelete(p, s *Stream) {
+	p.PlayersLock.Lock()
+	delete(p.Players, s.Key)
+	p.PlayersLock.Unlock()
+}
+
+// 播放参数only 只能是audio或video, 其他值都当作播放音视频
+func PlayOnlyParse(v string) string {
+	if v == "audio" || v == "video" {
+		return v
+	}
+	return ""
+}
+
+// 只播放音频或视频时, 过滤掉不需要的音视频数据, 修改Metadata
+// 返回nil表示不用发送, c为nil时也返回nil
+func PlayerChunk(s *Stream, c *Chunk) *Chunk {
+	if c == nil || s.PlayOnly == "" {
+		return c
+	}
+	switch c.MsgTypeId {
+	case MsgTypeIdAudio:
+		if s.PlayOnly == "video" {
+			return nil
+		}
+	case MsgTypeIdVideo:
+		if s.PlayOnly == "audio" {
+			return nil
+		}
+	case MsgTypeIdDataAmf0:
+		if c.DataType == "Metadata" {
+			return MetaDataOnly(s, c)
+		}
+	}
+	return c
+}
+
+// 去掉Metadata里 不播放的音频或视频的信息, hasAudio/hasVideo改为false
+// 解析或编码失败时 发送原来的Metadata
+func MetaDataOnly(s *Stream, c *Chunk) *Chunk {
+	vs, err := AmfUnmarshal(s, bytes.NewReader(c.MsgData))
+	if err != nil && err != io.EOF {
+		s.log.Println(err)
+		return c
+	}
+
+	drop := "audio"
+	if s.PlayOnly == "audio" {
+		drop = "video"
+	}
+	for _, v := range vs {
+		o, ok := v.(Object)
+		if !ok {
+			continue
+		}
+		for k := range o {
+			if MetaDataKeyIs(k, drop) {
+				delete(o, k)
+			}
+		}
+		if drop == "audio" {
+			o["hasAudio"] = false
+		} else {
+			o["hasVideo"] = false
+		}
+	}
+
+	d, err := AmfMarshal(s, vs...)
+	if err != nil {
+		s.log.Println(err)
+		return c
+	}
+	nc := *c
+	nc.MsgData = d
+	nc.MsgLength = uint32(len(d))
+	return &nc
+}
+
+// Metadata的key 是否是音频(audio)或视频(video)的信息
+func MetaDataKeyIs(k, t string) bool {
+	k = strings.ToLower(k)
+	if strings.HasPrefix(k, t) || k == "has"+t {
+		return true
+	}
+	if t == "audio" {
+		return k == "stereo"
+	}
+	switch k {
+	case "width", "height", "framerate", "fps", "displaywidth",
+		"displayheight", "haskeyframes", "keyframes":
+		return true
+	}
+	return false
+}
+
+// 发送失败 或 发布者结束时调用
+// http播放者(flv/ts) 通知http协程结束; rtmp播放者 断开连接
+func PlayerStop(s *Stream) {
+	if s.HttpDone != nil {
+		select {
+		case s.HttpDone <- true:
+		default:
+		}
+		return
+	}
+	if s.Conn != nil {
+		s.Conn.Close()
+	}
 }
 
 func PrintList(s *Stream, l *list.List) {
@@ -936,7 +1145,21 @@ func PrintList(s *Stream, l *list.List) {
 /**********************************************************/
 /* Metadata Video Audio handle
 /**********************************************************/
+// 不是rtmp推流的发布者(文件转直播, http-flv推流) 用这个处理音视频和Metadata
+func MediaHandle(s *Stream, c *Chunk) error {
+	switch c.MsgTypeId {
+	case MsgTypeIdVideo:
+		return VideoHandle(s, c)
+	case MsgTypeIdAudio:
+		return AudioHandle(s, c)
+	}
+	return MetadataHandle(s, c)
+}
+
 // Metadata 数据要缓存起来，发送给播放者
+// 只有onMetaData 缓存起来, 其他数据消息(onCuePoint, onTextData等) DataType为DataFrame
+// DataFrame不缓存 也不替换Metadata, 和音视频一样按顺序实时发给播放者
+// 推流的 "@setDataFrame" + "onCuePoint" 要去掉 "@setDataFrame", 播放器按第一个字符串找处理函数
 func MetadataHandle(s *Stream, c *Chunk) error {
 	c.DataType = "Metadata"
 	r := bytes.NewReader(c.MsgData)
@@ -947,10 +1170,30 @@ func MetadataHandle(s *Stream, c *Chunk) error {
 	}
 	s.log.Printf("Amf Unmarshal %#v", vs)
 
+	if name := DataMsgName(vs); name != "" && name != "onMetaData" {
+		c.DataType = "DataFrame"
+		c.MsgData = MetaDataStrip(c.MsgData)
+		c.MsgLength = uint32(len(c.MsgData))
+		return nil
+	}
 	s.GopCache.MetaData = c
 	return nil
 }
 
+// 数据消息的名字 如onMetaData onCuePoint onTextData, 第一个字符串是 "@setDataFrame" 时取第二个
+func DataMsgName(vs []interface{}) string {
+	for _, v := range vs {
+		name, ok := v.(string)
+		if !ok {
+			return ""
+		}
+		if name != "@setDataFrame" {
+			return name
+		}
+	}
+	return ""
+}
+
 //AVCDecoderConfigurationRecord 包含着是H.264解码相关比较重要的sps和pps信息，再给AVC解码器送数据流之前一定要把sps和pps信息送出，否则的话解码器不能正常解码。
 //而且在解码器stop之后再次start之前，如seek、快进快退状态切换等，都需要重新送一遍sps和pps的信息.
 //AVCDecoderConfigurationRecord在FLV文件中一般情况也是出现1次，也就是第一个 video tag.
@@ -984,8 +1227,9 @@ func VideoHandle(s *Stream, c *Chunk) error {
 	//5: On2 VP6 with alpha channel
 	//6: Screen video version 2
 	//7: AVC, AVCVIDEOPACKET
-	if CodecId != 7 {
-		err := fmt.Errorf("CodecId is't AVC")
+	//12: HEVC, 国内扩展的flv(不是Adobe的标准), 数据格式和AVC一样
+	if CodecId != 7 && CodecId != 12 {
+		err := fmt.Errorf("CodecId %d is't AVC or HEVC", CodecId)
 		s.log.Println(err)
 		return err
 	}
@@ -995,9 +1239,19 @@ func VideoHandle(s *Stream, c *Chunk) error {
 	//2: AVC end of sequence
 	AVCPacketType := c.MsgData[1] // 8bit
 	//创作时间 int24
-	CompositionTime := ByteToInt32(c.MsgData[2:5], BE) // 24bit
+	CompositionTime := ByteToInt24(c.MsgData[2:5], BE) // 24bit, 有符号
 
-	if AVCPacketType == 0 {
+	if AVCPacketType == 0 && CodecId == 12 {
+		s.log.Println("This frame is HEVC sequence header")
+		c.DataType = "VideoHeader"
+		HevcC, err := HevcCParse(c.MsgData)
+		if err != nil {
+			s.log.Println(err)
+			return err
+		}
+		s.log.Printf("%#v", HevcC)
+		s.GopCache.VideoHeader = c
+	} else if AVCPacketType == 0 {
 		s.log.Println("This frame is AVC sequence header")
 		c.DataType = "VideoHeader"
 
@@ -1041,6 +1295,9 @@ func VideoHandle(s *Stream, c *Chunk) error {
 		s.log.Println("This frame is AVC NALU")
 		c.Fmt = c.FmtFirst
 		s.GopCache.MediaData.PushBack(c)
+		if CodecId == 7 { // 字幕只检测h264的SEI
+			CaptionDetect(s, c)
+		}
 		//naluLen := ByteToUint32(c.MsgData[5:9], BE)
 		//s.log.Printf("naluLen=%d, Data=%#v", naluLen, c.MsgData)
 		// 前5个字节上面已经处理，从第6个字节开始
@@ -1097,24 +1354,324 @@ type AVCDecoderConfigurationRecord struct {
 	PpsData              []byte // 4Byte
 }
 
+// d 是VideoHeader的MsgData, 前5个字节是flv的VideoTagHeader
+func AvcCParse(d []byte) (*AVCDecoderConfigurationRecord, error) {
+	if len(d) < 13 {
+		return nil, fmt.Errorf("AVC sequence header len %d is too short", len(d))
+	}
+	var AvcC AVCDecoderConfigurationRecord
+	AvcC.ConfigurationVersion = d[5]
+	AvcC.AVCProfileIndication = d[6]
+	AvcC.ProfileCompatibility = d[7]
+	AvcC.AVCLevelIndication = d[8]
+	AvcC.Reserved0 = (d[9] & 0xFC) >> 2
+	AvcC.LengthSizeMinuxOne = d[9] & 0x3
+	AvcC.Reserved1 = (d[10] & 0xE0) >> 5
+	AvcC.NumOfSps = d[10] & 0x1F
+	AvcC.SpsSize = ByteToUint16(d[11:13], BE)
+	EndPos := 13 + int(AvcC.SpsSize)
+	if AvcC.NumOfSps == 0 || len(d) < EndPos+3 {
+		return nil, fmt.Errorf("AVC sequence header is incomplete")
+	}
+	AvcC.SpsData = d[13:EndPos]
+	AvcC.NumOsPps = d[EndPos]
+	AvcC.PpsSize = ByteToUint16(d[EndPos+1:EndPos+3], BE)
+	AvcC.PpsData = d[EndPos+3:]
+	return &AvcC, nil
+}
+
 //ProfileIdc         uint8 // 8bit
 // 44	CAVLC 4:4:4 Intra
 // 66	Baseline
 // 77	Main
 // 88	Extended
 // ...
-type Sps struct { // ???
-	ProfileIdc         uint8 // 8bit
-	ConstraintSet0Flag uint8 // 1bit
-	//...
-	ConstraintSet5Flag uint8 // 1bit
-	ReservedZero2bits  uint8 // 2bit
-	//...
+// 只解析到 frame_cropping, vui不解析
+type Sps struct {
+	ProfileIdc                uint8  // 8bit
+	ConstraintSetFlags        uint8  // 8bit, ConstraintSet0Flag - ConstraintSet5Flag + ReservedZero2bits
+	LevelIdc                  uint8  // 8bit
+	SeqParameterSetId         uint32 // ue(v)
+	ChromaFormatIdc           uint32 // ue(v), 默认为1, 表示4:2:0
+	SeparateColourPlaneFlag   uint32 // 1bit
+	Log2MaxFrameNumMinus4     uint32 // ue(v)
+	PicOrderCntType           uint32 // ue(v)
+	MaxNumRefFrames           uint32 // ue(v)
+	PicWidthInMbsMinus1       uint32 // ue(v)
+	PicHeightInMapUnitsMinus1 uint32 // ue(v)
+	FrameMbsOnlyFlag          uint32 // 1bit
+	FrameCroppingFlag         uint32 // 1bit
+	FrameCropLeftOffset       uint32 // ue(v)
+	FrameCropRightOffset      uint32 // ue(v)
+	FrameCropTopOffset        uint32 // ue(v)
+	FrameCropBottomOffset     uint32 // ue(v)
+	Width                     uint32 // 不是sps成员, 根据上面的值计算得出
+	Height                    uint32 // 不是sps成员, 根据上面的值计算得出
+}
+
+// d 是去掉防竞争字节(0x03)的sps, 第一个字节是0x67
+func SpsParse(d []byte) (*Sps, error) {
+	if len(d) < 4 {
+		return nil, fmt.Errorf("sps len %d is too short", len(d))
+	}
+	var sps Sps
+	r := &BitReader{Data: d, Pos: 8} // 跳过nalu header
+	sps.ProfileIdc = uint8(BitRead(r, 8))
+	sps.ConstraintSetFlags = uint8(BitRead(r, 8))
+	sps.LevelIdc = uint8(BitRead(r, 8))
+	sps.SeqParameterSetId = BitReadUe(r)
+
+	sps.ChromaFormatIdc = 1
+	switch sps.ProfileIdc {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		sps.ChromaFormatIdc = BitReadUe(r)
+		if sps.ChromaFormatIdc == 3 {
+			sps.SeparateColourPlaneFlag = BitRead(r, 1)
+		}
+		BitReadUe(r)            // bit_depth_luma_minus8
+		BitReadUe(r)            // bit_depth_chroma_minus8
+		BitRead(r, 1)           // qpprime_y_zero_transform_bypass_flag
+		if BitRead(r, 1) == 1 { // seq_scaling_matrix_present_flag
+			n := 8
+			if sps.ChromaFormatIdc == 3 {
+				n = 12
+			}
+			for i := 0; i < n; i++ {
+				if BitRead(r, 1) == 0 { // seq_scaling_list_present_flag
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				var last, next int32 = 8, 8
+				for j := 0; j < size; j++ {
+					if next != 0 {
+						next = (last + BitReadSe(r) + 256) % 256
+					}
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+
+	sps.Log2MaxFrameNumMinus4 = BitReadUe(r)
+	sps.PicOrderCntType = BitReadUe(r)
+	if sps.PicOrderCntType == 0 {
+		BitReadUe(r) // log2_max_pic_order_cnt_lsb_minus4
+	} else if sps.PicOrderCntType == 1 {
+		BitRead(r, 1)     // delta_pic_order_always_zero_flag
+		BitReadSe(r)      // offset_for_non_ref_pic
+		BitReadSe(r)      // offset_for_top_to_bottom_field
+		n := BitReadUe(r) // num_ref_frames_in_pic_order_cnt_cycle
+		for i := uint32(0); i < n && !BitReadOver(r); i++ {
+			BitReadSe(r) // offset_for_ref_frame
+		}
+	}
+	sps.MaxNumRefFrames = BitReadUe(r)
+	BitRead(r, 1) // gaps_in_frame_num_value_allowed_flag
+	sps.PicWidthInMbsMinus1 = BitReadUe(r)
+	sps.PicHeightInMapUnitsMinus1 = BitReadUe(r)
+	sps.FrameMbsOnlyFlag = BitRead(r, 1)
+	if sps.FrameMbsOnlyFlag == 0 {
+		BitRead(r, 1) // mb_adaptive_frame_field_flag
+	}
+	BitRead(r, 1) // direct_8x8_inference_flag
+	sps.FrameCroppingFlag = BitRead(r, 1)
+	if sps.FrameCroppingFlag == 1 {
+		sps.FrameCropLeftOffset = BitReadUe(r)
+		sps.FrameCropRightOffset = BitReadUe(r)
+		sps.FrameCropTopOffset = BitReadUe(r)
+		sps.FrameCropBottomOffset = BitReadUe(r)
+	}
+	if BitReadOver(r) {
+		return nil, fmt.Errorf("sps data is incomplete")
+	}
+
+	// 4:2:0时 裁剪单位是2个像素, 4:0:0和4:4:4时 是1个像素
+	var cropUnitX, cropUnitY uint32 = 1, 2 - sps.FrameMbsOnlyFlag
+	if sps.ChromaFormatIdc == 1 {
+		cropUnitX, cropUnitY = 2, 2*(2-sps.FrameMbsOnlyFlag)
+	} else if sps.ChromaFormatIdc == 2 {
+		cropUnitX = 2
+	}
+	sps.Width = (sps.PicWidthInMbsMinus1+1)*16 -
+		cropUnitX*(sps.FrameCropLeftOffset+sps.FrameCropRightOffset)
+	sps.Height = (2-sps.FrameMbsOnlyFlag)*(sps.PicHeightInMapUnitsMinus1+1)*16 -
+		cropUnitY*(sps.FrameCropTopOffset+sps.FrameCropBottomOffset)
+	return &sps, nil
 }
 
 type Pps struct { // ???
 }
 
+// See ISO 14496-15, 8.3.3.1 for HEVCDecoderConfigurationRecord
+// 国内扩展的flv(CodecId为12) HEVC sequence header就是HEVCDecoderConfigurationRecord
+// 23字节的固定部分 + numOfArrays个数组, 每个数组是同一种nalu(vps/sps/pps/sei)
+type HEVCDecoderConfigurationRecord struct {
+	ConfigurationVersion             uint8    // 8bit, 0x01
+	GeneralProfileSpace              uint8    // 2bit
+	GeneralTierFlag                  uint8    // 1bit
+	GeneralProfileIdc                uint8    // 5bit, 1 Main, 2 Main10
+	GeneralProfileCompatibilityFlags uint32   // 32bit
+	GeneralConstraintIndicatorFlags  []byte   // 48bit
+	GeneralLevelIdc                  uint8    // 8bit, 值为 level*30, 如 93是3.1
+	LengthSizeMinusOne               uint8    // 2bit, 通常为3, 表示nalu前是4字节长度
+	NumOfArrays                      uint8    // 8bit
+	Nalus                            [][]byte // 所有数组里的nalu, 按顺序 通常是vps sps pps
+	SpsData                          []byte   // 第一个sps
+}
+
+// d 是VideoHeader的MsgData, 前5个字节是flv的VideoTagHeader
+func HevcCParse(d []byte) (*HEVCDecoderConfigurationRecord, error) {
+	if len(d) < 5+23 {
+		return nil, fmt.Errorf("HEVC sequence header len %d is too short", len(d))
+	}
+	p := d[5:]
+	var HevcC HEVCDecoderConfigurationRecord
+	HevcC.ConfigurationVersion = p[0]
+	HevcC.GeneralProfileSpace = p[1] >> 6
+	HevcC.GeneralTierFlag = (p[1] >> 5) & 0x1
+	HevcC.GeneralProfileIdc = p[1] & 0x1f
+	HevcC.GeneralProfileCompatibilityFlags = ByteToUint32(p[2:6], BE)
+	HevcC.GeneralConstraintIndicatorFlags = p[6:12]
+	HevcC.GeneralLevelIdc = p[12]
+	HevcC.LengthSizeMinusOne = p[21] & 0x3
+	HevcC.NumOfArrays = p[22]
+
+	p = p[23:]
+	for i := 0; i < int(HevcC.NumOfArrays); i++ {
+		if len(p) < 3 {
+			return nil, fmt.Errorf("HEVC sequence header is incomplete")
+		}
+		typ := p[0] & 0x3f // array_completeness(1bit) + reserved(1bit) + NAL_unit_type(6bit)
+		n := int(ByteToUint16(p[1:3], BE))
+		p = p[3:]
+		for j := 0; j < n; j++ {
+			if len(p) < 2 || int(ByteToUint16(p[0:2], BE)) > len(p)-2 {
+				return nil, fmt.Errorf("HEVC sequence header is incomplete")
+			}
+			size := int(ByteToUint16(p[0:2], BE))
+			HevcC.Nalus = append(HevcC.Nalus, p[2:2+size])
+			if typ == 33 && HevcC.SpsData == nil {
+				HevcC.SpsData = p[2 : 2+size]
+			}
+			p = p[2+size:]
+		}
+	}
+	if HevcC.SpsData == nil {
+		return nil, fmt.Errorf("HEVC sequence header has no sps")
+	}
+	return &HevcC, nil
+}
+
+// ISO/IEC 14496-15 Annex E, 如 hvc1.1.6.L93.B0
+// profile_space(A/B/C) + profile_idc . 反转的compatibility_flags . tier(L/H) + level_idc . constraint_flags(去掉最后的0)
+func HevcCodecCreate(HevcC *HEVCDecoderConfigurationRecord) string {
+	var space string
+	if HevcC.GeneralProfileSpace > 0 {
+		space = string(rune('A' + HevcC.GeneralProfileSpace - 1))
+	}
+	var compat uint32
+	for i := 0; i < 32; i++ {
+		compat |= (HevcC.GeneralProfileCompatibilityFlags >> uint(i) & 0x1) << uint(31-i)
+	}
+	tier := "L"
+	if HevcC.GeneralTierFlag == 1 {
+		tier = "H"
+	}
+	codec := fmt.Sprintf("hvc1.%s%d.%X.%s%d", space, HevcC.GeneralProfileIdc, compat, tier, HevcC.GeneralLevelIdc)
+	cf := HevcC.GeneralConstraintIndicatorFlags
+	for len(cf) > 0 && cf[len(cf)-1] == 0 {
+		cf = cf[:len(cf)-1]
+	}
+	for _, b := range cf {
+		codec += fmt.Sprintf(".%X", b)
+	}
+	return codec
+}
+
+// H.265 sps, 定义在 ISO/IEC 23008-2, 7.3.2.2
+// 只解析到 conformance_window, 用来计算宽高
+type HevcSps struct {
+	MaxSubLayersMinus1      uint32 // 3bit
+	ChromaFormatIdc         uint32 // ue(v)
+	SeparateColourPlaneFlag uint32 // 1bit
+	PicWidthInLumaSamples   uint32 // ue(v)
+	PicHeightInLumaSamples  uint32 // ue(v)
+	ConformanceWindowFlag   uint32 // 1bit
+	ConfWinLeftOffset       uint32 // ue(v)
+	ConfWinRightOffset      uint32 // ue(v)
+	ConfWinTopOffset        uint32 // ue(v)
+	ConfWinBottomOffset     uint32 // ue(v)
+	Width                   uint32 // 不是sps成员, 根据上面的值计算得出
+	Height                  uint32 // 不是sps成员, 根据上面的值计算得出
+}
+
+// d 是去掉防竞争字节(0x03)的sps, 前2个字节是nalu header
+func HevcSpsParse(d []byte) (*HevcSps, error) {
+	if len(d) < 15 {
+		return nil, fmt.Errorf("hevc sps len %d is too short", len(d))
+	}
+	var sps HevcSps
+	r := &BitReader{Data: d, Pos: 16} // 跳过nalu header
+	BitRead(r, 4)                     // sps_video_parameter_set_id
+	sps.MaxSubLayersMinus1 = BitRead(r, 3)
+	BitRead(r, 1) // sps_temporal_id_nesting_flag
+
+	// profile_tier_level(1, sps_max_sub_layers_minus1)
+	// general_profile 88bit + general_level_idc 8bit
+	r.Pos += 96
+	var profile, level []uint32
+	for i := uint32(0); i < sps.MaxSubLayersMinus1; i++ {
+		profile = append(profile, BitRead(r, 1)) // sub_layer_profile_present_flag
+		level = append(level, BitRead(r, 1))     // sub_layer_level_present_flag
+	}
+	if sps.MaxSubLayersMinus1 > 0 {
+		r.Pos += int(8-sps.MaxSubLayersMinus1) * 2 // reserved_zero_2bits
+	}
+	for i := range profile {
+		if profile[i] == 1 {
+			r.Pos += 88
+		}
+		if level[i] == 1 {
+			r.Pos += 8
+		}
+	}
+
+	BitReadUe(r) // sps_seq_parameter_set_id
+	sps.ChromaFormatIdc = BitReadUe(r)
+	if sps.ChromaFormatIdc == 3 {
+		sps.SeparateColourPlaneFlag = BitRead(r, 1)
+	}
+	sps.PicWidthInLumaSamples = BitReadUe(r)
+	sps.PicHeightInLumaSamples = BitReadUe(r)
+	sps.ConformanceWindowFlag = BitRead(r, 1)
+	if sps.ConformanceWindowFlag == 1 {
+		sps.ConfWinLeftOffset = BitReadUe(r)
+		sps.ConfWinRightOffset = BitReadUe(r)
+		sps.ConfWinTopOffset = BitReadUe(r)
+		sps.ConfWinBottomOffset = BitReadUe(r)
+	}
+	if BitReadOver(r) {
+		return nil, fmt.Errorf("hevc sps data is incomplete")
+	}
+
+	// 4:2:0时 裁剪单位是2个像素, 4:2:2时 水平是2个像素
+	var subWidthC, subHeightC uint32 = 1, 1
+	if sps.SeparateColourPlaneFlag == 0 && (sps.ChromaFormatIdc == 1 || sps.ChromaFormatIdc == 2) {
+		subWidthC = 2
+	}
+	if sps.SeparateColourPlaneFlag == 0 && sps.ChromaFormatIdc == 1 {
+		subHeightC = 2
+	}
+	sps.Width = sps.PicWidthInLumaSamples - subWidthC*(sps.ConfWinLeftOffset+sps.ConfWinRightOffset)
+	sps.Height = sps.PicHeightInLumaSamples - subHeightC*(sps.ConfWinTopOffset+sps.ConfWinBottomOffset)
+	return &sps, nil
+}
+
 // >>> SoundFormat <<<
 //0 = Linear PCM, platform endian
 //1 = ADPCM
@@ -1147,9 +1704,17 @@ func AudioHandle(s *Stream, c *Chunk) error {
 	SoundSize := (c.MsgData[0] & 0x2) >> 1    // 1bit
 	SoundType := c.MsgData[0] & 0x1           // 1bit
 
-	if SoundFormat == 10 {
+	switch SoundFormat {
+	case 10:
 		s.log.Println("SoundFormat is AAC")
-	} else {
+	case 2, 14, 7, 8:
+		// MP3 和 G.711 没有sequence header, 1字节头之后 就是音频帧
+		s.log.Println("SoundFormat is", SoundFormat, SoundRate, SoundSize, SoundType)
+		c.DataType = "AudioFrame"
+		c.Fmt = c.FmtFirst
+		s.GopCache.MediaData.PushBack(c)
+		return nil
+	default:
 		err := fmt.Errorf("untreated SoundFormat %d", SoundFormat)
 		s.log.Println(err)
 		return err
@@ -1191,6 +1756,11 @@ func AudioHandle(s *Stream, c *Chunk) error {
 	return nil
 }
 
+// 音频帧, AAC的 和 没有音频头的(MP3, G.711)
+func ChunkIsAudioFrame(c *Chunk) bool {
+	return c.DataType == "AudioAacFrame" || c.DataType == "AudioFrame"
+}
+
 //AudioSpecificConfig is explained in ISO 14496-3, P52
 //ObjectType      uint8 // 5bit
 // 2	AAC-LC
@@ -1219,6 +1789,30 @@ type AudioSpecificConfig struct {
 	ExtensionFlag   uint8 // 1bit
 }
 
+// SamplingIdx 对应的采样率
+var AacSampleRates = []uint32{
+	96000, 88200, 64000, 48000, 44100, 32000, 24000,
+	22050, 16000, 12000, 11025, 8000, 7350,
+}
+
+// d 是AudioHeader的MsgData, 前2个字节是flv的AudioTagHeader
+func AudioSpecificConfigParse(d []byte) (*AudioSpecificConfig, error) {
+	if len(d) < 4 {
+		return nil, fmt.Errorf("AAC sequence header len %d is too short", len(d))
+	}
+	var AacC AudioSpecificConfig
+	AacC.ObjectType = (d[2] & 0xF8) >> 3
+	AacC.SamplingIdx = ((d[2] & 0x7) << 1) | (d[3] >> 7)
+	AacC.ChannelNum = (d[3] & 0x78) >> 3
+	AacC.FrameLenFlag = (d[3] & 0x4) >> 2
+	AacC.DependCoreCoder = (d[3] & 0x2) >> 1
+	AacC.ExtensionFlag = d[3] & 0x1
+	if int(AacC.SamplingIdx) >= len(AacSampleRates) {
+		return nil, fmt.Errorf("invalid AAC SamplingIdx %d", AacC.SamplingIdx)
+	}
+	return &AacC, nil
+}
+
 /**********************************************************/
 /* GopCache
 /**********************************************************/
@@ -1276,15 +1870,22 @@ func GopCacheUpdate(s *Stream) {
 }
 
 func GopCacheSend(s *Stream, gop *GopCache) error {
-	// 1 发送Metadata
+	// 1 发送Metadata, 没有音频或视频时 对应的Header为nil
+	// 只播放音频或视频时 PlayerChunk()返回nil 或 修改后的Metadata
 	s.log.Println("@@@ send Metadata")
-	MessageSplit(s, gop.MetaData)
+	if c := PlayerChunk(s, gop.MetaData); c != nil {
+		MessageSplit(s, c)
+	}
 	// 2 发送VideoHeader
 	s.log.Println("@@@ send VideoHeader")
-	MessageSplit(s, gop.VideoHeader)
+	if c := PlayerChunk(s, gop.VideoHeader); c != nil {
+		MessageSplit(s, c)
+	}
 	// 3 发送AudioHeader
 	s.log.Println("@@@ send AudioHeader")
-	MessageSplit(s, gop.AudioHeader)
+	if c := PlayerChunk(s, gop.AudioHeader); c != nil {
+		MessageSplit(s, c)
+	}
 	// 4 发送MediaData(包含最后收到的数据)
 	s.log.Println("@@@ send MediaData")
 	s.log.Println("@@@ GopCache.MediaData len", gop.MediaData.Len())
@@ -1292,6 +1893,9 @@ func GopCacheSend(s *Stream, gop *GopCache) error {
 	var err error
 	for e := gop.MediaData.Front(); e != nil; e = e.Next() {
 		v := (e.Value).(*Chunk)
+		if PlayerChunk(s, v) == nil {
+			continue
+		}
 		err = MessageSplit(s, v)
 		if err != nil {
 			s.log.Println(err)
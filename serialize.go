@@ -90,6 +90,15 @@ func ByteToInt32(b []byte, bo ByteOrder) int32 {
 	return u
 }
 
+// 24bit有符号数, 如flv视频tag里的CompositionTime
+func ByteToInt24(b []byte, bo ByteOrder) int32 {
+	u := ByteToUint32(b, bo) & 0xffffff
+	if u&0x800000 != 0 {
+		u |= 0xff000000
+	}
+	return int32(u)
+}
+
 func ByteToUint64(b []byte, bo ByteOrder) uint64 {
 	n := len(b)
 	if n > 8 {
@@ -156,7 +165,7 @@ func Uint64ToByte(u uint64, b []byte, bo ByteOrder) []byte {
 	bb := make([]byte, 8)
 	for i := 0; i < 8; i++ {
 		if bo == BE {
-			bb[i] = byte(u >> uint64((4-i-1)*8))
+			bb[i] = byte(u >> uint64((8-i-1)*8))
 		} else {
 			bb[i] = byte(u >> uint64(i*8))
 		}
@@ -312,3 +321,48 @@ func WriteUint64(w io.Writer, bo ByteOrder, u, n uint64) error {
 	}
 	return nil
 }
+
+// 按bit读取, h264的sps等 是按bit编码的
+type BitReader struct {
+	Data []byte
+	Pos  int // 当前读到第几个bit
+}
+
+// 读取n个bit(n <= 32), 超出范围的bit按0处理
+func BitRead(r *BitReader, n int) uint32 {
+	var u uint32
+	for i := 0; i < n; i++ {
+		u <<= 1
+		if r.Pos/8 < len(r.Data) {
+			u |= uint32(r.Data[r.Pos/8]>>(7-uint(r.Pos%8))) & 0x1
+		}
+		r.Pos++
+	}
+	return u
+}
+
+// 无符号指数哥伦布编码 ue(v)
+func BitReadUe(r *BitReader) uint32 {
+	zeros := 0
+	for BitRead(r, 1) == 0 {
+		zeros++
+		if zeros > 31 || r.Pos > len(r.Data)*8 {
+			return 0
+		}
+	}
+	return (1 << uint(zeros)) - 1 + BitRead(r, zeros)
+}
+
+// 有符号指数哥伦布编码 se(v)
+func BitReadSe(r *BitReader) int32 {
+	u := BitReadUe(r)
+	if u&0x1 == 1 {
+		return int32((u + 1) / 2)
+	}
+	return -int32(u / 2)
+}
+
+// 是否读取超出了数据范围
+func BitReadOver(r *BitReader) bool {
+	return r.Pos > len(r.Data)*8
+}
@@ -0,0 +1,727 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**********************************************************/
+/* vod
+/**********************************************************/
+// 点播录制的flv/mp4文件, 发布者不存在时 才查找点播文件
+// rtmp://ip/live/cctv1/cctv1_20220405102030.flv
+// rtmp://ip/live/mp4:cctv1/cctv1_20220405102030.mp4
+// 对应文件 VodPath/live/cctv1/cctv1_20220405102030.flv
+// play命令的Start和Duration单位是秒, Start<0表示从头播放, Duration<=0表示播放到结尾
+// 播放过程中 可以seek和pause, 按时间戳的间隔 实时发送
+type VodTag struct {
+	TagType   uint8  // 8音频, 9视频
+	Timestamp uint32 // 单位毫秒
+	Offset    int64  // 数据在文件中的位置
+	Size      uint32 // 数据在文件中的大小
+	KeyFrame  bool
+	Head      []byte // mp4的sample 要加上flv的AudioTagHeader/VideoTagHeader, flv的为nil
+}
+
+type VodFile struct {
+	Path        string
+	File        *os.File
+	Type        string // flv / mp4
+	Duration    uint32 // 单位毫秒
+	MetaData    []byte // "onMetaData" + object, 不含 "@setDataFrame"
+	VideoHeader []byte // flv的video tag数据, AVC sequence header
+	AudioHeader []byte // flv的audio tag数据, AAC sequence header
+	Tags        []VodTag
+	KeyFrames   []int // 关键帧在Tags中的下标
+}
+
+type VodCmd struct {
+	Name  string  // seek / pause / stop
+	Pause bool    // pause use, true暂停 false恢复
+	Ms    float64 // 单位毫秒
+}
+
+// 返回点播文件的路径, 不能访问VodPath以外的文件
+func VodFilename(app, name string) (string, bool) {
+	if !conf.Vod.Enable {
+		return "", false
+	}
+	name = strings.Split(name, "?")[0]
+	name = strings.TrimPrefix(strings.TrimPrefix(name, "mp4:"), "flv:")
+
+	root := filepath.Clean(conf.Vod.Path)
+	fn := filepath.Join(root, app, name)
+	if !strings.HasPrefix(fn, root+string(filepath.Separator)) {
+		return "", false
+	}
+
+	fns := []string{fn}
+	if filepath.Ext(fn) == "" {
+		fns = []string{fn + ".flv", fn + ".mp4"}
+	}
+	for _, f := range fns {
+		ext := filepath.Ext(f)
+		if ext != ".flv" && ext != ".mp4" {
+			continue
+		}
+		if fi, err := os.Stat(f); err == nil && fi.Mode().IsRegular() {
+			return f, true
+		}
+	}
+	return "", false
+}
+
+func VodFileOpen(s *Stream, fn string) (*VodFile, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	v := &VodFile{Path: fn, File: f}
+
+	if filepath.Ext(fn) == ".mp4" {
+		v.Type = "mp4"
+		err = VodMp4Index(s, v)
+	} else {
+		v.Type = "flv"
+		err = VodFlvIndex(s, v)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	// 只有音频时 每个音频帧都可以作为起播点
+	hasVideo := false
+	for _, t := range v.Tags {
+		if t.TagType == MsgTypeIdVideo {
+			hasVideo = true
+			break
+		}
+	}
+	for i := range v.Tags {
+		if !hasVideo {
+			v.Tags[i].KeyFrame = true
+		}
+		if v.Tags[i].KeyFrame {
+			v.KeyFrames = append(v.KeyFrames, i)
+		}
+	}
+	if n := len(v.Tags); n > 0 {
+		v.Duration = v.Tags[n-1].Timestamp
+	}
+	s.log.Printf("vod %s open, type %s, duration %dms, tag num %d, keyframe num %d", fn, v.Type, v.Duration, len(v.Tags), len(v.KeyFrames))
+	return v, nil
+}
+
+// flv文件 只读取Metadata和音视频头, 其他tag只记录位置
+func VodFlvIndex(s *Stream, v *VodFile) error {
+	fi, err := v.File.Stat()
+	if err != nil {
+		return err
+	}
+	size := fi.Size()
+
+	b := make([]byte, 13)
+	if _, err = v.File.ReadAt(b[:9], 0); err != nil {
+		return err
+	}
+	if string(b[:3]) != "FLV" {
+		return fmt.Errorf("%s is not flv file", v.Path)
+	}
+	off := int64(ByteToUint32(b[5:9], BE)) + 4 // 跳过 PreviousTagSize0
+
+	for off+11 <= size {
+		if _, err = v.File.ReadAt(b[:11], off); err != nil {
+			return err
+		}
+		t := FlvTagHeadParse(b[:11])
+		dataOff := off + 11
+		next := dataOff + int64(t.DataSize) + 4
+		if next > size {
+			s.log.Printf("%s last tag is incomplete, offset %d", v.Path, off)
+			break // 文件结尾不完整, 比如还在录制中
+		}
+		off = next
+		if t.DataSize < 2 && t.TagType != MsgTypeIdDataAmf0 {
+			continue
+		}
+
+		switch t.TagType {
+		case MsgTypeIdDataAmf0:
+			if v.MetaData == nil {
+				v.MetaData = make([]byte, t.DataSize)
+				if _, err = v.File.ReadAt(v.MetaData, dataOff); err != nil {
+					return err
+				}
+			}
+		case MsgTypeIdVideo, MsgTypeIdAudio:
+			if _, err = v.File.ReadAt(b[:2], dataOff); err != nil {
+				return err
+			}
+			// 视频 CodecID 7是AVC, 音频 SoundFormat 10是AAC
+			// AVCPacketType/AACPacketType 0是sequence header
+			isVideoHeader := t.TagType == MsgTypeIdVideo && b[0]&0xf == 7 && b[1] == 0
+			isAudioHeader := t.TagType == MsgTypeIdAudio && b[0]>>4 == 10 && b[1] == 0
+			if isVideoHeader || isAudioHeader {
+				d := make([]byte, t.DataSize)
+				if _, err = v.File.ReadAt(d, dataOff); err != nil {
+					return err
+				}
+				if isVideoHeader && v.VideoHeader == nil {
+					v.VideoHeader = d
+				} else if isAudioHeader && v.AudioHeader == nil {
+					v.AudioHeader = d
+				}
+				continue
+			}
+
+			vt := VodTag{
+				TagType:   t.TagType,
+				Timestamp: t.Timestamp,
+				Offset:    dataOff,
+				Size:      t.DataSize,
+			}
+			if t.TagType == MsgTypeIdVideo {
+				vt.KeyFrame = b[0]>>4 == 1
+			}
+			v.Tags = append(v.Tags, vt)
+		}
+	}
+	return nil
+}
+
+// mp4文件 转为flv的tag, sample数据前面加上 AudioTagHeader/VideoTagHeader
+func VodMp4Index(s *Stream, v *VodFile) error {
+	m, err := Mp4FileParse(v.File)
+	if err != nil {
+		return err
+	}
+
+	if t := m.Video; t != nil {
+		// CodecId avc是7, hevc是12
+		var codecId byte = 7
+		if Mp4TrackIsHevc(t) {
+			codecId = 12
+		}
+		v.VideoHeader = append([]byte{0x10 | codecId, 0x0, 0x0, 0x0, 0x0}, t.Config...)
+		for _, sp := range t.AllSamples {
+			h := []byte{0x20 | codecId, 0x1, 0x0, 0x0, 0x0}
+			if sp.KeyFrame {
+				h[0] = 0x10 | codecId
+			}
+			cts := int64(sp.Cts) * 1000 / int64(t.Timescale)
+			Uint24ToByte(uint32(cts)&0xffffff, h[2:5], BE)
+			v.Tags = append(v.Tags, VodTag{
+				TagType:   MsgTypeIdVideo,
+				Timestamp: uint32(sp.Dts * 1000 / uint64(t.Timescale)),
+				Offset:    sp.Offset,
+				Size:      sp.Size,
+				KeyFrame:  sp.KeyFrame,
+				Head:      h,
+			})
+		}
+	}
+	if t := m.Audio; t != nil {
+		// 0xaf: SoundFormat=10(AAC), 44kHz, 16bit, stereo; AAC固定为这个值
+		v.AudioHeader = append([]byte{0xaf, 0x0}, t.Config...)
+		h := []byte{0xaf, 0x1}
+		for _, sp := range t.AllSamples {
+			v.Tags = append(v.Tags, VodTag{
+				TagType:   MsgTypeIdAudio,
+				Timestamp: uint32(sp.Dts * 1000 / uint64(t.Timescale)),
+				Offset:    sp.Offset,
+				Size:      sp.Size,
+				Head:      h,
+			})
+		}
+	}
+	// 音视频按时间戳交错, 时间戳相同时 按文件中的位置
+	sort.SliceStable(v.Tags, func(i, j int) bool {
+		if v.Tags[i].Timestamp != v.Tags[j].Timestamp {
+			return v.Tags[i].Timestamp < v.Tags[j].Timestamp
+		}
+		return v.Tags[i].Offset < v.Tags[j].Offset
+	})
+
+	md := Object{"duration": 0.0}
+	if n := len(v.Tags); n > 0 {
+		md["duration"] = float64(v.Tags[n-1].Timestamp) / 1000
+	}
+	if t := m.Video; t != nil {
+		md["width"] = float64(t.Width)
+		md["height"] = float64(t.Height)
+		md["videocodecid"] = 7.0
+	}
+	if t := m.Audio; t != nil {
+		md["audiosamplerate"] = float64(t.SampleRate)
+		md["audiochannels"] = float64(t.ChannelNum)
+		md["audiocodecid"] = 10.0
+	}
+	v.MetaData, err = AmfMarshal(s, "onMetaData", md)
+	return err
+}
+
+// 返回ms之前最近的关键帧在Tags中的下标
+func VodSeek(v *VodFile, ms uint32) int {
+	n := sort.Search(len(v.KeyFrames), func(i int) bool {
+		return v.Tags[v.KeyFrames[i]].Timestamp > ms
+	})
+	if n == 0 {
+		if len(v.KeyFrames) > 0 {
+			return v.KeyFrames[0]
+		}
+		return 0
+	}
+	return v.KeyFrames[n-1]
+}
+
+// tag的数据, mp4的要加上Head
+func VodTagRead(v *VodFile, t *VodTag) ([]byte, error) {
+	d := make([]byte, len(t.Head)+int(t.Size))
+	copy(d, t.Head)
+	if _, err := v.File.ReadAt(d[len(t.Head):], t.Offset); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+/**********************************************************/
+/* rtmp vod player
+/**********************************************************/
+func VodPlayer(s *Stream, fn string) {
+	s.Key = fmt.Sprintf("%s_%s_%s", s.AmfInfo.App,
+		s.AmfInfo.StreamName, s.RemoteAddr)
+	s.log.Println("vod player key is", s.Key)
+
+	v, err := VodFileOpen(s, fn)
+	if err != nil {
+		s.log.Println(err)
+		VodStatusSend(s, "error", "NetStream.Play.StreamNotFound", err.Error())
+		s.Conn.Close()
+		return
+	}
+
+	ch := make(chan VodCmd, 5)
+	go VodCmdReceiver(s, ch)
+	VodSender(s, v, ch)
+
+	v.File.Close()
+	s.Conn.Close()
+	s.log.Printf("%s VodPlayer stop", s.Key)
+}
+
+// 接收播放者的命令 seek/pause/closeStream 等
+// 注意: 这里不发送Ack, 避免和发送协程同时写连接; 播放者发来的数据很少
+func VodCmdReceiver(s *Stream, ch chan VodCmd) {
+	defer close(ch)
+	for {
+		c, err := MessageMerge(s, nil)
+		if err != nil {
+			s.log.Println(err)
+			return
+		}
+
+		switch c.MsgTypeId {
+		case MsgTypeIdSetChunkSize, MsgTypeIdWindowAckSize:
+			MessageHandle(s, &c)
+			continue
+		case MsgTypeIdCmdAmf0:
+		default:
+			s.log.Printf("vod ignore MsgTypeId %d", c.MsgTypeId)
+			continue
+		}
+
+		vs, err := AmfUnmarshal(s, bytes.NewReader(c.MsgData))
+		if err != nil && err != io.EOF {
+			s.log.Println(err)
+			continue
+		}
+		if len(vs) == 0 {
+			continue
+		}
+		name, _ := vs[0].(string)
+		s.log.Printf("vod cmd %s, %#v", name, vs)
+
+		// seek: "seek" + TransactionId + null + milliSeconds
+		// pause: "pause" + TransactionId + null + pause(bool) + milliSeconds
+		var cmd VodCmd
+		switch name {
+		case "seek":
+			if len(vs) < 4 {
+				continue
+			}
+			cmd.Name = "seek"
+			cmd.Ms, _ = vs[3].(float64)
+		case "pause":
+			if len(vs) < 5 {
+				continue
+			}
+			cmd.Name = "pause"
+			cmd.Pause, _ = vs[3].(bool)
+			cmd.Ms, _ = vs[4].(float64)
+		case "closeStream", "deleteStream":
+			cmd.Name = "stop"
+		default:
+			continue
+		}
+
+		select {
+		case ch <- cmd:
+		default:
+			s.log.Printf("vod cmd %s is dropped", cmd.Name)
+		}
+		if cmd.Name == "stop" {
+			return
+		}
+	}
+}
+
+// 按tag的时间戳 实时发送, 时间到了才发送下一个tag
+func VodSender(s *Stream, v *VodFile, ch chan VodCmd) {
+	var start, end uint32 = 0, 0xffffffff
+	if s.AmfInfo.Start > 0 {
+		start = uint32(s.AmfInfo.Start * 1000)
+	}
+	if s.AmfInfo.Duration > 0 {
+		end = start + uint32(s.AmfInfo.Duration*1000)
+	}
+
+	idx := VodSeek(v, start)
+	if err := VodHeadSend(s, v, idx); err != nil {
+		return
+	}
+	t0, ts0 := time.Now(), VodTagTimestamp(v, idx)
+	paused, over := false, false
+
+	for {
+		var timeout <-chan time.Time
+		if !paused && !over {
+			if idx >= len(v.Tags) || v.Tags[idx].Timestamp > end {
+				over = true
+				VodStopSend(s)
+				continue
+			}
+
+			t := &v.Tags[idx]
+			wait := time.Duration(int64(t.Timestamp)-int64(ts0))*time.Millisecond - time.Since(t0)
+			if wait <= 0 {
+				if err := VodTagSend(s, v, t); err != nil {
+					s.log.Println(err)
+					return
+				}
+				idx++
+				continue
+			}
+			timeout = time.After(wait)
+		}
+
+		// 暂停或播放结束时 只等待命令
+		select {
+		case cmd, ok := <-ch:
+			if !ok || cmd.Name == "stop" {
+				return
+			}
+			switch cmd.Name {
+			case "seek":
+				idx = VodSeek(v, uint32(cmd.Ms))
+				s.log.Printf("vod seek to %.0fms, tag index %d", cmd.Ms, idx)
+				VodStatusSend(s, "status", "NetStream.Seek.Notify", "Seeking and resetting stream.")
+				VodStatusSend(s, "status", "NetStream.Play.Start", "Started playing stream.")
+				if err := VodHeadSend(s, v, idx); err != nil {
+					return
+				}
+				over = false
+			case "pause":
+				paused = cmd.Pause
+				if paused {
+					s.log.Printf("vod pause at %.0fms", cmd.Ms)
+					VodStatusSend(s, "status", "NetStream.Pause.Notify", "Pausing stream.")
+				} else {
+					s.log.Printf("vod unpause at %.0fms", cmd.Ms)
+					VodStatusSend(s, "status", "NetStream.Unpause.Notify", "Unpausing stream.")
+				}
+			}
+			t0, ts0 = time.Now(), VodTagTimestamp(v, idx)
+		case <-timeout:
+		}
+	}
+}
+
+func VodTagTimestamp(v *VodFile, idx int) uint32 {
+	if idx < len(v.Tags) {
+		return v.Tags[idx].Timestamp
+	}
+	return v.Duration
+}
+
+func VodChunkCreate(TypeId uint32, Timestamp uint32, d []byte) *Chunk {
+	c := CreateMessage(TypeId, uint32(len(d)), d)
+	c.Timestamp = Timestamp
+	c.MsgStreamId = 1
+	switch TypeId {
+	case MsgTypeIdAudio:
+		c.Csid = 4
+	case MsgTypeIdVideo:
+		c.Csid = 6
+	default:
+		c.Csid = 5
+	}
+	return &c
+}
+
+// 起播和seek后 先发送 Metadata VideoHeader AudioHeader
+func VodHeadSend(s *Stream, v *VodFile, idx int) error {
+	ts := VodTagTimestamp(v, idx)
+	for _, h := range []struct {
+		TypeId uint32
+		Data   []byte
+	}{
+		{MsgTypeIdDataAmf0, v.MetaData},
+		{MsgTypeIdVideo, v.VideoHeader},
+		{MsgTypeIdAudio, v.AudioHeader},
+	} {
+		if h.Data == nil {
+			continue
+		}
+		if err := MessageSplit(s, VodChunkCreate(h.TypeId, ts, h.Data)); err != nil {
+			s.log.Println(err)
+			return err
+		}
+	}
+	return nil
+}
+
+func VodTagSend(s *Stream, v *VodFile, t *VodTag) error {
+	d, err := VodTagRead(v, t)
+	if err != nil {
+		return err
+	}
+	return MessageSplit(s, VodChunkCreate(uint32(t.TagType), t.Timestamp, d))
+}
+
+// 播放结束: StreamEOF + NetStream.Play.Stop, 连接不断开 还可以seek
+func VodStopSend(s *Stream) {
+	s.log.Println("vod play over")
+	d := make([]byte, 6)
+	Uint16ToByte(1, d[0:2], BE) // EventType, StreamEOF
+	Uint32ToByte(1, d[2:], BE)  // StreamId
+	rc := CreateMessage(MsgTypeIdUserControl, 6, d)
+	MessageSplit(s, &rc)
+
+	VodStatusSend(s, "status", "NetStream.Play.Stop", "Stopped playing stream.")
+}
+
+func VodStatusSend(s *Stream, level, code, desc string) {
+	info := make(Object)
+	info["level"] = level
+	info["code"] = code
+	info["description"] = desc
+	d, _ := AmfMarshal(s, "onStatus", 0, nil, info) // 结构化转序列化
+	rc := VodChunkCreate(MsgTypeIdCmdAmf0, 0, d)
+	MessageSplit(s, rc)
+}
+
+/**********************************************************/
+/* http vod
+/**********************************************************/
+// GET http://www.domain.com/live/cctv1/cctv1_20220405102030.flv
+// GET http://www.domain.com/live/cctv1/cctv1_20220405102030.flv?start=60
+// GET http://www.domain.com/live/cctv1/cctv1_20220405102030.mp4
+// 支持Range请求; flv的onMetaData里 加入关键帧索引 keyframes.times/filepositions
+// flv可以用start参数(单位秒) 从最近的关键帧开始播放, 播放器拖动进度条时使用
+func VodHttpFilename(p string) (string, bool) {
+	ext := path.Ext(p)
+	if ext != ".flv" && ext != ".mp4" {
+		return "", false
+	}
+	// 直播优先, 和直播流同名的点播文件 不返回
+	if ext == ".flv" {
+		app, stream, _ := GetPlayInfo(p)
+		if _, ok := PublisherGet(fmt.Sprintf("%s_%s", app, stream)); ok {
+			return "", false
+		}
+	}
+	ss := strings.SplitN(strings.TrimPrefix(p, "/"), "/", 2)
+	if len(ss) < 2 {
+		return "", false
+	}
+	return VodFilename(ss[0], ss[1])
+}
+
+func GetVod(w http.ResponseWriter, r *http.Request, fn string) {
+	log.Println("vod file is", fn)
+	// amf编解码的日志太多, 不记录
+	s := &Stream{RemoteAddr: r.RemoteAddr, log: log.New(ioutil.Discard, "", 0)}
+
+	fi, err := os.Stat(fn)
+	if err != nil {
+		log.Println(err)
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Server", AppName)
+
+	if path.Ext(fn) == ".mp4" {
+		f, err := os.Open(fn)
+		if err != nil {
+			log.Println(err)
+			http.NotFound(w, r)
+			return
+		}
+		defer f.Close()
+		w.Header().Set("Content-Type", "video/mp4")
+		http.ServeContent(w, r, path.Base(fn), fi.ModTime(), f)
+		return
+	}
+
+	v, err := VodFileOpen(s, fn)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer v.File.Close()
+
+	var start uint32
+	if ss := r.URL.Query().Get("start"); ss != "" {
+		sec, err := strconv.ParseFloat(ss, 64)
+		if err == nil && sec > 0 {
+			start = uint32(sec * 1000)
+		}
+	}
+	rs, err := VodFlvReader(s, v, VodSeek(v, start))
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "video/x-flv")
+	http.ServeContent(w, r, path.Base(fn), fi.ModTime(), rs)
+}
+
+// 发送给播放者的flv文件 = 新生成的文件头 + 原文件从idx开始的tag
+// 新生成的文件头 = FlvHead + Metadata(含关键帧索引) + VideoHeader + AudioHeader
+func VodFlvReader(s *Stream, v *VodFile, idx int) (io.ReadSeeker, error) {
+	fi, err := v.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := fi.Size()
+	var start int64 = size
+	if idx < len(v.Tags) {
+		start = v.Tags[idx].Offset - 11
+	}
+
+	// amf的number固定是9字节, 文件头的大小 和filepositions的值无关
+	head, err := VodFlvHeadCreate(s, v, idx, 0)
+	if err != nil {
+		return nil, err
+	}
+	head, err = VodFlvHeadCreate(s, v, idx, int64(len(head))-start)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &VodMultiReader{Parts: []*io.SectionReader{
+		io.NewSectionReader(bytes.NewReader(head), 0, int64(len(head))),
+		io.NewSectionReader(v.File, start, size-start),
+	}}
+	return io.NewSectionReader(m, 0, int64(len(head))+size-start), nil
+}
+
+// delta 是原文件位置 到 新文件位置的偏移
+func VodFlvHeadCreate(s *Stream, v *VodFile, idx int, delta int64) ([]byte, error) {
+	md := make(Object)
+	if v.MetaData != nil {
+		vs, err := AmfUnmarshal(s, bytes.NewReader(v.MetaData))
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if len(vs) > 1 {
+			if o, ok := vs[1].(Object); ok {
+				md = o
+			}
+		}
+	}
+
+	var times, poss []float64
+	for _, i := range v.KeyFrames {
+		if i < idx {
+			continue
+		}
+		times = append(times, float64(v.Tags[i].Timestamp)/1000)
+		poss = append(poss, float64(v.Tags[i].Offset-11+delta))
+	}
+	md["duration"] = float64(v.Duration) / 1000
+	md["hasKeyframes"] = true
+	md["keyframes"] = Object{"times": times, "filepositions": poss}
+	d, err := AmfMarshal(s, "onMetaData", md)
+	if err != nil {
+		return nil, err
+	}
+
+	var h FlvHead
+	h.Signature0 = 0x46
+	h.Signature1 = 0x4c
+	h.Signature2 = 0x56
+	h.Version = 0x01
+	h.Offset = 0x9
+	if v.AudioHeader != nil {
+		h.FlagAudio = 0x1
+	}
+	if v.VideoHeader != nil {
+		h.FlagVideo = 0x1
+	}
+
+	ts := VodTagTimestamp(v, idx)
+	buf := bytes.NewBuffer(FlvHeadCreate(h))
+	buf.Write(FlvTagCreate(MsgTypeIdDataAmf0, 0, d))
+	if v.VideoHeader != nil {
+		buf.Write(FlvTagCreate(MsgTypeIdVideo, ts, v.VideoHeader))
+	}
+	if v.AudioHeader != nil {
+		buf.Write(FlvTagCreate(MsgTypeIdAudio, ts, v.AudioHeader))
+	}
+	return buf.Bytes(), nil
+}
+
+// 多个SectionReader 拼接成一个ReaderAt
+type VodMultiReader struct {
+	Parts []*io.SectionReader
+}
+
+func (m *VodMultiReader) ReadAt(p []byte, off int64) (int, error) {
+	var n int
+	for _, r := range m.Parts {
+		if len(p) == 0 {
+			break
+		}
+		if off >= r.Size() {
+			off -= r.Size()
+			continue
+		}
+		k, err := r.ReadAt(p, off)
+		n += k
+		p = p[k:]
+		off = 0
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+	}
+	if len(p) > 0 {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+/**********************************************************/
+/* websocket
+/**********************************************************/
+// https://datatracker.ietf.org/doc/html/rfc6455
+// 只实现播放需要的部分: 握手, 服务端发送不掩码的数据帧, 接收客户端的控制帧
+//  0                   1                   2                   3
+//  0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+// +-+-+-+-+-------+-+-------------+-------------------------------+
+// |F|R|R|R| opcode|M| Payload len |    Extended payload length    |
+// |I|S|S|S|  (4)  |A|     (7)     |             (16/64)           |
+// |N|V|V|V|       |S|             |   (if payload len==126/127)   |
+// | |1|2|3|       |K|             |                               |
+// +-+-+-+-+-------+-+-------------+ - - - - - - - - - - - - - - - +
+// |     Extended payload length continued, if payload len == 127  |
+// + - - - - - - - - - - - - - - - +-------------------------------+
+// |                               |Masking-key, if MASK set to 1  |
+// +-------------------------------+-------------------------------+
+// | Masking-key (continued)       |          Payload Data         |
+// +-------------------------------- - - - - - - - - - - - - - - - +
+const (
+	WsGuid           = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	WsOpContinue     = 0x0
+	WsOpText         = 0x1
+	WsOpBinary       = 0x2
+	WsOpClose        = 0x8
+	WsOpPing         = 0x9
+	WsOpPong         = 0xa
+	WsMaxCtrlPayload = 125 // 控制帧的数据 不能超过125字节
+)
+
+// 发送协程写数据帧, 接收协程回应ping和close, 所以写要加锁
+type WsConn struct {
+	Conn net.Conn
+	Rw   *bufio.ReadWriter
+	Lock sync.Mutex
+}
+
+// Connection: Upgrade 可能是 "keep-alive, Upgrade"
+func WsIsUpgrade(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") &&
+		strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade")
+}
+
+func WsAcceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + WsGuid))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// 接管http的tcp连接, 回复101后 连接上就是websocket数据帧了
+// https时 Hijack()拿到的是tls连接, 所以wss不用另外处理
+func WsUpgrade(w http.ResponseWriter, r *http.Request) (*WsConn, error) {
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		return nil, fmt.Errorf("websocket version %s isn't support",
+			r.Header.Get("Sec-WebSocket-Version"))
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		return nil, fmt.Errorf("Sec-WebSocket-Key is empty")
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, fmt.Errorf("http connection can't be hijacked")
+	}
+	c, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	s := "HTTP/1.1 101 Switching Protocols\r\n"
+	s += "Upgrade: websocket\r\n"
+	s += "Connection: Upgrade\r\n"
+	s += fmt.Sprintf("Sec-WebSocket-Accept: %s\r\n", WsAcceptKey(key))
+	s += fmt.Sprintf("Server: %s\r\n\r\n", AppName)
+	if _, err = c.Write([]byte(s)); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return &WsConn{Conn: c, Rw: rw}, nil
+}
+
+// 一次Write()就是一个二进制帧, 实现io.Writer 可以直接作为FlvWriter
+func (ws *WsConn) Write(d []byte) (int, error) {
+	if err := WsFrameWrite(ws, WsOpBinary, d); err != nil {
+		return 0, err
+	}
+	return len(d), nil
+}
+
+// 服务端发送的帧 不需要掩码
+func WsFrameWrite(ws *WsConn, opcode uint8, d []byte) error {
+	n := len(d)
+	h := make([]byte, 2, 10)
+	h[0] = 0x80 | opcode // FIN=1
+	switch {
+	case n < 126:
+		h[1] = uint8(n)
+	case n <= 0xffff:
+		h[1] = 126
+		h = append(h, Uint16ToByte(uint16(n), nil, BE)...)
+	default:
+		h[1] = 127
+		h = append(h, Uint64ToByte(uint64(n), nil, BE)...)
+	}
+
+	ws.Lock.Lock()
+	defer ws.Lock.Unlock()
+	// 头和数据合并发送, 避免拆成两个tcp包
+	_, err := ws.Conn.Write(append(h, d...))
+	return err
+}
+
+// 读取一个帧, 客户端发送的帧 必须有掩码
+func WsFrameRead(ws *WsConn) (uint8, []byte, error) {
+	h, err := ReadByte(ws.Rw, 2)
+	if err != nil {
+		return 0, nil, err
+	}
+	opcode := h[0] & 0xf
+	mask := h[1]&0x80 != 0
+	n := uint64(h[1] & 0x7f)
+	switch n {
+	case 126:
+		u, err := ReadUint16(ws.Rw, 2, BE)
+		if err != nil {
+			return 0, nil, err
+		}
+		n = uint64(u)
+	case 127:
+		u, err := ReadUint64(ws.Rw, 8, BE)
+		if err != nil {
+			return 0, nil, err
+		}
+		n = u
+	}
+	if !mask {
+		return 0, nil, fmt.Errorf("websocket client frame isn't masked")
+	}
+	// websocket推流时 一个帧一般是一个flv tag, flv tag最大16MB
+	if n > 0xffffff {
+		return 0, nil, fmt.Errorf("websocket frame too big, %d", n)
+	}
+
+	key, err := ReadByte(ws.Rw, 4)
+	if err != nil {
+		return 0, nil, err
+	}
+	d, err := ReadByte(ws.Rw, uint32(n))
+	if err != nil {
+		return 0, nil, err
+	}
+	for i := range d {
+		d[i] ^= key[i%4]
+	}
+	return opcode, d, nil
+}
+
+// 把客户端发来的数据帧 连起来当作字节流读取, 帧的边界不影响读取
+// ping回复pong, close回复close 并返回io.EOF
+type WsReader struct {
+	Ws  *WsConn
+	Buf []byte
+}
+
+func (wr *WsReader) Read(p []byte) (int, error) {
+	for len(wr.Buf) == 0 {
+		opcode, d, err := WsFrameRead(wr.Ws)
+		if err != nil {
+			return 0, err
+		}
+		switch opcode {
+		case WsOpBinary, WsOpText, WsOpContinue:
+			wr.Buf = d
+		case WsOpPing:
+			if len(d) > WsMaxCtrlPayload {
+				d = d[:WsMaxCtrlPayload]
+			}
+			if err = WsFrameWrite(wr.Ws, WsOpPong, d); err != nil {
+				return 0, err
+			}
+		case WsOpClose:
+			if len(d) > 2 {
+				d = d[:2] // 只回复关闭码
+			}
+			WsFrameWrite(wr.Ws, WsOpClose, d)
+			return 0, io.EOF
+		}
+	}
+	n := copy(p, wr.Buf)
+	wr.Buf = wr.Buf[n:]
+	return n, nil
+}
+
+// 播放时 接收客户端的帧, 直到客户端关闭或连接断开, 数据帧丢弃
+func WsReceiver(ws *WsConn) error {
+	_, err := io.Copy(ioutil.Discard, &WsReader{Ws: ws})
+	return err
+}
+
+// 服务端主动关闭, 关闭码1000 表示正常关闭
+func WsClose(ws *WsConn) {
+	WsFrameWrite(ws, WsOpClose, Uint16ToByte(1000, nil, BE))
+	ws.Conn.Close()
+}